@@ -0,0 +1,182 @@
+// Per-target access control lists: who may open which door.
+//
+// The policy is read from a CSV file, one rule per target:
+//
+//	# target,levels,users
+//	elevator,member;philanthropist;trustedphilanthropist;fulltimeuser,
+//	upstairs,member;fulltimeuser,Jane Doe;Jon Doe
+//
+// Only the listed levels and the users listed by name may open a target that
+// has a rule. Targets without a rule are open to everyone (subject to the
+// usual time limits). Users can in addition be restricted to particular
+// targets in the user file.
+//
+// A rule that can't be parsed locks its target for everyone until fixed. A
+// file that can't be read at all, or has a line without a target, is not
+// used; the rules read before stay in effect.
+//
+// Like the user file, the policy is re-read whenever it changes.
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TargetRule struct {
+	Levels []Level
+	Users  []string // User names.
+}
+
+type AccessPolicy struct {
+	filename string
+
+	lock          sync.Mutex
+	fileTimestamp time.Time
+	rules         map[Target]*TargetRule
+}
+
+func (r *TargetRule) Allows(user *User) bool {
+	for _, level := range r.Levels {
+		if level == user.UserLevel {
+			return true
+		}
+	}
+	for _, name := range r.Users {
+		if name == user.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a rule. On error, the target is still returned if known, so that
+// it can be locked.
+func NewTargetRuleFromCSVLine(line []string) (Target, *TargetRule, error) {
+	target := Target(strings.TrimSpace(line[0]))
+	if target == "" {
+		return "", nil, fmt.Errorf("empty target")
+	}
+	if len(line) != 3 {
+		return target, nil, fmt.Errorf("expected 3 fields, got %d", len(line))
+	}
+	rule := &TargetRule{}
+	for _, level := range strings.Split(line[1], ";") {
+		level = strings.TrimSpace(level)
+		if level == "" {
+			continue
+		}
+		if !isValidLevel(level) {
+			return target, nil, fmt.Errorf("invalid level '%s'", level)
+		}
+		rule.Levels = append(rule.Levels, Level(level))
+	}
+	for _, name := range strings.Split(line[2], ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			rule.Users = append(rule.Users, name)
+		}
+	}
+	return target, rule, nil
+}
+
+// Create an access policy from the given file. Returns nil if the file
+// can't be read.
+func NewAccessPolicy(filename string) *AccessPolicy {
+	p := &AccessPolicy{filename: filename}
+	if !p.readPolicy() {
+		return nil
+	}
+	return p
+}
+
+func (p *AccessPolicy) readPolicy() bool {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		log.Println("Could not read access policy", err)
+		return false
+	}
+	defer f.Close()
+	fileinfo, _ := f.Stat()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	rules := make(map[Target]*TargetRule)
+	for lineno := 1; ; lineno++ {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("%s: %v; not using this file.", p.filename, err)
+			p.keepRules(fileinfo.ModTime())
+			return false
+		}
+		target, rule, err := NewTargetRuleFromCSVLine(line)
+		if err != nil && target == "" {
+			log.Printf("%s:%d: %v; not using this file.", p.filename, lineno, err)
+			p.keepRules(fileinfo.ModTime())
+			return false
+		}
+		if err != nil {
+			log.Printf("%s:%d: %v; nobody may open %s until fixed.",
+				p.filename, lineno, err, target)
+			rules[target] = &TargetRule{} // Allows no one.
+			continue
+		}
+		if _, exists := rules[target]; exists {
+			log.Printf("%s:%d: duplicate rule for %s; ignored.",
+				p.filename, lineno, target)
+			continue
+		}
+		rules[target] = rule
+	}
+	log.Printf("Read access rules for %d targets from %s", len(rules), p.filename)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fileTimestamp = fileinfo.ModTime()
+	p.rules = rules
+	return true
+}
+
+// Remember the file as read, but keep the rules we have.
+func (p *AccessPolicy) keepRules(fileTimestamp time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fileTimestamp = fileTimestamp
+}
+
+func (p *AccessPolicy) reloadIfChanged() {
+	fileinfo, err := os.Stat(p.filename)
+	if err != nil {
+		return // Keep what we have.
+	}
+	p.lock.Lock()
+	unchanged := p.fileTimestamp == fileinfo.ModTime()
+	p.lock.Unlock()
+	if unchanged {
+		return
+	}
+	log.Printf("Refreshing changed %s", p.filename)
+	p.readPolicy()
+}
+
+// Is the user allowed to open the target at all ? Can be called on a nil
+// AccessPolicy, which allows everything.
+func (p *AccessPolicy) Allows(user *User, target Target) bool {
+	if p == nil {
+		return true
+	}
+	p.reloadIfChanged()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rule, exists := p.rules[target]
+	return !exists || rule.Allows(user)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAccessPolicyRules(t *testing.T) {
+	policyFile, _ := ioutil.TempFile("", "test-policy")
+	policyFile.WriteString(`# target,levels,users
+elevator,member;fulltimeuser,Jon Doe
+upstairs,member,
+upstairs,user,
+gate,nosuchlevel,
+`)
+	policyFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(policyFile.Name())
+	}
+	policy := NewAccessPolicy(policyFile.Name())
+	if policy == nil {
+		t.Fatal("Could not read policy")
+	}
+
+	member := &User{Name: "Some Member", UserLevel: LevelMember}
+	user := &User{Name: "Some User", UserLevel: LevelUser}
+	jon := &User{Name: "Jon Doe", UserLevel: LevelUser}
+
+	ExpectTrue(t, policy.Allows(member, TargetElevator), "Member in elevator")
+	ExpectFalse(t, policy.Allows(user, TargetElevator), "User in elevator")
+	ExpectTrue(t, policy.Allows(jon, TargetElevator), "Named user in elevator")
+	ExpectFalse(t, policy.Allows(user, TargetUpstairs), "Duplicate rule ignored")
+	ExpectFalse(t, policy.Allows(member, TargetDownstairs), "Broken rule locks target")
+	ExpectTrue(t, policy.Allows(user, TargetControlUI), "No rule for target")
+
+	var noPolicy *AccessPolicy
+	ExpectTrue(t, noPolicy.Allows(user, TargetElevator), "nil policy")
+
+	// Modify file. Change the timestamp to make sure it is noticed.
+	ioutil.WriteFile(policyFile.Name(), []byte("elevator,user,\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(policyFile.Name(), later, later)
+	ExpectTrue(t, policy.Allows(user, TargetElevator), "Reloaded policy")
+	ExpectTrue(t, policy.Allows(user, TargetUpstairs), "Upstairs rule gone")
+
+	// A file we can't make sense of is not used.
+	ioutil.WriteFile(policyFile.Name(), []byte(",member,\n"), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(policyFile.Name(), later, later)
+	ExpectTrue(t, policy.Allows(user, TargetElevator), "Previous rules kept")
+	ExpectTrue(t, policy.Allows(user, TargetUpstairs), "Still no upstairs rule")
+	ioutil.WriteFile(policyFile.Name(), []byte("elevator,member,\n\"unterminated\n"), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(policyFile.Name(), later, later)
+	ExpectTrue(t, policy.Allows(user, TargetElevator), "Previous rules kept on read error")
+}
+
+func TestAuthenticatorWithAccessPolicy(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "policy-auth-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	policyFile, _ := ioutil.TempFile("", "test-policy")
+	policyFile.WriteString("elevator,member,\n")
+	policyFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(policyFile.Name())
+	}
+	auth.policy = NewAccessPolicy(policyFile.Name())
+
+	u := User{
+		Name:        "Philanthropist",
+		ContactInfo: "phil@noisebridge.net",
+		UserLevel:   LevelPhilanthropist}
+	u.SetAuthCode("phil123")
+	auth.AddNewUser("root123", u)
+
+	ExpectAuthResult(t, auth, "root123", TargetElevator, AuthOk, "")
+	ExpectAuthResult(t, auth, "phil123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "phil123", TargetElevator,
+		AuthTargetDenied, "philanthropist has no access to elevator")
+	ExpectAuthResult(t, auth, "nobody123", TargetElevator,
+		AuthFail, "No user")
+
+	// A typo in a rule doesn't open the target to everyone.
+	ioutil.WriteFile(policyFile.Name(), []byte("elevator,membr,\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(policyFile.Name(), later, later)
+	ExpectAuthResult(t, auth, "phil123", TargetElevator,
+		AuthTargetDenied, "philanthropist has no access to elevator")
+	ExpectAuthResult(t, auth, "phil123", TargetUpstairs, AuthOk, "")
+}
@@ -133,6 +133,8 @@ func (h *AccessHandler) checkAccess(code string, fyi_origin string) {
 	target := Target(h.t.GetTerminalName())
 	user := h.backends.authenticator.FindUser(code)
 	auth_result, msg := h.backends.authenticator.AuthUser(code, target)
+	h.backends.auditLog.RecordAttempt(h.clock.Now(), target, fyi_origin, code,
+		user, auth_result, msg)
 	if user != nil && auth_result == AuthOk {
 		h.t.BuzzSpeaker("H", 500)
 		// Be sparse, don't log user, but keep track of level.
@@ -158,6 +160,11 @@ func (h *AccessHandler) checkAccess(code string, fyi_origin string) {
 			target, msg, fyi_origin, scrubLogValue(code))
 		if auth_result == AuthFail {
 			h.setColorForTime("R", 500*time.Millisecond)
+		} else if auth_result == AuthTargetDenied {
+			// Valid user, but this is not their door. Show
+			// purple; no nightbell, as nobody should open for
+			// them either.
+			h.setColorForTime("RB", 1000*time.Millisecond)
 		} else {
 			// Show blue (='nighttime') for authentication that is
 			// just failing due to be outside daytime (or expired).
@@ -49,6 +49,8 @@ func (a *MockAuthenticator) DeleteUser(auth_code string, user_code string) (bool
 	return false, ""
 }
 
+func (a *MockAuthenticator) IterateUsers(callback func(user User)) {}
+
 type Buzz struct {
 	toneCode string
 	duration time.Duration
@@ -150,7 +152,7 @@ func (f *TestFixture) FlushAllAppEvents() {
 		// Events accumulated for the term: give it to handle
 		case event := <-f.termEventChannel:
 			f.handlerUnderTest.HandleAppEvent(event)
-		case <-time.After(0):
+		default:
 			return // done.
 		}
 	}
@@ -176,7 +178,7 @@ func (f *TestFixture) ExpectNoMoreEvents() {
 	case event := <-f.expectEventChannel:
 		f.tester.Errorf("Didn't expect event but got %s:%s\n",
 			event.Ev, event.Target)
-	case <-time.After(0):
+	default:
 		// Good.
 	}
 }
@@ -223,6 +225,17 @@ func TestExpiredAccessCode(t *testing.T) {
 	testFixture.ExpectNoMoreEvents()
 }
 
+func TestTargetDeniedAccessCode(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthTargetDenied
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.FlushAllAppEvents()
+
+	testFixture.mockterm.expectColor("RB") // purple
+	testFixture.mockterm.expectBuzz(Buzz{"L", 200})
+	testFixture.ExpectNoMoreEvents() // In particular: no nightbell.
+}
+
 func TestKeypadDoorbell(t *testing.T) {
 	testFixture := NewTestFixture(t)
 	// Just a single '#' should ring the bell.
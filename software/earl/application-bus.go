@@ -16,12 +16,60 @@
 //
 // The appliation bus allows interested parties to Subscribe() to events that
 // are being Post()ed to the bus.
+//
+// Each subscriber has its own queue, so that a slow subscriber (say, a stuck
+// HTTP client) can't hold up everyone else. If the queue runs full, the
+// oldest events are dropped; or, for subscribers that rather know about it,
+// they are disconnected by closing their channel.
+//
+// The bus numbers the events and keeps the recent ones in an EventHistory.
+// Subscribers can ask for a replay from there, which they get before any
+// new event; so nothing is missed in between.
 package main
 
 import (
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultSubscriberQueueSize = 100
+
+var (
+	busDroppedEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: "bus",
+			Name:      "dropped_events_total",
+			Help:      "Events dropped because the subscriber did not keep up",
+		},
+		[]string{"subscriber"},
+	)
+	busDisconnectedSubscribers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: "bus",
+			Name:      "disconnected_subscribers_total",
+			Help:      "Subscribers disconnected because they did not keep up",
+		},
+		[]string{"subscriber"},
+	)
+	busSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: "bus",
+			Name:      "subscribers",
+			Help:      "Number of subscribers to the application bus",
+		},
+	)
 )
 
+func init() {
+	prometheus.MustRegister(busDroppedEvents, busDisconnectedSubscribers,
+		busSubscribers)
+}
+
 type AppEventType string
 
 const (
@@ -31,6 +79,14 @@ const (
 	AppOpenRequest          = AppEventType("open")         // Request to open door for target.
 	AppHushBellRequest      = AppEventType("hush-bell")    // Request to snooze bell until given timeout
 
+	// Door sensor alarms.
+	AppDoorHeldOpenAlarm   = AppEventType("door-held-open")   // Door open too long.
+	AppDoorForcedOpenAlarm = AppEventType("door-forced-open") // Opened without open request.
+
+	// Space open to public (Timeout: until when, zero if no limit).
+	AppSpaceOpened = AppEventType("space-opened")
+	AppSpaceClosed = AppEventType("space-closed")
+
 	// User management events.
 	AppUserAdded        = AppEventType("user-added")
 	AppUserUpdated      = AppEventType("user-updated")
@@ -41,8 +97,6 @@ const (
 	AppEarlStarted        = AppEventType("earl-started")
 	AppTerminalConnect    = AppEventType("terminal-connect")
 	AppTerminalDisconnect = AppEventType("terminal-disconnect")
-
-	applicationBusInternalFlush = AppEventType("internal-flush")
 )
 
 // We keep it simple and somewhat un-typed: an event is identified by an
@@ -59,20 +113,240 @@ type AppEvent struct {
 	// Optional paramters, depending on context.
 	Value   int
 	Timeout time.Time
+
+	Seq      uint64 // Set by the bus on Post(); increasing.
+	Replayed bool   // Delivered from the history on Subscribe().
 }
 
 type AppEventChannel chan *AppEvent
+
+// What to do if a subscriber's queue is full.
+type DropPolicy int
+
+const (
+	DropOldest     DropPolicy = iota // Make room for the new event.
+	DisconnectSlow                   // Unsubscribe and close the channel.
+)
+
+type SubscribeOption func(s *subscriber)
+
+// Name of the subscriber in metrics.
+func SubscriberName(name string) SubscribeOption {
+	return func(s *subscriber) { s.name = name }
+}
+
+// Number of events to hold for the subscriber, if it doesn't keep up.
+// At least one.
+func QueueSize(size int) SubscribeOption {
+	if size < 1 {
+		size = 1
+	}
+	return func(s *subscriber) { s.queueSize = size }
+}
+
+func WithDropPolicy(policy DropPolicy) SubscribeOption {
+	return func(s *subscriber) { s.dropPolicy = policy }
+}
+
+// Only deliver events of these types.
+func OnlyEvents(types ...AppEventType) SubscribeOption {
+	return func(s *subscriber) {
+		s.types = make(map[AppEventType]bool)
+		for _, ev := range types {
+			s.types[ev] = true
+		}
+	}
+}
+
+// Which events of the history a subscriber starts with.
+type ReplayFunc func(h *EventHistory) []*AppEvent
+
+// Start with the events chosen from the history by the given function.
+func Replay(replay ReplayFunc) SubscribeOption {
+	return func(s *subscriber) { s.replay = replay }
+}
+
+// Start with the events after the one with the given sequence number.
+func ReplaySince(seq uint64) SubscribeOption {
+	return Replay(func(h *EventHistory) []*AppEvent { return h.Since(seq) })
+}
+
+// Start with the events posted since the given time.
+func ReplaySinceTime(since time.Time) SubscribeOption {
+	return Replay(func(h *EventHistory) []*AppEvent { return h.SinceTime(since) })
+}
+
+// Start with the last event of each type.
+func ReplayLatest() SubscribeOption {
+	return Replay((*EventHistory).Latest)
+}
+
+// Send the number of events the replay starts with to count (buffered; it is
+// sent to from the bus), so that the subscriber knows which events belong to
+// it. Give after the Replay option.
+func CountReplay(count chan<- int) SubscribeOption {
+	return func(s *subscriber) {
+		replay := s.replay
+		s.replay = func(h *EventHistory) []*AppEvent {
+			var events []*AppEvent
+			if replay != nil {
+				events = replay(h)
+			}
+			count <- len(events)
+			return events
+		}
+	}
+}
+
+// Only deliver events for these targets.
+func OnlyTargets(targets ...Target) SubscribeOption {
+	return func(s *subscriber) {
+		s.targets = make(map[Target]bool)
+		for _, target := range targets {
+			s.targets[target] = true
+		}
+	}
+}
+
+type subscriber struct {
+	channel    AppEventChannel
+	name       string
+	queueSize  int
+	dropPolicy DropPolicy
+	types      map[AppEventType]bool // nil: all
+	targets    map[Target]bool       // nil: all
+	replay     ReplayFunc
+
+	lock         sync.Mutex
+	queue        []*AppEvent
+	replayLeft   int           // Replayed events at the front of the queue.
+	inFlight     bool          // Forwarder holds an event not delivered yet.
+	changed      *sync.Cond    // Signaled when the queue gets shorter.
+	wakeup       chan struct{} // Queue got something for the forwarder.
+	done         chan struct{} // Closed when unsubscribed.
+	disconnected bool
+}
+
+func (s *subscriber) wants(event *AppEvent) bool {
+	return (s.types == nil || s.types[event.Ev]) &&
+		(s.targets == nil || s.targets[event.Target])
+}
+
+// Queue the event. Returns false if the subscriber is to be disconnected.
+// Called from the bus goroutine, never blocks.
+func (s *subscriber) enqueue(event *AppEvent) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue)-s.replayLeft >= s.queueSize {
+		if s.dropPolicy == DisconnectSlow {
+			return false
+		}
+		// Drop the oldest new event; the replay stays complete.
+		s.queue = append(s.queue[:s.replayLeft], s.queue[s.replayLeft+1:]...)
+		busDroppedEvents.WithLabelValues(s.name).Inc()
+	}
+	s.queue = append(s.queue, event)
+	select {
+	case s.wakeup <- struct{}{}:
+	default: // Forwarder already knows.
+	}
+	return true
+}
+
+// Move the events from the queue to the channel at the pace of the reader.
+func (s *subscriber) forward() {
+	defer func() {
+		if s.disconnected {
+			close(s.channel) // We are the only sender.
+		}
+	}()
+	for {
+		s.lock.Lock()
+		if len(s.queue) == 0 {
+			s.lock.Unlock()
+			select {
+			case <-s.wakeup:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		if s.replayLeft > 0 {
+			s.replayLeft--
+		}
+		s.inFlight = true
+		s.lock.Unlock()
+
+		select {
+		case s.channel <- event:
+		case <-s.done:
+			return
+		}
+		s.lock.Lock()
+		s.inFlight = false
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	}
+}
+
+// Wait until the queue is delivered to the channel.
+func (s *subscriber) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for (len(s.queue) > 0 || s.inFlight) && !s.stopped() {
+		s.changed.Wait()
+	}
+}
+
+func (s *subscriber) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *subscriber) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	close(s.done)
+	s.changed.Broadcast()
+}
+
+// Queue replayed events. They don't count against the queue size, which
+// is only about keeping up with new events; the allowance for them is used
+// up as they are delivered.
+func (s *subscriber) enqueueReplay(events []*AppEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, event := range events {
+		if !s.wants(event) {
+			continue
+		}
+		replayed := *event
+		replayed.Replayed = true
+		s.queue = append(s.queue, &replayed)
+		s.replayLeft++
+	}
+}
+
 type ApplicationBus struct {
-	receivers        map[AppEventChannel]bool
+	receivers        map[AppEventChannel]*subscriber
 	syncedOperations chan func()
 	isRunning        bool
+	history          *EventHistory
+	lastSeq          uint64
 }
 
 func NewApplicationBus() *ApplicationBus {
 	bus := &ApplicationBus{
-		receivers:        make(map[AppEventChannel]bool),
+		receivers:        make(map[AppEventChannel]*subscriber),
 		syncedOperations: make(chan func(), 1),
 		isRunning:        true,
+		history:          NewEventHistory(defaultEventHistorySize),
 	}
 	go bus.run()
 	return bus
@@ -83,30 +357,88 @@ func (b *ApplicationBus) Post(event *AppEvent) {
 		event.Timestamp = time.Now()
 	}
 	b.syncedOperations <- func() {
-		for channel, _ := range b.receivers {
-			if event.Ev != applicationBusInternalFlush {
-				channel <- event
+		b.lastSeq++
+		event.Seq = b.lastSeq
+		b.history.Add(event)
+		for channel, receiver := range b.receivers {
+			if !receiver.wants(event) {
+				continue
+			}
+			if !receiver.enqueue(event) {
+				busDisconnectedSubscribers.WithLabelValues(receiver.name).Inc()
+				receiver.disconnected = true
+				b.remove(channel)
 			}
 		}
 	}
 }
 
+// Wait until all events posted so far are delivered to the receivers.
 func (b *ApplicationBus) Flush() {
-	// Since we have a syncedOperations channel of length 1, this will
-	// make sure that we wait until the previous operation is through.
-	b.Post(&AppEvent{Ev: applicationBusInternalFlush})
+	// The syncedOperations are executed in sequence, so once our
+	// operation runs, the previous ones are queued.
+	receivers := make(chan []*subscriber)
+	b.syncedOperations <- func() {
+		var list []*subscriber
+		for _, receiver := range b.receivers {
+			list = append(list, receiver)
+		}
+		receivers <- list
+	}
+	for _, receiver := range <-receivers {
+		receiver.flush()
+	}
+}
+
+// The recent events.
+func (b *ApplicationBus) History() *EventHistory {
+	return b.history
 }
 
-func (b *ApplicationBus) Subscribe(channel AppEventChannel) {
-	b.syncedOperations <- func() { b.receivers[channel] = true }
+// Receive events in the channel. By default, all events are delivered,
+// dropping the oldest if the channel is not read fast enough.
+func (b *ApplicationBus) Subscribe(channel AppEventChannel, options ...SubscribeOption) {
+	receiver := &subscriber{
+		channel:    channel,
+		name:       "anonymous",
+		queueSize:  defaultSubscriberQueueSize,
+		dropPolicy: DropOldest,
+		wakeup:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	receiver.changed = sync.NewCond(&receiver.lock)
+	for _, option := range options {
+		option(receiver)
+	}
+	b.syncedOperations <- func() {
+		if receiver.replay != nil {
+			receiver.enqueueReplay(receiver.replay(b.history))
+		}
+		b.receivers[channel] = receiver
+		busSubscribers.Set(float64(len(b.receivers)))
+		go receiver.forward()
+	}
 }
 
 func (b *ApplicationBus) Unsubscribe(channel AppEventChannel) {
-	b.syncedOperations <- func() { delete(b.receivers, channel) }
+	b.syncedOperations <- func() { b.remove(channel) }
+}
+
+func (b *ApplicationBus) remove(channel AppEventChannel) {
+	if receiver, exists := b.receivers[channel]; exists {
+		receiver.stop()
+		delete(b.receivers, channel)
+		busSubscribers.Set(float64(len(b.receivers)))
+	}
 }
 
 func (b *ApplicationBus) Shutdown() {
-	b.syncedOperations <- func() { b.isRunning = false }
+	b.syncedOperations <- func() {
+		for channel := range b.receivers {
+			b.remove(channel)
+		}
+		b.isRunning = false
+	}
 }
 
 func (b *ApplicationBus) run() {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// How long to wait for something to happen asynchronously.
+const asyncTestTimeout = 5 * time.Second
+
+// Wait until the number of goroutines is back to what it was.
+func ExpectGoroutinesEventually(t *testing.T, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > count; {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Errorf("%d goroutines left over, expected %d:\n%s",
+				runtime.NumGoroutine(), count, buf[:runtime.Stack(buf, true)])
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Receive an event or nil if none arrives in time.
+func receiveEvent(channel AppEventChannel) *AppEvent {
+	select {
+	case event := <-channel:
+		return event
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestBusSubscribeFilters(t *testing.T) {
+	bus := NewApplicationBus()
+	opens := make(AppEventChannel, 10)
+	bus.Subscribe(opens, OnlyEvents(AppOpenRequest))
+	upstairs := make(AppEventChannel, 10)
+	bus.Subscribe(upstairs, OnlyTargets(TargetUpstairs))
+
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetDownstairs})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetUpstairs})
+	bus.Flush()
+
+	ExpectTrue(t, len(opens) == 1, "One open request")
+	ExpectTrue(t, (<-opens).Target == TargetDownstairs, "Downstairs opens")
+	ExpectTrue(t, len(upstairs) == 1, "One upstairs event")
+	ExpectTrue(t, (<-upstairs).Ev == AppDoorbellTriggerEvent, "Upstairs bell")
+}
+
+func TestBusDropsOldest(t *testing.T) {
+	bus := NewApplicationBus()
+	slow := make(AppEventChannel)
+	bus.Subscribe(slow, SubscriberName("test-slow"), QueueSize(3))
+	dropped := testutil.ToFloat64(busDroppedEvents.WithLabelValues("test-slow"))
+
+	for i := 1; i <= 10; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Value: i})
+	}
+	// Nobody reads, still everyone else gets their events.
+	fast := make(AppEventChannel, 1)
+	bus.Subscribe(fast)
+	bus.Post(&AppEvent{Ev: AppOpenRequest})
+	ExpectTrue(t, receiveEvent(fast) != nil, "Others are not held up")
+
+	// Newest events are kept.
+	var received []int
+	for event := receiveEvent(slow); event != nil; event = receiveEvent(slow) {
+		received = append(received, event.Value)
+		if event.Ev == AppOpenRequest {
+			break
+		}
+	}
+	ExpectTrue(t, len(received) <= 5, "Dropped some")
+	ExpectTrue(t, len(received) >= 3 && received[len(received)-2] == 10,
+		"Newest kept")
+	ExpectTrue(t, testutil.ToFloat64(busDroppedEvents.WithLabelValues("test-slow")) >= dropped+6,
+		"Drops counted")
+}
+
+func TestBusQueueSizeAtLeastOne(t *testing.T) {
+	bus := NewApplicationBus()
+	slow := make(AppEventChannel)
+	bus.Subscribe(slow, QueueSize(0))
+	for i := 1; i <= 5; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Value: i})
+	}
+
+	var last *AppEvent
+	for event := receiveEvent(slow); event != nil; event = receiveEvent(slow) {
+		last = event
+	}
+	ExpectTrue(t, last != nil && last.Value == 5, "Newest kept")
+}
+
+func TestBusDisconnectsSlow(t *testing.T) {
+	bus := NewApplicationBus()
+	slow := make(AppEventChannel)
+	bus.Subscribe(slow, QueueSize(2), WithDropPolicy(DisconnectSlow))
+	for i := 0; i < 10; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+	}
+	bus.Flush()
+
+	// What was in the queue is gone; the channel is closed.
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-slow:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Slow subscriber not disconnected")
+		}
+	}
+}
+
+func TestBusUnsubscribeStopsDelivery(t *testing.T) {
+	bus := NewApplicationBus()
+	bus.Flush()
+	goroutines := runtime.NumGoroutine()
+	channel := make(AppEventChannel)
+	bus.Subscribe(channel)
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent}) // Never read.
+	bus.Unsubscribe(channel)
+	bus.Flush()
+	ExpectGoroutinesEventually(t, goroutines)
+	ExpectTrue(t, len(channel) == 0, "Nothing delivered")
+}
+
+// A subscriber that does not read at all, e.g. a stuck HTTP client, must not
+// keep the door from opening.
+func TestBusBlockedSubscriberDoesNotBlockDoor(t *testing.T) {
+	gpio := NewFakeGPIO()
+	config := &Config{
+		Targets: []*TargetConfig{
+			{Name: TargetDownstairs, RelayPin: relayPin(7)},
+		},
+	}
+	config.applyDefaults()
+	bus := NewApplicationBus()
+	bus.Subscribe(make(AppEventChannel))
+	go NewGPIOActions("", config, gpio, nil).EventLoop(bus)
+
+	posted := make(chan bool)
+	go func() {
+		for i := 0; i < 5*defaultSubscriberQueueSize; i++ {
+			bus.Post(&AppEvent{Ev: AppDoorSensorEvent, Target: TargetDownstairs})
+		}
+		bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetDownstairs})
+		close(posted)
+	}()
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Post() blocked")
+	}
+	for deadline := time.Now().Add(5 * time.Second); !gpio.Level(7); {
+		if time.Now().After(deadline) {
+			t.Fatal("Door not opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,235 @@
+// Persistent audit trail of access attempts.
+//
+// Each attempt to open a door is recorded as one JSON object per line in an
+// append-only file, so that it is possible to answer questions such as
+// "who opened upstairs last tuesday night" without grepping through logs.
+//
+// The SD card on the Raspberry Pi is small, so records older than the
+// retention time are pruned from time to time.
+//
+// To see when the same unknown code is tried again and again, records carry
+// an HMAC of the code. Its key is kept in a separate file next to the log
+// (<auditlog>.key), so the log alone doesn't allow guessing codes.
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditPruneInterval = 24 * time.Hour
+	auditSecretSize    = 32
+)
+
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Target    Target    `json:"target"`
+	Origin    string    `json:"origin"`          // keypad, RFID
+	Result    string    `json:"result"`          // AuthResult.String()
+	Level     Level     `json:"level,omitempty"` // if user is known
+	Name      string    `json:"name,omitempty"`  // if user is known
+	CodeHash  string    `json:"code,omitempty"`  // AuditLog.codeHash()
+	Msg       string    `json:"msg,omitempty"`
+}
+
+// Select records. Zero values match everything.
+type AuditFilter struct {
+	From   time.Time // Inclusive
+	To     time.Time // Exclusive
+	Target Target
+	Result string
+	Limit  int // Only return the last Limit records.
+}
+
+type AuditLog struct {
+	filename  string
+	retention time.Duration // Zero: keep forever.
+	clock     Clock
+	secret    []byte // Key for the code HMAC.
+
+	fileLock  sync.Mutex
+	nextPrune time.Time
+}
+
+func NewAuditLog(filename string, retention time.Duration) *AuditLog {
+	return &AuditLog{
+		filename:  filename,
+		retention: retention,
+		clock:     RealClock{},
+		secret:    loadAuditSecret(filename + ".key"),
+	}
+}
+
+// Read the key for the code HMAC, create one on first use.
+func loadAuditSecret(filename string) []byte {
+	secret, err := os.ReadFile(filename)
+	if err == nil && len(secret) >= auditSecretSize {
+		return secret
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Audit log: %v", err)
+	}
+	secret = make([]byte, auditSecretSize)
+	rand.Read(secret)
+	if !os.IsNotExist(err) {
+		// Don't overwrite whatever is there; just not stable over restarts.
+		return secret
+	}
+	if err := os.WriteFile(filename, secret, 0600); err != nil {
+		log.Printf("Audit log: can't store key, code hashes change on restart: %v", err)
+	}
+	return secret
+}
+
+// Identifies a code in the records, without revealing it.
+func (l *AuditLog) codeHash(code string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))[0:16]
+}
+
+// Record an attempt to open a target with the given code (can be empty),
+// by the user (if known). Can be called on a nil AuditLog, which records
+// nothing.
+func (l *AuditLog) RecordAttempt(when time.Time, target Target, origin string,
+	code string, user *User, result AuthResult, msg string) {
+	if l == nil {
+		return
+	}
+	record := &AuditRecord{
+		Timestamp: when,
+		Target:    target,
+		Origin:    origin,
+		Result:    result.String(),
+		Msg:       msg,
+	}
+	if code != "" {
+		record.CodeHash = l.codeHash(code)
+	}
+	if user != nil {
+		record.Level = user.UserLevel
+		record.Name = user.Name
+	}
+	l.Record(record)
+}
+
+// Append record to the log.
+func (l *AuditLog) Record(record *AuditRecord) {
+	if record.Timestamp.IsZero() {
+		record.Timestamp = l.clock.Now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	l.fileLock.Lock()
+	defer l.fileLock.Unlock()
+	if !l.clock.Now().Before(l.nextPrune) {
+		l.pruneRequiresLock()
+	}
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+func (f *AuditFilter) matches(record *AuditRecord) bool {
+	return (f.From.IsZero() || !record.Timestamp.Before(f.From)) &&
+		(f.To.IsZero() || record.Timestamp.Before(f.To)) &&
+		(f.Target == "" || f.Target == record.Target) &&
+		(f.Result == "" || f.Result == record.Result)
+}
+
+// Return records matching the filter, oldest first.
+func (l *AuditLog) Query(filter AuditFilter) ([]*AuditRecord, error) {
+	result := []*AuditRecord{}
+	err := l.forEachRecord(func(record *AuditRecord) {
+		if !filter.matches(record) {
+			return
+		}
+		result = append(result, record)
+		if filter.Limit > 0 && len(result) > filter.Limit {
+			result = result[1:]
+		}
+	})
+	return result, err
+}
+
+func (l *AuditLog) forEachRecord(callback func(record *AuditRecord)) error {
+	l.fileLock.Lock()
+	defer l.fileLock.Unlock()
+	f, err := os.Open(l.filename)
+	if os.IsNotExist(err) {
+		return nil // Nothing recorded yet.
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &AuditRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			continue // Garbage, e.g. a partially written line.
+		}
+		callback(record)
+	}
+	return scanner.Err()
+}
+
+// Remove records older than the retention time. Rewrites the file in a
+// temporary file that is then atomically renamed.
+func (l *AuditLog) pruneRequiresLock() {
+	now := l.clock.Now()
+	l.nextPrune = now.Add(auditPruneInterval)
+	if l.retention <= 0 {
+		return
+	}
+	in, err := os.Open(l.filename)
+	if err != nil {
+		return // Nothing there yet.
+	}
+	defer in.Close()
+	tmpFilename := l.filename + ".tmp"
+	out, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("Audit log: %v", err)
+		return
+	}
+	oldest := now.Add(-l.retention)
+	pruned := 0
+	writer := bufio.NewWriter(out)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		record := &AuditRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil ||
+			record.Timestamp.Before(oldest) {
+			pruned++
+			continue
+		}
+		writer.Write(scanner.Bytes())
+		writer.WriteByte('\n')
+	}
+	writer.Flush()
+	out.Close()
+	if pruned == 0 {
+		os.Remove(tmpFilename)
+		return
+	}
+	os.Rename(tmpFilename, l.filename)
+	log.Printf("Audit log: pruned %d records older than %s",
+		pruned, oldest.Format("2006-01-02 15:04"))
+}
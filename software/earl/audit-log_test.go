@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func CreateTempAuditLog(clock Clock) (*AuditLog, string) {
+	dir, _ := ioutil.TempDir("", "test-audit")
+	auditLog := NewAuditLog(filepath.Join(dir, "audit.log"), 7*24*time.Hour)
+	auditLog.clock = clock
+	return auditLog, dir
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	mockClock := &MockClock{}
+	auditLog, dir := CreateTempAuditLog(mockClock)
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	someMidnight, _ := time.Parse("2006-01-02", "2016-12-24")
+	mockClock.now = someMidnight
+	auditLog.Record(&AuditRecord{Target: TargetUpstairs, Result: "ok", Name: "a"})
+	mockClock.now = someMidnight.Add(1 * time.Hour)
+	auditLog.Record(&AuditRecord{Target: TargetDownstairs, Result: "failed"})
+	mockClock.now = someMidnight.Add(2 * time.Hour)
+	auditLog.Record(&AuditRecord{Target: TargetUpstairs, Result: "ok", Name: "b"})
+
+	records, err := auditLog.Query(AuditFilter{})
+	ExpectTrue(t, err == nil && len(records) == 3, "All records")
+
+	records, _ = auditLog.Query(AuditFilter{Target: TargetUpstairs})
+	ExpectTrue(t, len(records) == 2, "Upstairs records")
+
+	records, _ = auditLog.Query(AuditFilter{Result: "failed"})
+	ExpectTrue(t, len(records) == 1 && records[0].Target == TargetDownstairs,
+		"Failed records")
+
+	records, _ = auditLog.Query(AuditFilter{
+		From: someMidnight.Add(30 * time.Minute),
+		To:   someMidnight.Add(2 * time.Hour)})
+	ExpectTrue(t, len(records) == 1 && records[0].Result == "failed",
+		"Time range is [from, to)")
+
+	records, _ = auditLog.Query(AuditFilter{Target: TargetUpstairs, Limit: 1})
+	ExpectTrue(t, len(records) == 1 && records[0].Name == "b",
+		"Limit returns latest records")
+}
+
+func TestAuditLogRetention(t *testing.T) {
+	mockClock := &MockClock{}
+	auditLog, dir := CreateTempAuditLog(mockClock)
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	someMidnight, _ := time.Parse("2006-01-02", "2016-12-24")
+	mockClock.now = someMidnight
+	auditLog.Record(&AuditRecord{Target: TargetUpstairs, Name: "old"})
+	mockClock.now = someMidnight.Add(5 * 24 * time.Hour)
+	auditLog.Record(&AuditRecord{Target: TargetUpstairs, Name: "newer"})
+
+	// Beyond retention of the first record, the next record prunes it.
+	mockClock.now = someMidnight.Add(8 * 24 * time.Hour)
+	auditLog.Record(&AuditRecord{Target: TargetUpstairs, Name: "newest"})
+
+	records, _ := auditLog.Query(AuditFilter{})
+	if len(records) != 2 {
+		t.Fatalf("Expected old record pruned, got %d records", len(records))
+	}
+	ExpectTrue(t, records[0].Name == "newer", "Kept newer record")
+	ExpectTrue(t, records[1].Name == "newest", "Kept newest record")
+}
+
+func TestAccessHandlerRecordsAudit(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	auditLog, dir := CreateTempAuditLog(RealClock{})
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	testFixture.mockbackends.auditLog = auditLog
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthOk
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	PressKeys(testFixture.handlerUnderTest, "654321#")
+	testFixture.handlerUnderTest.HandleRFID("rfid-123")
+	PressKeys(testFixture.handlerUnderTest, "654321#")
+
+	records, _ := auditLog.Query(AuditFilter{})
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 audit records, got %d", len(records))
+	}
+	ExpectTrue(t, records[0].Result == "ok" && records[0].Origin == "keypad",
+		"Granted keypad access")
+	ExpectTrue(t, records[0].Level == LevelMember, "Level recorded")
+	ExpectTrue(t, records[1].Result == "failed", "Denied keypad access")
+	ExpectTrue(t, records[2].Origin == "RFID", "RFID access")
+
+	// The same code can be recognized, but not looked up in the user file.
+	ExpectTrue(t, records[1].CodeHash != "" && records[1].CodeHash == records[3].CodeHash,
+		"Same code, same hash")
+	ExpectTrue(t, records[0].CodeHash != records[1].CodeHash, "Other code, other hash")
+	ExpectFalse(t, strings.Contains(hashAuthCode("654321"), records[1].CodeHash),
+		"Not the user file hash")
+
+	// Stable over restarts.
+	restarted := NewAuditLog(auditLog.filename, 0)
+	ExpectTrue(t, restarted.codeHash("654321") == records[1].CodeHash, "Same key after restart")
+}
+
+func TestAuditHttpApi(t *testing.T) {
+	auditLog, dir := CreateTempAuditLog(RealClock{})
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	auditLog.Record(&AuditRecord{Target: TargetUpstairs, Result: "ok"})
+	auditLog.Record(&AuditRecord{Target: TargetDownstairs, Result: "failed"})
+
+	authFile, _ := os.Create(filepath.Join(dir, "users.csv"))
+	mux := http.NewServeMux()
+	server := NewApiServer(&Backends{
+		authenticator: CreateSimpleFileAuth(authFile, RealClock{}),
+		appEventBus:   NewApplicationBus(),
+		auditLog:      auditLog,
+	}, mux)
+	server.members.authFailureDelay = 0
+	get := func(path string, authCode string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if authCode != "" {
+			req.Header.Set("Authorization", "Bearer "+authCode)
+		}
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, req)
+		return response
+	}
+
+	response := get("/api/audit", "")
+	ExpectTrue(t, response.Code == http.StatusUnauthorized, "Authentication needed")
+	response = get("/api/audit", "guess123")
+	ExpectTrue(t, response.Code == http.StatusForbidden, "Members only")
+
+	response = get("/api/audit?target=gate", "root123")
+	var records []*AuditRecord
+	json.Unmarshal(response.Body.Bytes(), &records)
+	ExpectTrue(t, len(records) == 1 && records[0].Result == "failed",
+		"Filter by target")
+
+	response = get("/api/audit?from=yesterday", "root123")
+	ExpectTrue(t, response.Code == http.StatusBadRequest, "Invalid time")
+}
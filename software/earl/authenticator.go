@@ -5,15 +5,12 @@
 // all the handlers that need to authenticate or modify users.
 //
 // This file also contains a concrete implementation (FileBasedAuthenticator) that stores users
-// in a CSV file.
-//
+// in a CSV file. An alternative implementation backed by SQLite lives in
+// sqlite-authenticator.go
 package main
 
-// TODO
-// - We need the concept of an 'open space'. If the space is open (e.g.
-//   two members state that they are there), then regular users should come
-//   in independent of time.
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/csv"
 	"encoding/hex"
@@ -21,6 +18,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -33,9 +31,8 @@ const (
 	AuthFail             = AuthResult(0) // Not authorized.
 	AuthExpired          = AuthResult(1)
 	AuthOkButOutsideTime = AuthResult(2) // User ok; time-of-day limit.
+	AuthTargetDenied     = AuthResult(3) // User ok; not for this target.
 	AuthOk               = AuthResult(42)
-	HolidayHiatusBegin   = 1482278400 // 2016-12-21 UTC
-	HolidayHiatusEnd     = 1483747200 // 2017-01-07 UTC
 )
 
 var (
@@ -43,6 +40,7 @@ var (
 		AuthFail,
 		AuthExpired,
 		AuthOkButOutsideTime,
+		AuthTargetDenied,
 		AuthOk,
 	}
 )
@@ -55,6 +53,8 @@ func (a AuthResult) String() string {
 		return "expired"
 	case AuthOkButOutsideTime:
 		return "ok-but-outside-time"
+	case AuthTargetDenied:
+		return "target-denied"
 	case AuthOk:
 		return "ok"
 	}
@@ -86,6 +86,9 @@ type Authenticator interface {
 	// Given a valid authentication code of some member, delete user
 	// associated with user_code.
 	DeleteUser(authentication_code string, user_code string) (bool, string)
+
+	// Iterate through users. The users are a copy, you can't modify them.
+	IterateUsers(callback func(user User))
 }
 
 type FileBasedAuthenticator struct {
@@ -106,6 +109,15 @@ type FileBasedAuthenticator struct {
 
 	eventBus *ApplicationBus
 	clock    Clock // Our source of time. Useful for simulated clock in tests
+
+	AccessRules
+}
+
+// Rules besides the user records that decide about access. All optional.
+type AccessRules struct {
+	space    *SpaceStatus     // If open to public, users may come in.
+	closures *ClosureCalendar // Periods the space is closed.
+	policy   *AccessPolicy    // Who may open which target.
 }
 
 var (
@@ -123,6 +135,10 @@ var (
 
 func init() {
 	prometheus.MustRegister(authCounter)
+}
+
+// Make the counters for all targets and results visible, even if zero.
+func initAuthCounter(targets []Target) {
 	for _, target := range targets {
 		for _, auth := range authResults {
 			authCounter.WithLabelValues(target.String(), auth.String())
@@ -159,8 +175,17 @@ func (a *FileBasedAuthenticator) FindUser(plain_code string) *User {
 
 // Iterate through users. The users are a copy, you can't modify them.
 func (a *FileBasedAuthenticator) IterateUsers(callback func(user User)) {
+	a.reloadIfChanged()
+	a.userLock.Lock()
+	users := make([]User, 0, len(a.userList))
 	for _, user := range a.userList {
-		callback(*user)
+		if user != nil { // deleted users leave a hole.
+			users = append(users, *user)
+		}
+	}
+	a.userLock.Unlock()
+	for _, user := range users {
+		callback(user)
 	}
 }
 
@@ -173,20 +198,28 @@ func (a *FileBasedAuthenticator) AuthUser(code string, target Target) (result Au
 	if !hasMinimalCodeRequirements(code) {
 		return AuthFail, "Auth failed: too short code."
 	}
-	user := a.findUserSynchronized(code, nil)
-	if user == nil {
-		return AuthFail, "No user for code"
-	}
-	// In case of Hiatus users, be a bit more specific with logging: this
-	// might be someone stolen a token of some person on leave or attempt
-	// of a blocked user to get access.
-	if user.UserLevel == LevelHiatus {
-		return AuthFail, fmt.Sprintf("User on hiatus '%s <%s>'", user.Name, user.ContactInfo)
+	a.reloadIfChanged()
+	now := a.clock.Now()
+	// Decide and count the use of a limited-use code in one go, so
+	// that no use is handed out twice.
+	a.userLock.Lock()
+	user := a.code2user[hashAuthCode(code)]
+	result, message = a.authorizeUser(user, target, now)
+	consumed := false
+	if result == AuthOk && user.UsesLeft > 0 {
+		used := *user
+		used.ConsumeUse(now)
+		a.revision++
+		if !a.addUserAtPosRequiresLock(&used, a.deleteUserRequiresLock(user)) {
+			result, message = AuthFail, "Counting use failed"
+		}
+		consumed = true
 	}
-	if !user.InValidityPeriod(a.clock.Now()) {
-		return AuthExpired, "Code not valid yet/expired"
+	a.userLock.Unlock()
+	if consumed {
+		a.writeDatabase() // Logs failures; the use is counted anyway.
 	}
-	return a.userHasAccess(user, target)
+	return result, message
 }
 
 func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
@@ -205,7 +238,7 @@ func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user Use
 		return false, "Duplicate codes while adding user"
 	}
 
-	a.postUserEvent(AppUserAdded, &user)
+	postUserEvent(a.eventBus, AppUserAdded, &user)
 
 	return a.appendDatabaseSingleEntry(&user)
 }
@@ -218,6 +251,9 @@ func (a *FileBasedAuthenticator) UpdateUser(authentication_code string,
 
 	var previous_revision int
 	orig_user := a.findUserSynchronized(user_code, &previous_revision)
+	if orig_user == nil {
+		return false, "No user for code."
+	}
 	modification_copy := *orig_user
 	// Call back the caller asking for modification of this user record. We
 	// hand out a copy to mess with. If updater_fun() decides to not modify
@@ -232,7 +268,7 @@ func (a *FileBasedAuthenticator) UpdateUser(authentication_code string,
 		return false, "Changed while editing."
 	}
 
-	a.postUserEvent(AppUserUpdated, &modification_copy)
+	postUserEvent(a.eventBus, AppUserUpdated, &modification_copy)
 
 	return a.writeDatabase()
 }
@@ -249,21 +285,31 @@ func (a *FileBasedAuthenticator) DeleteUser(
 		return false, "Delete failed"
 	}
 
-	a.postUserEvent(AppUserDeleted, user)
+	postUserEvent(a.eventBus, AppUserDeleted, user)
 
 	return a.writeDatabase()
 }
 
 // Given a test function for the user level, test if operation is allowed
 func (a *FileBasedAuthenticator) verifyOpAllowed(auth_code string, isOpAllowed func(Level) bool) (bool, string) {
-	authMember := a.findUserSynchronized(auth_code, nil)
+	return verifyMemberOpAllowed(a.findUserSynchronized(auth_code, nil),
+		isOpAllowed, a.clock.Now())
+}
+
+// Check if the given member (nil if not found) is allowed to do an operation
+// that needs the given level.
+func verifyMemberOpAllowed(authMember *User, isOpAllowed func(Level) bool, now time.Time) (bool, string) {
 	if authMember == nil {
 		return false, "Couldn't find member with authentication code."
 	}
 	if !isOpAllowed(authMember.UserLevel) {
 		return false, "User not authorized."
 	}
-	if !authMember.InValidityPeriod(a.clock.Now()) {
+	if authMember.broken != "" {
+		// The level might be right, but we don't know what else was meant.
+		return false, "Auth-Member entry broken: " + authMember.broken
+	}
+	if !authMember.InValidityPeriod(now) {
 		return false, "Auth-Member expired."
 	}
 	return true, ""
@@ -362,7 +408,6 @@ func (a *FileBasedAuthenticator) deleteUserRequiresLock(user *User) int {
 	return pos
 }
 
-//
 // Read the user CSV file
 //
 // It is name, level, code[,code...]
@@ -451,17 +496,32 @@ func (a *FileBasedAuthenticator) reloadIfChanged() {
 
 // Full dump of database.
 func (a *FileBasedAuthenticator) writeDatabase() (bool, string) {
-	// First, dump out the database to a temporary file and
-	// make sure it succeeds.
-	tmpFilename := a.userFilename + ".tmp"
-	if ok, msg := a.writeTempCSV(tmpFilename); !ok {
-		return false, msg
-	}
-
-	// Alright, good. Atomic rename.
+	// Same lock order as reloadIfChanged(). Holding the fileLock all the
+	// way makes sure a later snapshot is never overwritten by an earlier.
 	a.fileLock.Lock()
 	defer a.fileLock.Unlock()
-	os.Rename(tmpFilename, a.userFilename)
+
+	// Snapshot of the users, so that we write a consistent file.
+	var content bytes.Buffer
+	writer := csv.NewWriter(&content)
+	a.userLock.Lock()
+	for _, user := range a.userList {
+		if user != nil {
+			user.WriteCSV(writer)
+		}
+	}
+	a.userLock.Unlock()
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return false, err.Error()
+	}
+
+	// Dump it out to a temporary file of our own, make sure it
+	// succeeds, then do an atomic rename.
+	if err := writeFileAtomically(a.userFilename, content.Bytes()); err != nil {
+		log.Printf("Writing %s: %v", a.userFilename, err)
+		return false, err.Error()
+	}
 
 	fileinfo, _ := os.Stat(a.userFilename)
 	a.fileTimestamp = fileinfo.ModTime()
@@ -490,28 +550,27 @@ func (a *FileBasedAuthenticator) appendDatabaseSingleEntry(user *User) (bool, st
 	return true, ""
 }
 
-// Write content of the 'user database' to temp CSV file.
-func (a *FileBasedAuthenticator) writeTempCSV(filename string) (bool, string) {
-	os.Remove(filename)
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// Replace the file with the content, without anyone ever seeing it half
+// written.
+func writeFileAtomically(filename string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
 	if err != nil {
-		return false, err.Error()
+		return err
 	}
-	defer f.Close()
-	writer := csv.NewWriter(f)
-	for _, user := range a.userList {
-		if user != nil {
-			user.WriteCSV(writer)
-		}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
-	writer.Flush()
-	/* writer.Error() does not exist in older go versions :(
-	if writer.Error() != nil {
-		log.Println(writer.Error())
-		return false, writer.Error()
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
 	}
-	*/
-	return true, ""
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 // We hash the authentication codes, as we don't need/want knowledge
@@ -540,52 +599,73 @@ func hasMinimalCodeRequirements(code string) bool {
 	return len(code) >= 5
 }
 
-func (a *FileBasedAuthenticator) userHasAccess(user *User, target Target) (AuthResult, string) {
-	// TODO: we need a concept of an 'open' space, i.e. a responsible user
-	// opens the space to be accessible by the public, so that other users
-	// can come in even outside 'their' times. Right now only dummy - never
-	// open.
-	space_open_to_public := false
-
-	hour_from, hour_to := user.AccessHours()
-	current_hour := a.clock.Now().Hour()
-	isday := space_open_to_public ||
-		(current_hour >= hour_from && current_hour < hour_to)
+// Given the user found for a code (or nil if none), decide if access
+// to "target" is granted at time "now". The closures apply even while the
+// space is open to the public.
+func (r *AccessRules) authorizeUser(user *User, target Target, now time.Time) (AuthResult, string) {
+	if user == nil {
+		return AuthFail, "No user for code"
+	}
+	if user.broken != "" {
+		return AuthFail, fmt.Sprintf("Broken entry for '%s': %s", user.Name, user.broken)
+	}
+	// In case of Hiatus users, be a bit more specific with logging: this
+	// might be someone stolen a token of some person on leave or attempt
+	// of a blocked user to get access.
+	if user.UserLevel == LevelHiatus {
+		return AuthFail, fmt.Sprintf("User on hiatus '%s <%s>'", user.Name, user.ContactInfo)
+	}
+	if !user.InValidityPeriod(now) {
+		return AuthExpired, "Code not valid yet/expired"
+	}
+	if !user.HasTarget(target) || !r.policy.Allows(user, target) {
+		return AuthTargetDenied, fmt.Sprintf("%s has no access to %s",
+			user.UserLevel, target)
+	}
+	space_open_to_public := r.space.IsOpen()
+	result, msg := userHasAccess(user, now, space_open_to_public)
+	if result != AuthOk {
+		return result, msg
+	}
+	if closure := r.closures.ActiveClosure(user.UserLevel, target, now); closure != nil {
+		return AuthOkButOutsideTime,
+			fmt.Sprintf("%s during closure '%s'", user.UserLevel, closure.Description)
+	}
+	return AuthOk, ""
+}
+
+// If the space is open, i.e. responsible members opened the space to be
+// accessible by the public, users can come in even outside the hours of
+// their level. Users with a custom schedule are limited to that, whatever
+// their level and whether the space is open.
+func userHasAccess(user *User, now time.Time, space_open_to_public bool) (AuthResult, string) {
+	var who string
 	switch user.UserLevel {
 	case LevelMember:
-		return AuthOk, "" // Members always have access.
-
-	case LevelPhilanthropist, LevelTrustedPhilanthropist: // Philanthropists also have all-hour access
-		return AuthOk, ""
-
+		who = "Member"
+	case LevelPhilanthropist, LevelTrustedPhilanthropist:
+		who = "Philanthropist"
 	case LevelFulltimeUser:
-		if !isday {
-			return AuthOkButOutsideTime,
-				fmt.Sprintf("Fulltime user outside %d:00..%d:00",
-					hour_from, hour_to)
-		}
-		return AuthOk, ""
-
+		who = "Fulltime user"
 	case LevelUser:
-		if !isday {
-			return AuthOkButOutsideTime,
-				fmt.Sprintf("Regular user outside %d:00..%d:00",
-					hour_from, hour_to)
-		}
-		now := a.clock.Now().Unix()
-		if now >= HolidayHiatusBegin && now <= HolidayHiatusEnd {
-			return AuthOkButOutsideTime, "Regular user during holiday hiatus period"
-		}
-		return AuthOk, ""
-
+		who = "Regular user"
 	case LevelHiatus:
 		return AuthFail, "On Hiatus"
+	default:
+		return AuthFail, ""
 	}
-	return AuthFail, ""
+	// Without a custom schedule, members and philanthropists have
+	// all-hour access.
+	if (user.Schedule != nil || !space_open_to_public) &&
+		!user.AccessSchedule().Allows(now) {
+		return AuthOkButOutsideTime,
+			fmt.Sprintf("%s outside %s", who, user.AccessTimeString())
+	}
+	return AuthOk, ""
 }
 
-func (a *FileBasedAuthenticator) postUserEvent(ev AppEventType, user *User) {
-	a.eventBus.Post(&AppEvent{
+func postUserEvent(bus *ApplicationBus, ev AppEventType, user *User) {
+	bus.Post(&AppEvent{
 		Ev:     ev,
 		Source: "authenticator",
 		Msg:    "user:" + user.Name,
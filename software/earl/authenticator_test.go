@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/csv"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -185,6 +191,9 @@ func TestUpdateUser(t *testing.T) {
 	ExpectTrue(t, eatmsg(auth.UpdateUser("phil123", "doe123", func(user *User) bool { return true })),
 		"Philanthropist should be able to update")
 
+	ExpectFalse(t, eatmsg(auth.UpdateUser("root123", "nobody123", func(user *User) bool { return true })),
+		"Unknown user")
+
 	// Now let the root user modify user identified by doe123
 	auth.UpdateUser("root123", "doe123", func(user *User) bool {
 		user.SetAuthCode("newdoe123")
@@ -376,10 +385,13 @@ func TestTimeLimits(t *testing.T) {
 func TestHolidayTimeLimits(t *testing.T) {
 	authFile, _ := ioutil.TempFile("", "holiday-timing-tests")
 	mockClock := &MockClock{}
-	auth := CreateSimpleFileAuth(authFile, mockClock)
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	closureFile := CreateClosureFile("2016-12-21,2017-01-06,user,,Holiday hiatus\n")
 	if !keepGeneratedFiles {
 		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(closureFile)
 	}
+	auth.closures = NewClosureCalendar(closureFile)
 
 	someMidnight, _ := time.Parse("2006-01-02", "2016-12-24")            // midnight
 	nightTime_3h := someMidnight.Add(3 * time.Hour)                      // 03:00
@@ -409,7 +421,7 @@ func TestHolidayTimeLimits(t *testing.T) {
 
 	mockClock.now = hackerDaytime_13h
 	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "holiday")
+		AuthOkButOutsideTime, "closure")
 
 	mockClock.now = closingTime_22h // should behave similar to earlyMorning
 	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
@@ -419,3 +431,182 @@ func TestHolidayTimeLimits(t *testing.T) {
 	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
 		AuthOkButOutsideTime, "outside")
 }
+
+func TestCustomSchedule(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "custom-schedule-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	friday, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = friday.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Class participant",
+		ContactInfo: "class@noisebridge.net",
+		UserLevel:   LevelUser,
+		Targets:     []Target{TargetDownstairs, TargetUpstairs}}
+	u.Schedule, _ = ParseSchedule("Fri 18-22")
+	u.SetAuthCode("class123")
+	auth.AddNewUser("root123", u)
+
+	u = User{
+		Name:        "Weekend member",
+		ContactInfo: "weekend@noisebridge.net",
+		UserLevel:   LevelMember}
+	u.Schedule, _ = ParseSchedule("Sat,Sun 0-24")
+	u.SetAuthCode("weekend123")
+	auth.AddNewUser("root123", u)
+
+	// Schedule instead of the regular 10..23 user hours
+	mockClock.now = friday.Add(12 * time.Hour)
+	ExpectAuthResult(t, auth, "class123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside Fri 18-22")
+	mockClock.now = friday.Add(19 * time.Hour)
+	ExpectAuthResult(t, auth, "class123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "class123", TargetElevator,
+		AuthTargetDenied, "no access to elevator")
+
+	// A schedule limits even members.
+	ExpectAuthResult(t, auth, "weekend123", TargetUpstairs,
+		AuthOkButOutsideTime, "Member outside")
+	mockClock.now = friday.Add(26 * time.Hour)
+	ExpectAuthResult(t, auth, "weekend123", TargetUpstairs, AuthOk, "")
+
+	// Re-read from file.
+	found := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus()).FindUser("class123")
+	ExpectTrue(t, found.Schedule.String() == "Fri 18-22", "Schedule persisted")
+	ExpectTrue(t, len(found.Targets) == 2 && found.Targets[1] == TargetUpstairs,
+		"Targets persisted")
+}
+
+func TestUserCSVOptionalFields(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	u := User{Name: "plain", UserLevel: LevelUser}
+	u.WriteCSV(writer)
+	u.Name = "scheduled"
+	u.Schedule, _ = ParseSchedule("Mon 10-12")
+	u.WriteCSV(writer)
+	u = User{Name: "limited", UserLevel: LevelUser, UsesLeft: 3}
+	u.WriteCSV(writer)
+	writer.Flush()
+	lines := strings.Split(buffer.String(), "\n")
+	ExpectTrue(t, strings.Count(lines[0], ",") == 6, "No optional fields if not needed")
+	ExpectTrue(t, strings.Count(lines[1], ",") == 8, "Optional fields")
+	ExpectTrue(t, strings.Count(lines[2], ",") == 9, "Uses left")
+
+	reader := csv.NewReader(strings.NewReader(buffer.String() +
+		"broken,,user,,,,code,Mon 25-26\n"))
+	reader.FieldsPerRecord = -1
+	user, _ := NewUserFromCSV(reader)
+	ExpectTrue(t, user.Name == "plain" && user.Schedule == nil, "Old format")
+	user, _ = NewUserFromCSV(reader)
+	ExpectTrue(t, user.Name == "scheduled" && user.Schedule.String() == "Mon 10-12",
+		"New format")
+	user, _ = NewUserFromCSV(reader)
+	ExpectTrue(t, user.Name == "limited" && user.UsesLeft == 3 && user.Schedule == nil,
+		"Limited uses")
+	user, done := NewUserFromCSV(reader)
+	ExpectTrue(t, user.Name == "broken" && user.broken != "" && !done, "Invalid schedule kept")
+}
+
+func TestBrokenEntryKeptButDenied(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-broken-entry")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.WriteString("broken,b@nb,user,,,," + hashAuthCode("doe123") + ",Mon 25-26,,x\n")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	broken := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus()).FindUser("doe123")
+	ExpectTrue(t, broken != nil && broken.Name == "broken", "Broken entry loaded")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthFail, "Broken entry for 'broken'")
+
+	// Rewriting the file keeps the entry as it was.
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "root123", func(user *User) bool {
+		user.ContactInfo = "root@noisebridge"
+		return true
+	})), "Update other user")
+	content, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Contains(string(content), ",Mon 25-26,,x\n"), string(content))
+}
+
+func TestBrokenMemberCantSponsor(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-broken-member")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.WriteString("member,m@nb,member,,2020-01-01 00:00,," +
+		hashAuthCode("member123") + ",Mon 25-26\n")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+
+	u := User{Name: "New", ContactInfo: "new@nb", UserLevel: LevelUser}
+	u.SetAuthCode("new12345")
+	ok, msg := auth.AddNewUser("member123", u)
+	ExpectFalse(t, ok, "Broken member can't add users")
+	ExpectTrue(t, strings.Contains(msg, "broken"), msg)
+	ok, _ = auth.UpdateUser("member123", "root123", func(user *User) bool { return true })
+	ExpectFalse(t, ok, "Broken member can't update users")
+
+	// Neither over the API.
+	bearer := NewBearerAuth(auth)
+	bearer.authFailureDelay = 0
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set("Authorization", "Bearer member123")
+	out := httptest.NewRecorder()
+	code, _ := bearer.authenticate(out, req, CanLevelModify)
+	ExpectTrue(t, code == "" && out.Code == http.StatusForbidden, "API denied")
+}
+
+// Try the code concurrently; expect exactly the number of uses to succeed.
+func ExpectUsesGrantedOnce(t *testing.T, auth Authenticator, code string, uses int) {
+	t.Helper()
+	results := make(chan AuthResult)
+	for i := 0; i < 3*uses; i++ {
+		go func() {
+			result, _ := auth.AuthUser(code, TargetDownstairs)
+			results <- result
+		}()
+	}
+	granted := 0
+	for i := 0; i < 3*uses; i++ {
+		if <-results == AuthOk {
+			granted++
+		}
+	}
+	ExpectTrue(t, granted == uses, fmt.Sprintf("Expected %d uses, got %d", uses, granted))
+}
+
+func TestLimitedUses(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-limited-uses")
+	mockClock := &MockClock{now: time.Date(2026, 10, 1, 14, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	u := User{UserLevel: LevelUser, ValidFrom: mockClock.now.Add(-time.Minute), UsesLeft: 2}
+	u.SetAuthCode("visitor123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add limited user")
+
+	ExpectAuthResult(t, auth, "visitor123", TargetDownstairs, AuthOk, "")
+	found := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus()).FindUser("visitor123")
+	ExpectTrue(t, found.UsesLeft == 1, "Use counted in file")
+	ExpectAuthResult(t, auth, "visitor123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "visitor123", TargetDownstairs, AuthExpired, "expired")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+
+	u.UsesLeft = 3
+	u.SetAuthCode("group123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add group")
+	ExpectUsesGrantedOnce(t, auth, "group123", 3)
+
+	// The concurrent rewrites left a complete file, and no temp files.
+	reread := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reread.FindUser("root123") != nil && reread.FindUser("visitor123") != nil,
+		"Other users still in file")
+	ExpectTrue(t, reread.FindUser("group123").UsesLeft == 0, "All uses counted in file")
+	leftovers, _ := filepath.Glob(authFile.Name() + ".tmp*")
+	ExpectTrue(t, len(leftovers) == 0, fmt.Sprintf("Temp files left: %v", leftovers))
+}
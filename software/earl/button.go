@@ -0,0 +1,101 @@
+// Push buttons wired to GPIO input pins, e.g. a doorbell button outside
+// or a buzzer button next to the door that opens the gate.
+//
+// A press posts an AppDoorbellTriggerEvent or AppOpenRequest for the
+// configured target, with Source "gpio:<pin>" so that it can be told apart
+// from terminals.
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultButtonRateLimit = 2 * time.Second
+)
+
+type ButtonAction string
+
+const (
+	ButtonDoorbell = ButtonAction("doorbell") // Ring the bell of the target.
+	ButtonOpen     = ButtonAction("open")     // Open the target.
+)
+
+type Button struct {
+	config   *ButtonConfig
+	input    *debouncedInput
+	bus      *ApplicationBus
+	auditLog *AuditLog // Optional, can be nil.
+	clock    Clock
+
+	nextAllowedPress time.Time
+}
+
+func NewButton(config *ButtonConfig, input DigitalInput, bus *ApplicationBus, auditLog *AuditLog) *Button {
+	return &Button{
+		config: config,
+		input: &debouncedInput{
+			name:  config.source(),
+			input: input,
+		},
+		bus:      bus,
+		auditLog: auditLog,
+		clock:    RealClock{},
+	}
+}
+
+// Poll the button forever. Call in its own goroutine.
+func (b *Button) Run() {
+	for {
+		b.Poll()
+		time.Sleep(gpioInputPollInterval)
+	}
+}
+
+// Read the input once and post an event if the button was pressed.
+func (b *Button) Poll() {
+	now := b.clock.Now()
+	wasKnown := b.input.known // Don't take a stuck button as press.
+	changed, pressed := b.input.Update(now)
+	if !changed || !pressed || !wasKnown {
+		return
+	}
+	if now.Before(b.nextAllowedPress) {
+		return // Someone is leaning on the button.
+	}
+	b.nextAllowedPress = now.Add(b.config.RateLimit)
+
+	event := &AppEvent{
+		Target: b.config.Target,
+		Source: b.config.source(),
+		Msg:    "button",
+	}
+	switch b.config.Action {
+	case ButtonDoorbell:
+		event.Ev = AppDoorbellTriggerEvent
+	case ButtonOpen:
+		event.Ev = AppOpenRequest
+		log.Printf("%s: opened by button %s", b.config.Target, event.Source)
+		b.recordAudit(now)
+	}
+	b.bus.Post(event)
+}
+
+func (b *Button) recordAudit(now time.Time) {
+	if b.auditLog == nil {
+		return
+	}
+	b.auditLog.Record(&AuditRecord{
+		Timestamp: now,
+		Target:    b.config.Target,
+		Origin:    b.config.source(),
+		Result:    AuthOk.String(),
+		Msg:       "button",
+	})
+}
+
+func (c *ButtonConfig) source() string {
+	return fmt.Sprintf("gpio:%d", c.Pin)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type ButtonFixture struct {
+	t      *testing.T
+	gpio   *FakeGPIO
+	clock  *MockClock
+	bus    *ApplicationBus
+	events AppEventChannel
+	button *Button
+}
+
+func NewButtonFixture(t *testing.T, action ButtonAction, auditLog *AuditLog) *ButtonFixture {
+	f := &ButtonFixture{
+		t:      t,
+		gpio:   NewFakeGPIO(),
+		clock:  &MockClock{},
+		bus:    NewApplicationBus(),
+		events: make(AppEventChannel, 10),
+	}
+	f.bus.Subscribe(f.events)
+	config := &ButtonConfig{
+		Pin:       17,
+		ActiveLow: true,
+		Target:    TargetDownstairs,
+		Action:    action,
+		RateLimit: 2 * time.Second,
+	}
+	input, _ := f.gpio.Input(17, true)
+	f.button = NewButton(config, input, f.bus, auditLog)
+	f.button.clock = f.clock
+	f.Hold(true, time.Second) // Pulled up; not pressed.
+	return f
+}
+
+func (f *ButtonFixture) Hold(level bool, duration time.Duration) {
+	f.gpio.SetLevel(17, level)
+	for end := f.clock.now.Add(duration); !f.clock.now.After(end); {
+		f.button.Poll()
+		f.clock.now = f.clock.now.Add(gpioInputPollInterval)
+	}
+	f.bus.Flush()
+}
+
+func (f *ButtonFixture) Press() {
+	f.Hold(false, 200*time.Millisecond)
+	f.Hold(true, 200*time.Millisecond)
+}
+
+func (f *ButtonFixture) ExpectEvent(ev AppEventType) {
+	select {
+	case event := <-f.events:
+		if event.Ev != ev || event.Target != TargetDownstairs || event.Source != "gpio:17" {
+			f.t.Errorf("Expected %s for gate from gpio:17, got %s for %s from %s",
+				ev, event.Ev, event.Target, event.Source)
+		}
+	default:
+		f.t.Errorf("Expected %s, got nothing", ev)
+	}
+}
+
+func (f *ButtonFixture) ExpectNoMoreEvents() {
+	select {
+	case event := <-f.events:
+		f.t.Errorf("Unexpected event %s", event.Ev)
+	default:
+	}
+}
+
+func TestDoorbellButton(t *testing.T) {
+	f := NewButtonFixture(t, ButtonDoorbell, nil)
+	f.ExpectNoMoreEvents()
+
+	f.Press()
+	f.ExpectEvent(AppDoorbellTriggerEvent)
+	f.ExpectNoMoreEvents()
+
+	// Too short to be a real press.
+	f.Hold(false, gpioInputDebounce/2)
+	f.Hold(true, 2*time.Second)
+	f.ExpectNoMoreEvents()
+
+	f.Press()
+	f.ExpectEvent(AppDoorbellTriggerEvent)
+}
+
+func TestButtonRateLimit(t *testing.T) {
+	f := NewButtonFixture(t, ButtonDoorbell, nil)
+	f.Press()
+	f.ExpectEvent(AppDoorbellTriggerEvent)
+	f.Press()
+	f.Press()
+	f.ExpectNoMoreEvents()
+
+	f.Hold(true, 2*time.Second)
+	f.Press()
+	f.ExpectEvent(AppDoorbellTriggerEvent)
+}
+
+func TestButtonStuckAtStartup(t *testing.T) {
+	f := NewButtonFixture(t, ButtonDoorbell, nil)
+
+	// A button that is already pressed when we start is not a press.
+	input, _ := f.gpio.Input(17, true)
+	f.button = NewButton(f.button.config, input, f.bus, nil)
+	f.button.clock = f.clock
+	f.Hold(false, 2*time.Second)
+	f.ExpectNoMoreEvents()
+
+	f.Hold(true, time.Second)
+	f.Press()
+	f.ExpectEvent(AppDoorbellTriggerEvent)
+}
+
+func TestOpenButtonIsAudited(t *testing.T) {
+	mockClock := &MockClock{}
+	auditLog, dir := CreateTempAuditLog(mockClock)
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	f := NewButtonFixture(t, ButtonOpen, auditLog)
+	f.Press()
+	f.ExpectEvent(AppOpenRequest)
+
+	records, _ := auditLog.Query(AuditFilter{})
+	ExpectTrue(t, len(records) == 1, "One audit record")
+	ExpectTrue(t, records[0].Origin == "gpio:17", "Origin")
+	ExpectTrue(t, records[0].Target == TargetDownstairs, "Target")
+	ExpectTrue(t, records[0].Result == "ok", "Result")
+}
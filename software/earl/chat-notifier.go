@@ -0,0 +1,231 @@
+// Notifications to the chat: doorbells, nightbells and forced doors reach
+// people who are not near enough to hear the bell. Configured in the chat
+// section of the -config file (see ChatConfig).
+//
+// Messages are POSTed as {"text": "..."} to an incoming webhook in the
+// format of Slack; Mattermost, Rocket.Chat and the Matrix and IRC bridges
+// understand it, too.
+//
+// Each message has a short reply code, valid once within reply_window.
+// Members can answer with a slash command configured to POST to /api/chat
+// (reply_command, /earl by default), e.g.
+//
+//	/earl open K7Q2 <your PIN or RFID>
+//
+// which opens the door the message was about, if the code is valid for a
+// member that may open that door now (see Authenticator.AuthUser()). Slash
+// commands are not shown in the channel, so the PIN stays private. Openings
+// and failed attempts are recorded in the audit log.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChatReplyCommand = "/earl"
+	defaultChatReplyWindow  = 5 * time.Minute
+
+	chatSendTimeout = 5 * time.Second
+
+	// Slow down guessing codes.
+	chatAuthFailureDelay = 1 * time.Second
+
+	// No 0/O, 1/I, that are easy to mix up.
+	chatReplyCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	chatReplyCodeLength   = 4
+)
+
+// Events sent to the chat if not configured otherwise.
+var defaultChatEvents = []AppEventType{AppDoorbellTriggerEvent, AppDoorForcedOpenAlarm}
+
+type chatReply struct {
+	target  Target
+	expires time.Time
+}
+
+type ChatNotifier struct {
+	config    *ChatConfig
+	backends  *Backends
+	clock     Clock
+	client    *http.Client
+	appEvents AppEventChannel
+
+	// Held while delaying a failed reply; see RemoteCommands.
+	authFailureLock  sync.Mutex
+	authFailureDelay time.Duration
+
+	lock    sync.Mutex
+	replies map[string]*chatReply // By reply code.
+}
+
+// Subscribes to the bus; call Run() to start sending.
+func NewChatNotifier(config *ChatConfig, backends *Backends) *ChatNotifier {
+	c := &ChatNotifier{
+		config:           config,
+		backends:         backends,
+		clock:            RealClock{},
+		client:           &http.Client{Timeout: chatSendTimeout},
+		appEvents:        make(AppEventChannel, 10),
+		authFailureDelay: chatAuthFailureDelay,
+		replies:          make(map[string]*chatReply),
+	}
+	backends.appEventBus.Subscribe(c.appEvents, SubscriberName("chat"),
+		OnlyEvents(config.Events...))
+	return c
+}
+
+// Send messages for the events. Call in its own goroutine.
+func (c *ChatNotifier) Run() {
+	for event := range c.appEvents {
+		if err := c.send(c.message(event)); err != nil {
+			log.Printf("Chat: %v", err)
+		}
+	}
+}
+
+func newChatReplyCode() string {
+	random := make([]byte, chatReplyCodeLength)
+	rand.Read(random)
+	code := make([]byte, chatReplyCodeLength)
+	for i, b := range random {
+		code[i] = chatReplyCodeAlphabet[int(b)%len(chatReplyCodeAlphabet)]
+	}
+	return string(code)
+}
+
+// Remember a new reply code for the target.
+func (c *ChatNotifier) newReply(target Target) string {
+	now := c.clock.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for code, reply := range c.replies {
+		if now.After(reply.expires) {
+			delete(c.replies, code)
+		}
+	}
+	code := newChatReplyCode()
+	for c.replies[code] != nil {
+		code = newChatReplyCode()
+	}
+	c.replies[code] = &chatReply{target: target, expires: now.Add(c.config.ReplyWindow)}
+	return code
+}
+
+func (c *ChatNotifier) message(event *AppEvent) string {
+	var text string
+	switch {
+	case event.Ev == AppDoorbellTriggerEvent && strings.Contains(event.Msg, "nightbell"):
+		text = fmt.Sprintf("Nightbell at *%s* (%s)", event.Target, event.Msg)
+	case event.Ev == AppDoorbellTriggerEvent:
+		text = fmt.Sprintf("Doorbell at *%s*.", event.Target)
+	case event.Ev == AppDoorForcedOpenAlarm:
+		text = fmt.Sprintf("ALARM: *%s* forced open!", event.Target)
+	case event.Ev == AppDoorHeldOpenAlarm:
+		text = fmt.Sprintf("ALARM: *%s* held open.", event.Target)
+	default:
+		text = fmt.Sprintf("%s %s %s", event.Ev, event.Target, event.Msg)
+	}
+	if c.config.ReplyTokenHash != "" && event.Target != "" {
+		code := c.newReply(event.Target)
+		// Never suggest a plain message: the PIN would be there for
+		// everyone to read.
+		text += fmt.Sprintf(" Reply code %s; the slash command `%s open %s <your PIN>` opens it.",
+			code, c.config.ReplyCommand, code)
+	}
+	return text
+}
+
+func (c *ChatNotifier) send(text string) error {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	response, err := c.client.Post(c.config.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook: status %s", response.Status)
+	}
+	return nil
+}
+
+// Take the reply code. It can only be tried once, so that guessing PINs
+// needs a doorbell for each guess.
+func (c *ChatNotifier) takeReply(code string) *chatReply {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	reply := c.replies[strings.ToUpper(code)]
+	if reply == nil || c.clock.Now().After(reply.expires) {
+		return nil
+	}
+	delete(c.replies, strings.ToUpper(code))
+	return reply
+}
+
+// Handle "open <reply code> <member code>" from chat user. Returns the
+// answer for them.
+func (c *ChatNotifier) handleReply(chatUser string, text string) string {
+	fields := strings.Fields(text)
+	if len(fields) != 3 || fields[0] != "open" {
+		return fmt.Sprintf("Usage: %s open <reply code> <your PIN>", c.config.ReplyCommand)
+	}
+	origin := "chat:" + chatUser
+	reply := c.takeReply(fields[1])
+	if reply == nil {
+		return "Unknown or expired reply code."
+	}
+	code := fields[2]
+	// Check the level first, so that e.g. a limited-use code doesn't lose a
+	// use for nothing.
+	user := c.backends.authenticator.FindUser(code)
+	auth, msg := AuthTargetDenied, "Only members can open from the chat"
+	if user == nil {
+		auth, msg = AuthFail, "No user for code"
+	} else if user.UserLevel == LevelMember {
+		auth, msg = c.backends.authenticator.AuthUser(code, reply.target)
+	}
+	c.backends.auditLog.RecordAttempt(c.clock.Now(), reply.target, origin, code,
+		user, auth, msg)
+	if auth != AuthOk {
+		log.Printf("%s: chat reply by %s denied. %s (%s)",
+			reply.target, chatUser, msg, scrubLogValue(code))
+		c.authFailureLock.Lock()
+		time.Sleep(c.authFailureDelay)
+		c.authFailureLock.Unlock()
+		return "Not authorized."
+	}
+	log.Printf("%s: opened from chat by %s", reply.target, user.Name)
+	c.backends.appEventBus.Post(&AppEvent{
+		Ev:     AppOpenRequest,
+		Target: reply.target,
+		Source: origin,
+		Msg:    "Opening for " + user.Name,
+	})
+	return fmt.Sprintf("Opening %s.", reply.target)
+}
+
+// Slash command: POST /api/chat with the form fields token, user_name and
+// text, as Slack sends them. The answer is only shown to the user.
+func (c *ChatNotifier) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req.ParseForm()
+	hash := hashApiToken(req.Form.Get("token"))
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(c.config.ReplyTokenHash))) != 1 {
+		writeJSONError(out, http.StatusUnauthorized, errBadToken.Error())
+		return
+	}
+	answer := c.handleReply(req.Form.Get("user_name"), req.Form.Get("text"))
+	writeJSONResponse(out, http.StatusOK, map[string]string{"text": answer})
+}
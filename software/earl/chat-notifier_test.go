@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var chatReplyCodeRegexp = regexp.MustCompile(`Reply code ([A-Z0-9]+);`)
+
+// Post the slash command; returns the status and the answer.
+func postChatReply(chat *ChatNotifier, token string, text string) (int, string) {
+	form := url.Values{"token": {token}, "user_name": {"alice"}, "text": {text}}
+	req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	chat.ServeHTTP(recorder, req)
+	var answer map[string]string
+	json.Unmarshal(recorder.Body.Bytes(), &answer)
+	return recorder.Code, answer["text"]
+}
+
+// Wait for the chat message; returns its text and reply code.
+func expectChatMessage(t *testing.T, receiver *WebhookReceiver, expected string) (string, string) {
+	t.Helper()
+	var message map[string]string
+	json.Unmarshal([]byte(receiver.Expect(t).body), &message)
+	text := message["text"]
+	ExpectTrue(t, strings.Contains(text, expected), "Expected '"+expected+"' in "+text)
+	match := chatReplyCodeRegexp.FindStringSubmatch(text)
+	if match == nil {
+		t.Fatalf("No reply code in %s", text)
+	}
+	return text, match[1]
+}
+
+func TestChatNotifier(t *testing.T) {
+	receiver := NewWebhookReceiver(t)
+	config, err := ParseConfig([]byte(`
+targets:
+  - name: gate
+chat:
+  webhook_url: ` + receiver.server.URL + `
+  reply_token_sha256: ` + testTokenHash + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &MockClock{now: time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC)}
+	auditLog, dir := CreateTempAuditLog(clock)
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	auth := NewMockAuthenticator()
+	auth.allow[ACKey{"123456", TargetDownstairs}] = AuthOk
+	bus := NewApplicationBus()
+	opens := make(AppEventChannel, 10)
+	bus.Subscribe(opens, OnlyEvents(AppOpenRequest))
+	chat := NewChatNotifier(config.Chat, &Backends{
+		appEventBus: bus, authenticator: auth, auditLog: auditLog})
+	chat.clock = clock
+	chat.authFailureDelay = 0
+	go chat.Run()
+
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs,
+		Msg: "Bob nightbell."})
+	text, code := expectChatMessage(t, receiver, "Nightbell at *gate* (Bob nightbell.)")
+	ExpectTrue(t, strings.Contains(text, "`/earl open "+code+" <your PIN>`"), "Slash command: "+text)
+
+	status, _ := postChatReply(chat, "guess", "open "+code+" 123456")
+	ExpectTrue(t, status == http.StatusUnauthorized, "Slash command token checked")
+	_, answer := postChatReply(chat, testToken, "open "+code+" 999999")
+	ExpectTrue(t, answer == "Not authorized.", answer)
+	_, answer = postChatReply(chat, testToken, "open "+code+" 123456")
+	ExpectTrue(t, answer == "Unknown or expired reply code.", "Only one try: "+answer)
+
+	bus.Post(&AppEvent{Ev: AppDoorForcedOpenAlarm, Target: TargetDownstairs})
+	_, code = expectChatMessage(t, receiver, "ALARM: *gate* forced open!")
+	clock.now = clock.now.Add(defaultChatReplyWindow + time.Second)
+	_, answer = postChatReply(chat, testToken, "open "+code+" 123456")
+	ExpectTrue(t, answer == "Unknown or expired reply code.", "Expired: "+answer)
+
+	bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetDownstairs}) // Not sent.
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	_, code = expectChatMessage(t, receiver, "Doorbell at *gate*.")
+	_, answer = postChatReply(chat, testToken, "open "+strings.ToLower(code)+" 123456")
+	ExpectTrue(t, answer == "Opening gate.", answer)
+	for opened := false; !opened; {
+		select {
+		case event := <-opens:
+			opened = event.Source == "chat:alice" && event.Target == TargetDownstairs
+		case <-time.After(asyncTestTimeout):
+			t.Fatal("Timeout waiting for open request")
+		}
+	}
+	receiver.ExpectNone(t)
+
+	records, _ := auditLog.Query(AuditFilter{})
+	ExpectTrue(t, len(records) == 2, "Audit records")
+	ExpectTrue(t, records[0].Result == "failed" && records[0].Origin == "chat:alice", "Failure")
+	ExpectTrue(t, records[1].Result == "ok" && records[1].Level == LevelMember, "Opened")
+}
+
+func TestChatReplyOnlyForMembers(t *testing.T) {
+	receiver := NewWebhookReceiver(t)
+	config, err := ParseConfig([]byte(`
+targets:
+  - name: gate
+chat:
+  webhook_url: ` + receiver.server.URL + `
+  reply_token_sha256: ` + testTokenHash + `
+  reply_command: /door
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authFile, _ := ioutil.TempFile("", "test-chat-reply")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	clock := &MockClock{now: time.Date(2026, 10, 1, 14, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, clock)
+	visitor := User{UserLevel: LevelUser, ValidFrom: clock.now.Add(-time.Minute), UsesLeft: 1}
+	visitor.SetAuthCode("visitor123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", visitor)), "Add limited user")
+	bus := NewApplicationBus()
+	chat := NewChatNotifier(config.Chat, &Backends{appEventBus: bus, authenticator: auth})
+	chat.clock = clock
+	chat.authFailureDelay = 0
+	go chat.Run()
+
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	text, code := expectChatMessage(t, receiver, "Doorbell at *gate*.")
+	ExpectTrue(t, strings.Contains(text, "`/door open "), "Configured command: "+text)
+	_, answer := postChatReply(chat, testToken, "open "+code+" visitor123")
+	ExpectTrue(t, answer == "Not authorized.", answer)
+	ExpectTrue(t, auth.FindUser("visitor123").UsesLeft == 1, "Use not taken")
+}
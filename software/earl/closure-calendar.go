@@ -0,0 +1,210 @@
+// Calendar of periods in which the space is closed, e.g. the winter break.
+//
+// Closures are read from a CSV file, one closure per line:
+//
+//	# from,to,levels,targets,description
+//	2016-12-21,2017-01-06,user,,Winter break
+//	2017-03-04 18:00,2017-03-05 08:00,user;fulltimeuser,gate;upstairs,Party
+//
+// Times are either a date, which is the whole day (so the 'to' day is
+// included), or "2006-01-02 15:04" (the 'to' time is excluded).
+// Levels and targets are semicolon separated lists. An empty list of targets
+// means all targets. An empty list of levels means all levels but members,
+// who are responsible for the space and always have access; to close the
+// space even for members, list "member" explicitly.
+//
+// Like the user file, the calendar is re-read whenever it changes.
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Closure struct {
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"` // Exclusive
+	Levels      []Level   `json:"levels,omitempty"`
+	Targets     []Target  `json:"targets,omitempty"`
+	Description string    `json:"description"`
+}
+
+type ClosureCalendar struct {
+	filename string
+
+	lock          sync.Mutex
+	fileTimestamp time.Time
+	closures      []*Closure // Sorted by From.
+}
+
+// Does this closure deny access to user of "level" for "target" at "now" ?
+func (c *Closure) AppliesTo(level Level, target Target, now time.Time) bool {
+	if now.Before(c.From) || !now.Before(c.To) {
+		return false
+	}
+	levelMatches := len(c.Levels) == 0 && level != LevelMember
+	for _, l := range c.Levels {
+		levelMatches = levelMatches || l == level
+	}
+	targetMatches := len(c.Targets) == 0
+	for _, t := range c.Targets {
+		targetMatches = targetMatches || t == target
+	}
+	return levelMatches && targetMatches
+}
+
+// Parse closure time, in local time like the access hours. Returns the time
+// and if it was a date only.
+func parseClosureTime(value string) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+	return t, false, err
+}
+
+func NewClosureFromCSVLine(line []string) (*Closure, error) {
+	if len(line) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(line))
+	}
+	from, _, err := parseClosureTime(line[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %v", err)
+	}
+	to, dateOnly, err := parseClosureTime(line[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %v", err)
+	}
+	if dateOnly {
+		to = to.AddDate(0, 0, 1) // Including that day.
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("empty range")
+	}
+	result := &Closure{
+		From:        from,
+		To:          to,
+		Description: strings.TrimSpace(line[4]),
+	}
+	for _, level := range strings.Split(line[2], ";") {
+		level = strings.TrimSpace(level)
+		if level == "" {
+			continue
+		}
+		if !isValidLevel(level) {
+			return nil, fmt.Errorf("invalid level '%s'", level)
+		}
+		result.Levels = append(result.Levels, Level(level))
+	}
+	for _, target := range strings.Split(line[3], ";") {
+		if target = strings.TrimSpace(target); target != "" {
+			result.Targets = append(result.Targets, Target(target))
+		}
+	}
+	return result, nil
+}
+
+// Create a closure calendar from the given file. Returns nil if the file
+// can't be read.
+func NewClosureCalendar(filename string) *ClosureCalendar {
+	c := &ClosureCalendar{filename: filename}
+	if !c.readCalendar() {
+		return nil
+	}
+	return c
+}
+
+func (c *ClosureCalendar) readCalendar() bool {
+	f, err := os.Open(c.filename)
+	if err != nil {
+		log.Println("Could not read closure calendar", err)
+		return false
+	}
+	defer f.Close()
+	fileinfo, _ := f.Stat()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	var closures []*Closure
+	for lineno := 1; ; lineno++ {
+		line, err := reader.Read()
+		if err != nil {
+			break
+		}
+		closure, err := NewClosureFromCSVLine(line)
+		if err != nil {
+			log.Printf("%s:%d: %v", c.filename, lineno, err)
+			continue
+		}
+		closures = append(closures, closure)
+	}
+	sort.Slice(closures, func(i, j int) bool {
+		return closures[i].From.Before(closures[j].From)
+	})
+	log.Printf("Read %d closures from %s", len(closures), c.filename)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fileTimestamp = fileinfo.ModTime()
+	c.closures = closures
+	return true
+}
+
+func (c *ClosureCalendar) reloadIfChanged() {
+	fileinfo, err := os.Stat(c.filename)
+	if err != nil {
+		return // Keep what we have.
+	}
+	c.lock.Lock()
+	unchanged := c.fileTimestamp == fileinfo.ModTime()
+	c.lock.Unlock()
+	if unchanged {
+		return
+	}
+	log.Printf("Refreshing changed %s", c.filename)
+	c.readCalendar()
+}
+
+// Return the closure denying access to a user of the given level for the
+// target at time "now" or nil if there is none. Can be called on a nil
+// ClosureCalendar, which never has closures.
+func (c *ClosureCalendar) ActiveClosure(level Level, target Target, now time.Time) *Closure {
+	if c == nil {
+		return nil
+	}
+	c.reloadIfChanged()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, closure := range c.closures {
+		if closure.AppliesTo(level, target, now) {
+			return closure
+		}
+	}
+	return nil
+}
+
+// Return closures that are not over yet at time "now", in chronological
+// order.
+func (c *ClosureCalendar) Upcoming(now time.Time) []Closure {
+	result := []Closure{}
+	if c == nil {
+		return result
+	}
+	c.reloadIfChanged()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, closure := range c.closures {
+		if now.Before(closure.To) {
+			result = append(result, *closure)
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func CreateClosureFile(content string) string {
+	closureFile, _ := ioutil.TempFile("", "test-closures")
+	closureFile.WriteString(content)
+	closureFile.Close()
+	return closureFile.Name()
+}
+
+func TestClosureRules(t *testing.T) {
+	closureFile := CreateClosureFile(`# from,to,levels,targets,description
+2016-12-21,2017-01-06,,,Winter break
+2017-03-04 18:00,2017-03-05 08:00,user;member,upstairs,Party
+2017-04-01,2017-04-01,nosuchlevel,,Broken line
+`)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(closureFile)
+	}
+	closures := NewClosureCalendar(closureFile)
+	if closures == nil {
+		t.Fatal("Could not read closures")
+	}
+
+	winter, _ := time.ParseInLocation("2006-01-02 15:04", "2017-01-06 23:59", time.Local)
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, winter) != nil,
+		"Last day of closure is included")
+	ExpectTrue(t, closures.ActiveClosure(LevelPhilanthropist, TargetDownstairs, winter) != nil,
+		"Empty levels apply to everyone...")
+	ExpectTrue(t, closures.ActiveClosure(LevelMember, TargetDownstairs, winter) == nil,
+		"...but members")
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, winter.Add(time.Minute)) == nil,
+		"After closure")
+
+	party, _ := time.ParseInLocation("2006-01-02 15:04", "2017-03-04 20:00", time.Local)
+	ExpectTrue(t, closures.ActiveClosure(LevelMember, TargetUpstairs, party) != nil,
+		"Explicitly listed member")
+	ExpectTrue(t, closures.ActiveClosure(LevelFulltimeUser, TargetUpstairs, party) == nil,
+		"Level not listed")
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetDownstairs, party) == nil,
+		"Target not listed")
+	partyOver, _ := time.ParseInLocation("2006-01-02 15:04", "2017-03-05 08:00", time.Local)
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, partyOver) == nil,
+		"Time-range end is exclusive")
+
+	upcoming := closures.Upcoming(winter.Add(time.Minute))
+	ExpectTrue(t, len(upcoming) == 1 && upcoming[0].Description == "Party",
+		"Only party upcoming; broken line ignored")
+
+	// Modify file. Change the timestamp to make sure it is noticed.
+	ioutil.WriteFile(closureFile, []byte("2017-03-04,2017-03-04,,,Cleaning day\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(closureFile, later, later)
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, party).Description == "Cleaning day",
+		"Reloaded calendar")
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, winter) == nil,
+		"Winter break gone")
+}
+
+func TestClosuresInLocalTime(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("PST", -8*3600)
+	closureFile := CreateClosureFile("2017-03-04 18:00,2017-03-05 08:00,,,Party\n")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(closureFile)
+	}
+	closures := NewClosureCalendar(closureFile)
+
+	evening := time.Date(2017, 3, 4, 18, 30, 0, 0, time.Local)
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, evening) != nil,
+		"Closed in the evening, local time")
+	ExpectTrue(t, closures.ActiveClosure(LevelUser, TargetUpstairs, evening.Add(-8*time.Hour)) == nil,
+		"Open at 18:30 UTC")
+}
+
+func TestClosuresHttpApi(t *testing.T) {
+	closureFile := CreateClosureFile(`2016-12-21,2017-01-06,,,Past break
+2096-12-21,2097-01-06,user,,Future break
+`)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(closureFile)
+	}
+	mux := http.NewServeMux()
+	NewApiServer(&Backends{
+		authenticator: NewMockAuthenticator(),
+		appEventBus:   NewApplicationBus(),
+		closures:      NewClosureCalendar(closureFile),
+	}, mux)
+
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest("GET", "/api/closures", nil))
+	var closures []Closure
+	json.Unmarshal(response.Body.Bytes(), &closures)
+	ExpectTrue(t, len(closures) == 1 && closures[0].Description == "Future break",
+		"Only upcoming closures")
+	ExpectTrue(t, len(closures[0].Levels) == 1 && closures[0].Levels[0] == LevelUser,
+		"Levels reported")
+}
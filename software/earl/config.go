@@ -0,0 +1,445 @@
+// Declarative configuration of the targets, given with -config.
+//
+// Each target has a name, which is also the name of the terminal mounted
+// there, a handler that runs on that terminal and optionally a relay that
+// opens the door:
+//
+//	targets:
+//	  - name: gate
+//	    handler: access         # access, control or debug
+//	    relay_pin: 7            # GPIO pin; leave out if there is no relay
+//	    active_low: true        # relay switches on with a low signal
+//	    open_duration: 2s       # how long to keep the door open
+//	    rate_limit: 500ms       # minimum time between door openings
+//	    bell: gate.wav          # relative to -belldir if not absolute
+//	    control_key: "4"        # key to open it from the control terminal;
+//	                            # not one of the menu keys 1,2,3,7,8,9
+//	    door_sensor:            # optional reed contact
+//	      pin: 22
+//	      active_low: false     # input high means door open
+//	      held_open_alarm: 5m   # alarm if open longer; negative: no alarm
+//	      forced_open_alarm: true  # alarm if opened without open request.
+//	                            # Not useful if people leave through it.
+//	  - name: control
+//	    handler: control
+//	spare_relays:               # optional; relays without a door, kept off
+//	  - pin: 8
+//	    active_low: true
+//	buttons:                    # optional push buttons
+//	  - pin: 17
+//	    target: gate
+//	    action: doorbell        # doorbell or open
+//	    active_low: true        # pressed button pulls input low
+//	    rate_limit: 2s          # ignore presses in quick succession
+//	api_clients:                # optional; scripts sending commands
+//	  - name: doorbot           # events have Source api:doorbot
+//	    token_sha256: 9f86d0... # echo -n <token> | sha256sum
+//	    targets: [gate]         # empty: all targets
+//	    commands: [open]        # open, hush-bell, trigger-bell; empty: all
+//	    rate_limit: 2s          # minimum time between commands
+//	    mqtt: true              # also earl/command/doorbot; needs broker ACLs
+//	websocket_origins:          # web pages elsewhere that may use the
+//	  - https://noisebridge.net # WebSocket (/api/events/ws); default: none
+//	spaceapi:                   # optional; static part of /spaceapi.json
+//	  space: Noisebridge        # see spaceapi.go
+//	webhooks:                   # optional; POST events elsewhere
+//	  - url: http://pegasus.noise/bell/
+//	    name: pegasus           # in logs and metrics; default: host
+//	    events: [trigger-bell]  # empty: all events
+//	    targets: [gate]         # empty: all targets
+//	    payload: '{"tone": {{json .Target}}}'  # template; default: event JSON
+//	    secret: s3cr3t          # optional; HMAC signature, see webhooks.go
+//	    timeout: 5s
+//	    retries: 3              # on network and server errors; -1: none
+//	chat:                       # optional; see chat-notifier.go
+//	  webhook_url: https://hooks.slack.com/services/...
+//	  events: [trigger-bell, door-forced-open]   # the default
+//	  reply_token_sha256: 2c26b4...  # slash command token; empty: no replies
+//	  reply_command: /earl      # the slash command, named in the messages
+//	  reply_window: 5m          # how long reply codes are valid
+//
+// Without a configuration file, DefaultConfig() describes the installation
+// at Noisebridge.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type HandlerType string
+
+const (
+	HandlerAccess  = HandlerType("access")  // Opens doors for valid codes.
+	HandlerControl = HandlerType("control") // UI to add new users.
+	HandlerDebug   = HandlerType("debug")   // Logs keypresses and RFIDs.
+)
+
+type TargetConfig struct {
+	Name         Target        `yaml:"name"`
+	Handler      HandlerType   `yaml:"handler"`
+	RelayPin     *int          `yaml:"relay_pin"` // nil: no relay.
+	ActiveLow    bool          `yaml:"active_low"`
+	OpenDuration time.Duration `yaml:"open_duration"`
+	RateLimit    time.Duration `yaml:"rate_limit"`
+	Bell         string        `yaml:"bell"`        // Default: <name>.wav
+	ControlKey   string        `yaml:"control_key"` // Optional. Keep clear of menu keys.
+
+	Sensor *DoorSensorConfig `yaml:"door_sensor"` // Optional.
+}
+
+type DoorSensorConfig struct {
+	Pin             int           `yaml:"pin"`
+	ActiveLow       bool          `yaml:"active_low"` // Low input: door open.
+	HeldOpenAlarm   time.Duration `yaml:"held_open_alarm"`
+	ForcedOpenAlarm bool          `yaml:"forced_open_alarm"`
+}
+
+// A relay that is wired up, but not used by a target. Switched off at start.
+type SpareRelayConfig struct {
+	Pin       int  `yaml:"pin"`
+	ActiveLow bool `yaml:"active_low"`
+}
+
+type ButtonConfig struct {
+	Pin       int           `yaml:"pin"`
+	ActiveLow bool          `yaml:"active_low"` // Low input: pressed.
+	Target    Target        `yaml:"target"`
+	Action    ButtonAction  `yaml:"action"`
+	RateLimit time.Duration `yaml:"rate_limit"`
+}
+
+// A client allowed to send commands over the API; see remote-commands.go.
+type ApiClientConfig struct {
+	Name      string         `yaml:"name"`
+	TokenHash string         `yaml:"token_sha256"` // Hex SHA-256 of the token.
+	Targets   []Target       `yaml:"targets"`      // Empty: all targets.
+	Commands  []AppEventType `yaml:"commands"`     // Empty: all commands.
+	RateLimit time.Duration  `yaml:"rate_limit"`
+	Mqtt      bool           `yaml:"mqtt"` // Commands on its topic; needs broker ACLs.
+}
+
+// Where to POST events to; see webhooks.go.
+type WebhookConfig struct {
+	URL     string         `yaml:"url"`
+	Name    string         `yaml:"name"`    // Default: host of the URL.
+	Events  []AppEventType `yaml:"events"`  // Empty: all events.
+	Targets []Target       `yaml:"targets"` // Empty: all targets.
+	Payload string         `yaml:"payload"` // Template; default: event JSON.
+	Secret  string         `yaml:"secret"`  // Optional. Key for HMAC signature.
+	Timeout time.Duration  `yaml:"timeout"`
+	Retries int            `yaml:"retries"` // Negative: none.
+}
+
+// Chat notifications; see chat-notifier.go.
+type ChatConfig struct {
+	WebhookURL     string         `yaml:"webhook_url"`
+	Events         []AppEventType `yaml:"events"`
+	ReplyTokenHash string         `yaml:"reply_token_sha256"` // Optional.
+	ReplyCommand   string         `yaml:"reply_command"`
+	ReplyWindow    time.Duration  `yaml:"reply_window"`
+}
+
+type Config struct {
+	Targets     []*TargetConfig     `yaml:"targets"`
+	SpareRelays []*SpareRelayConfig `yaml:"spare_relays"`
+	Buttons     []*ButtonConfig     `yaml:"buttons"`
+	ApiClients  []*ApiClientConfig  `yaml:"api_clients"`
+	Webhooks    []*WebhookConfig    `yaml:"webhooks"`
+	Chat        *ChatConfig         `yaml:"chat"` // Optional.
+
+	// Origins of web pages, besides our own, whose scripts may open
+	// WebSockets; e.g. https://noisebridge.net
+	WebSocketOrigins []string `yaml:"websocket_origins"`
+
+	// Static fields of the SpaceAPI; passed on as they are.
+	SpaceApi map[string]interface{} `yaml:"spaceapi"`
+}
+
+func relayPin(pin int) *int {
+	return &pin
+}
+
+// The configuration as it is wired at Noisebridge. Used if no config file is
+// given.
+func DefaultConfig() *Config {
+	config := &Config{
+		Targets: []*TargetConfig{
+			{Name: TargetDownstairs, Handler: HandlerAccess,
+				RelayPin: relayPin(7), ActiveLow: true, ControlKey: "4"},
+			{Name: TargetUpstairs, Handler: HandlerAccess,
+				RelayPin: relayPin(11), ActiveLow: true, ControlKey: "5"},
+			{Name: TargetElevator, Handler: HandlerAccess,
+				RelayPin: relayPin(9), ActiveLow: true, ControlKey: "6"},
+			{Name: TargetControlUI, Handler: HandlerControl},
+		},
+		SpareRelays: []*SpareRelayConfig{{Pin: 8, ActiveLow: true}},
+	}
+	config.applyDefaults()
+	return config
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(content)
+}
+
+func ParseConfig(content []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) applyDefaults() {
+	for _, target := range c.Targets {
+		if target.Handler == "" {
+			target.Handler = HandlerAccess
+		}
+		if target.OpenDuration == 0 {
+			target.OpenDuration = defaultDoorOpenTime
+		}
+		if target.RateLimit == 0 {
+			target.RateLimit = defaultDoorOpenRateLimit
+		}
+		if target.Bell == "" {
+			target.Bell = string(target.Name) + ".wav"
+		}
+		if target.Sensor != nil && target.Sensor.HeldOpenAlarm == 0 {
+			target.Sensor.HeldOpenAlarm = defaultDoorHeldOpenAlarm
+		}
+	}
+	for _, button := range c.Buttons {
+		if button.RateLimit == 0 {
+			button.RateLimit = defaultButtonRateLimit
+		}
+	}
+	for _, client := range c.ApiClients {
+		if client.RateLimit == 0 {
+			client.RateLimit = defaultApiClientRateLimit
+		}
+		if len(client.Commands) == 0 {
+			client.Commands = remoteCommandTypes
+		}
+	}
+	for _, hook := range c.Webhooks {
+		if hook.Name == "" {
+			if u, err := url.Parse(hook.URL); err == nil {
+				hook.Name = u.Host
+			}
+		}
+		if hook.Timeout == 0 {
+			hook.Timeout = defaultWebhookTimeout
+		}
+		if hook.Retries == 0 {
+			hook.Retries = defaultWebhookRetries
+		}
+	}
+	if c.Chat != nil {
+		if len(c.Chat.Events) == 0 {
+			c.Chat.Events = defaultChatEvents
+		}
+		if c.Chat.ReplyCommand == "" {
+			c.Chat.ReplyCommand = defaultChatReplyCommand
+		}
+		if c.Chat.ReplyWindow == 0 {
+			c.Chat.ReplyWindow = defaultChatReplyWindow
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("no targets configured")
+	}
+	names := make(map[Target]bool)
+	pins := make(map[int]Target)
+	keys := make(map[string]Target)
+	for i, target := range c.Targets {
+		if target.Name == "" {
+			return fmt.Errorf("target #%d: missing name", i+1)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("target %s: duplicate name", target.Name)
+		}
+		names[target.Name] = true
+		switch target.Handler {
+		case HandlerAccess, HandlerControl, HandlerDebug:
+		default:
+			return fmt.Errorf("target %s: unknown handler '%s'",
+				target.Name, target.Handler)
+		}
+		if target.ControlKey != "" {
+			if len(target.ControlKey) != 1 || target.ControlKey[0] < '0' || target.ControlKey[0] > '9' {
+				return fmt.Errorf("target %s: control key needs to be a digit",
+					target.Name)
+			}
+			if strings.Contains(controlMenuKeys, target.ControlKey) {
+				return fmt.Errorf("target %s: control key %s is a menu key of the control terminal",
+					target.Name, target.ControlKey)
+			}
+			if other, exists := keys[target.ControlKey]; exists {
+				return fmt.Errorf("target %s: control key %s already used by %s",
+					target.Name, target.ControlKey, other)
+			}
+			keys[target.ControlKey] = target.Name
+		}
+		if target.RelayPin != nil {
+			if err := claimPin(pins, *target.RelayPin, target.Name, "relay"); err != nil {
+				return err
+			}
+		}
+		if target.Sensor != nil {
+			if err := claimPin(pins, target.Sensor.Pin, target.Name, "door sensor"); err != nil {
+				return err
+			}
+		}
+	}
+	for i, relay := range c.SpareRelays {
+		if relay.Pin < 0 {
+			return fmt.Errorf("spare relay #%d: invalid pin %d", i+1, relay.Pin)
+		}
+		if other, exists := pins[relay.Pin]; exists {
+			return fmt.Errorf("spare relay #%d: pin %d already used by %s",
+				i+1, relay.Pin, other)
+		}
+		pins[relay.Pin] = Target(fmt.Sprintf("spare relay #%d", i+1))
+	}
+	for i, button := range c.Buttons {
+		if !names[button.Target] {
+			return fmt.Errorf("button #%d: unknown target '%s'", i+1, button.Target)
+		}
+		switch button.Action {
+		case ButtonDoorbell, ButtonOpen:
+		default:
+			return fmt.Errorf("button #%d: unknown action '%s'", i+1, button.Action)
+		}
+		if err := claimPin(pins, button.Pin, button.Target, "button"); err != nil {
+			return err
+		}
+	}
+	clients := make(map[string]bool)
+	for i, client := range c.ApiClients {
+		if client.Name == "" {
+			return fmt.Errorf("api client #%d: missing name", i+1)
+		}
+		if clients[client.Name] {
+			return fmt.Errorf("api client %s: duplicate name", client.Name)
+		}
+		clients[client.Name] = true
+		if client.Mqtt && strings.ContainsAny(client.Name, "/+#") {
+			return fmt.Errorf("api client %s: name can't be an MQTT topic", client.Name)
+		}
+		if hash, err := hex.DecodeString(client.TokenHash); err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("api client %s: token_sha256 needs to be 64 hex digits",
+				client.Name)
+		}
+		for _, target := range client.Targets {
+			if !names[target] {
+				return fmt.Errorf("api client %s: unknown target '%s'",
+					client.Name, target)
+			}
+		}
+		for _, command := range client.Commands {
+			if !isRemoteCommand(command) {
+				return fmt.Errorf("api client %s: unknown command '%s'",
+					client.Name, command)
+			}
+		}
+	}
+	for i, hook := range c.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook #%d: url needs to be http(s)://host/...", i+1)
+		}
+		for _, target := range hook.Targets {
+			if !names[target] {
+				return fmt.Errorf("webhook %s: unknown target '%s'", hook.Name, target)
+			}
+		}
+		if _, err := parseWebhookPayload(hook); err != nil {
+			return fmt.Errorf("webhook %s: payload: %v", hook.Name, err)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("webhook %s: negative timeout", hook.Name)
+		}
+	}
+	if c.Chat != nil {
+		u, err := url.Parse(c.Chat.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("chat: webhook_url needs to be http(s)://host/...")
+		}
+		if c.Chat.ReplyTokenHash != "" {
+			if hash, err := hex.DecodeString(c.Chat.ReplyTokenHash); err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("chat: reply_token_sha256 needs to be 64 hex digits")
+			}
+		}
+		if !strings.HasPrefix(c.Chat.ReplyCommand, "/") || strings.ContainsAny(c.Chat.ReplyCommand, " \t") {
+			return fmt.Errorf("chat: reply_command needs to be a slash command like /earl")
+		}
+	}
+	if c.SpaceApi != nil {
+		for _, field := range spaceApiRequiredFields {
+			if _, exists := c.SpaceApi[field]; !exists {
+				return fmt.Errorf("spaceapi: missing %s", field)
+			}
+		}
+	}
+	return nil
+}
+
+// Make sure every GPIO pin is only used once.
+func claimPin(pins map[int]Target, pin int, name Target, what string) error {
+	if pin < 0 {
+		return fmt.Errorf("target %s: invalid %s pin %d", name, what, pin)
+	}
+	if other, exists := pins[pin]; exists {
+		return fmt.Errorf("target %s: %s pin %d already used by %s",
+			name, what, pin, other)
+	}
+	pins[pin] = name
+	return nil
+}
+
+// Find configuration for target. Returns nil if not configured.
+func (c *Config) Target(name Target) *TargetConfig {
+	for _, target := range c.Targets {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
+
+// Find the target opened with the given key on the control terminal.
+func (c *Config) TargetForControlKey(key byte) *TargetConfig {
+	for _, target := range c.Targets {
+		if target.ControlKey == string(key) {
+			return target
+		}
+	}
+	return nil
+}
+
+func (c *Config) TargetNames() []Target {
+	result := make([]Target, len(c.Targets))
+	for i, target := range c.Targets {
+		result[i] = target.Name
+	}
+	return result
+}
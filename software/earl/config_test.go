@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+targets:
+  - name: gate
+    relay_pin: 7
+    active_low: true
+    open_duration: 3s
+    bell: /usr/share/sounds/gate.wav
+    control_key: "4"
+  - name: workshop
+    relay_pin: 17
+    rate_limit: 2s
+    door_sensor:
+      pin: 22
+      active_low: true
+      forced_open_alarm: true
+  - name: control
+    handler: control
+  - name: test
+    handler: debug
+buttons:
+  - pin: 18
+    target: gate
+    action: open
+    active_low: true
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ExpectTrue(t, len(config.Targets) == 4, "Number of targets")
+
+	gate := config.Target(TargetDownstairs)
+	ExpectTrue(t, gate != nil && *gate.RelayPin == 7 && gate.ActiveLow, "Gate relay")
+	ExpectTrue(t, gate.OpenDuration == 3*time.Second, "Open duration")
+	ExpectTrue(t, gate.RateLimit == defaultDoorOpenRateLimit, "Default rate limit")
+	ExpectTrue(t, gate.Bell == "/usr/share/sounds/gate.wav", "Bell")
+	ExpectTrue(t, config.TargetForControlKey('4') == gate, "Control key")
+	ExpectTrue(t, config.TargetForControlKey('5') == nil, "No control key")
+
+	workshop := config.Target(Target("workshop"))
+	ExpectTrue(t, workshop.Handler == HandlerAccess, "Default handler")
+	ExpectFalse(t, workshop.ActiveLow, "Default polarity")
+	ExpectTrue(t, workshop.OpenDuration == defaultDoorOpenTime, "Default open duration")
+	ExpectTrue(t, workshop.RateLimit == 2*time.Second, "Rate limit")
+	ExpectTrue(t, workshop.Bell == "workshop.wav", "Default bell")
+	ExpectTrue(t, workshop.Sensor.Pin == 22 && workshop.Sensor.ActiveLow, "Sensor")
+	ExpectTrue(t, workshop.Sensor.HeldOpenAlarm == defaultDoorHeldOpenAlarm,
+		"Default held open alarm")
+	ExpectTrue(t, workshop.Sensor.ForcedOpenAlarm, "Forced open alarm")
+	ExpectTrue(t, gate.Sensor == nil, "No sensor")
+
+	ExpectTrue(t, config.Target(TargetControlUI).RelayPin == nil, "No relay")
+	ExpectTrue(t, config.Target(Target("test")).Handler == HandlerDebug, "Debug")
+	ExpectTrue(t, config.Target(TargetElevator) == nil, "Not configured")
+
+	ExpectTrue(t, len(config.Buttons) == 1, "Number of buttons")
+	button := config.Buttons[0]
+	ExpectTrue(t, button.Pin == 18 && button.ActiveLow, "Button pin")
+	ExpectTrue(t, button.Target == TargetDownstairs && button.Action == ButtonOpen,
+		"Button action")
+	ExpectTrue(t, button.RateLimit == defaultButtonRateLimit, "Default button rate limit")
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, broken := range []struct{ config, expected string }{
+		{"targets:\n", "no targets"},
+		{"targets:\n  - relay_pin: 7\n", "missing name"},
+		{"targets:\n  - name: gate\n  - name: gate\n", "duplicate name"},
+		{"targets:\n  - name: gate\n    handler: magic\n", "unknown handler"},
+		{"targets:\n  - name: gate\n    relay_pin: -1\n", "invalid relay pin"},
+		{"targets:\n  - name: gate\n    relay_pin: 7\n  - name: upstairs\n    relay_pin: 7\n",
+			"already used by gate"},
+		{"targets:\n  - name: gate\n    control_key: \"#\"\n", "needs to be a digit"},
+		{"targets:\n  - name: gate\n    control_key: \"4\"\n  - name: upstairs\n    control_key: \"4\"\n",
+			"already used by gate"},
+		{"targets:\n  - name: gate\n    control_key: \"8\"\n", "menu key"},
+		{"targets:\n  - name: gate\n    relay_pin: 8\nspare_relays:\n  - pin: 8\n",
+			"spare relay #1: pin 8 already used by gate"},
+		{"targets:\n  - name: gate\n    open_duration: forever\n", "forever"},
+		{"targets:\n  - name: gate\n    relay_pin: 7\n    door_sensor:\n      pin: 7\n",
+			"door sensor pin 7 already used by gate"},
+		{"targets:\n  - name: gate\nbuttons:\n  - pin: 17\n    target: upstairs\n    action: open\n",
+			"unknown target 'upstairs'"},
+		{"targets:\n  - name: gate\nbuttons:\n  - pin: 17\n    target: gate\n    action: explode\n",
+			"unknown action 'explode'"},
+		{"targets:\n  - name: gate\n    relay_pin: 17\nbuttons:\n  - pin: 17\n    target: gate\n    action: open\n",
+			"button pin 17 already used by gate"},
+		{"targets:\n  - name: gate\napi_clients:\n  - token_sha256: " + testTokenHash + "\n",
+			"api client #1: missing name"},
+		{"targets:\n  - name: gate\napi_clients:\n  - name: bot\n    token_sha256: secret\n",
+			"64 hex digits"},
+		{"targets:\n  - name: gate\napi_clients:\n  - name: bot\n    token_sha256: " + testTokenHash + "\n    targets: [upstairs]\n",
+			"unknown target 'upstairs'"},
+		{"targets:\n  - name: gate\napi_clients:\n  - name: bot\n    token_sha256: " + testTokenHash + "\n    commands: [explode]\n",
+			"unknown command 'explode'"},
+		{"targets:\n  - name: gate\napi_clients:\n  - name: bot/1\n    token_sha256: " + testTokenHash + "\n    mqtt: true\n",
+			"can't be an MQTT topic"},
+		{"targets:\n  - name: gate\nspaceapi:\n  space: Noisebridge\n", "spaceapi: missing logo"},
+		{"targets:\n  - name: gate\nwebhooks:\n  - url: pegasus.noise/bell\n",
+			"webhook #1: url needs"},
+		{"targets:\n  - name: gate\nwebhooks:\n  - url: http://pegasus.noise/\n    targets: [upstairs]\n",
+			"webhook pegasus.noise: unknown target 'upstairs'"},
+		{"targets:\n  - name: gate\nwebhooks:\n  - url: http://pegasus.noise/\n    payload: '{{.Target'\n",
+			"webhook pegasus.noise: payload"},
+		{"targets:\n  - name: gate\nchat:\n  webhook_url: hooks.slack.com\n", "chat: webhook_url"},
+		{"targets:\n  - name: gate\nchat:\n  webhook_url: https://hooks.slack.com/x\n  reply_token_sha256: 9f86\n",
+			"chat: reply_token_sha256"},
+	} {
+		_, err := ParseConfig([]byte(broken.config))
+		if err == nil || !strings.Contains(err.Error(), broken.expected) {
+			t.Errorf("Expected error containing '%s', got %v", broken.expected, err)
+		}
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config := DefaultConfig()
+	ExpectTrue(t, config.validate() == nil, "Default config valid")
+	ExpectTrue(t, *config.Target(TargetUpstairs).RelayPin == 11, "Upstairs pin")
+	ExpectTrue(t, config.TargetForControlKey('6').Name == TargetElevator,
+		"Elevator control key")
+	ExpectTrue(t, config.Target(TargetControlUI).Handler == HandlerControl,
+		"Control UI")
+}
@@ -14,6 +14,12 @@ func (h *DebugHandler) Init(t Terminal) {
 	h.t = t
 }
 
+func (h *DebugHandler) HandleShutdown() {}
+
+func (h *DebugHandler) HandleAppEvent(event *AppEvent) {
+	log.Print("Received event: ", event.Ev)
+}
+
 func (h *DebugHandler) HandleKeypress(b byte) {
 	log.Print("Received keypress: ", string(b))
 	switch b {
@@ -0,0 +1,118 @@
+// Door sensors: reed contacts wired to GPIO input pins.
+//
+// Each sensor is polled regularly and debounced, as reed contacts tend to
+// bounce when the door swings. Changes are posted as AppDoorSensorEvent
+// (Value 1: open, 0: closed).
+//
+// In addition, there are alarms if the door stays open too long or if it
+// is opened without having been buzzed open before (forced open).
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// People need a moment after the buzzer to push the door open.
+	doorOpenRequestGrace = 10 * time.Second
+
+	defaultDoorHeldOpenAlarm = 5 * time.Minute
+)
+
+type DoorSensor struct {
+	target *TargetConfig
+	input  *debouncedInput
+	bus    *ApplicationBus
+	clock  Clock
+
+	// Only accessed from the polling goroutine.
+	stateKnown    bool
+	openSince     time.Time
+	heldOpenAlarm bool // Alarm already raised for this opening.
+
+	lock            sync.Mutex
+	lastOpenRequest time.Time
+}
+
+func NewDoorSensor(target *TargetConfig, input DigitalInput, bus *ApplicationBus) *DoorSensor {
+	return &DoorSensor{
+		target: target,
+		input: &debouncedInput{
+			name:  string(target.Name) + " door sensor",
+			input: input,
+		},
+		bus:   bus,
+		clock: RealClock{},
+	}
+}
+
+// Remember that the door has been requested to open, so that opening it
+// is not considered forced. Can be called from any goroutine.
+func (s *DoorSensor) NoteOpenRequest() {
+	s.lock.Lock()
+	s.lastOpenRequest = s.clock.Now()
+	s.lock.Unlock()
+}
+
+func (s *DoorSensor) openWasRequested(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.lastOpenRequest.IsZero() &&
+		now.Sub(s.lastOpenRequest) < s.target.OpenDuration+doorOpenRequestGrace
+}
+
+// Poll the sensor forever. Call in its own goroutine.
+func (s *DoorSensor) Run() {
+	for {
+		s.Poll()
+		time.Sleep(gpioInputPollInterval)
+	}
+}
+
+// Read the input once and post events if something changed.
+func (s *DoorSensor) Poll() {
+	now := s.clock.Now()
+	if changed, open := s.input.Update(now); changed {
+		s.changeState(open, now)
+	}
+
+	if s.input.active && !s.heldOpenAlarm &&
+		s.target.Sensor.HeldOpenAlarm > 0 &&
+		now.Sub(s.openSince) >= s.target.Sensor.HeldOpenAlarm {
+		s.heldOpenAlarm = true
+		s.post(AppDoorHeldOpenAlarm, 1,
+			fmt.Sprintf("Door held open for %s", now.Sub(s.openSince).Round(time.Second)))
+	}
+}
+
+func (s *DoorSensor) changeState(open bool, now time.Time) {
+	wasKnown := s.stateKnown
+	s.stateKnown = true
+	if !open {
+		s.post(AppDoorSensorEvent, 0, "closed")
+		return
+	}
+	s.openSince = now
+	s.heldOpenAlarm = false
+	s.post(AppDoorSensorEvent, 1, "open")
+	// Don't know how it got open if we just started.
+	if wasKnown && s.target.Sensor.ForcedOpenAlarm && !s.openWasRequested(now) {
+		s.post(AppDoorForcedOpenAlarm, 1, "Door opened without request")
+	}
+}
+
+func (s *DoorSensor) post(ev AppEventType, value int, msg string) {
+	if ev != AppDoorSensorEvent {
+		log.Printf("%s: %s", s.target.Name, msg)
+	}
+	s.bus.Post(&AppEvent{
+		Ev:     ev,
+		Target: s.target.Name,
+		Source: "door-sensor",
+		Msg:    msg,
+		Value:  value,
+	})
+}
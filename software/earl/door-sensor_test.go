@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type DoorSensorFixture struct {
+	t      *testing.T
+	gpio   *FakeGPIO
+	clock  *MockClock
+	bus    *ApplicationBus
+	events AppEventChannel
+	sensor *DoorSensor
+}
+
+func NewDoorSensorFixture(t *testing.T, activeLow bool, forcedOpenAlarm bool) *DoorSensorFixture {
+	f := &DoorSensorFixture{
+		t:      t,
+		gpio:   NewFakeGPIO(),
+		clock:  &MockClock{},
+		bus:    NewApplicationBus(),
+		events: make(AppEventChannel, 10),
+	}
+	f.bus.Subscribe(f.events)
+	target := &TargetConfig{
+		Name:         TargetDownstairs,
+		OpenDuration: 2 * time.Second,
+		Sensor: &DoorSensorConfig{
+			Pin:             22,
+			ActiveLow:       activeLow,
+			HeldOpenAlarm:   time.Minute,
+			ForcedOpenAlarm: forcedOpenAlarm,
+		},
+	}
+	input, _ := f.gpio.Input(22, activeLow)
+	f.sensor = NewDoorSensor(target, input, f.bus)
+	f.sensor.clock = f.clock
+	return f
+}
+
+// Keep the input at the given level for the given time, polling regularly.
+func (f *DoorSensorFixture) Hold(level bool, duration time.Duration) {
+	f.gpio.SetLevel(22, level)
+	for end := f.clock.now.Add(duration); !f.clock.now.After(end); {
+		f.sensor.Poll()
+		f.clock.now = f.clock.now.Add(gpioInputPollInterval)
+	}
+	f.bus.Flush()
+}
+
+func (f *DoorSensorFixture) ExpectEvent(ev AppEventType, value int) {
+	select {
+	case event := <-f.events:
+		if event.Ev != ev || event.Value != value {
+			f.t.Errorf("Expected %s=%d, got %s=%d",
+				ev, value, event.Ev, event.Value)
+		}
+	default:
+		f.t.Errorf("Expected %s=%d, got nothing", ev, value)
+	}
+}
+
+func (f *DoorSensorFixture) ExpectNoMoreEvents() {
+	select {
+	case event := <-f.events:
+		f.t.Errorf("Unexpected event %s=%d (%s)", event.Ev, event.Value, event.Msg)
+	default:
+	}
+}
+
+func TestDoorSensorDebounce(t *testing.T) {
+	f := NewDoorSensorFixture(t, false, false)
+	f.Hold(false, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 0) // Initial state.
+	f.ExpectNoMoreEvents()
+
+	// Short bounce is ignored
+	f.Hold(true, gpioInputDebounce/2)
+	f.Hold(false, time.Second)
+	f.ExpectNoMoreEvents()
+
+	f.Hold(true, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+	f.ExpectNoMoreEvents()
+
+	f.Hold(false, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 0)
+	f.ExpectNoMoreEvents()
+}
+
+func TestDoorSensorActiveLow(t *testing.T) {
+	f := NewDoorSensorFixture(t, true, false)
+	f.Hold(true, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 0)
+	f.Hold(false, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+}
+
+func TestDoorSensorHeldOpenAlarm(t *testing.T) {
+	f := NewDoorSensorFixture(t, false, false)
+	f.Hold(true, 30*time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+	f.ExpectNoMoreEvents()
+
+	f.Hold(true, 2*time.Minute)
+	f.ExpectEvent(AppDoorHeldOpenAlarm, 1)
+	f.ExpectNoMoreEvents() // Only once.
+
+	// Next time it is held open, we alarm again.
+	f.Hold(false, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 0)
+	f.Hold(true, 2*time.Minute)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+	f.ExpectEvent(AppDoorHeldOpenAlarm, 1)
+	f.ExpectNoMoreEvents()
+}
+
+func TestDoorSensorForcedOpenAlarm(t *testing.T) {
+	f := NewDoorSensorFixture(t, false, true)
+
+	// We don't know how the door got open before we started.
+	f.Hold(true, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+	f.ExpectNoMoreEvents()
+
+	f.Hold(false, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 0)
+
+	// Buzzed open: all good.
+	f.sensor.NoteOpenRequest()
+	f.Hold(true, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+	f.ExpectNoMoreEvents()
+	f.Hold(false, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 0)
+
+	// Long after the open request, the door is opened again.
+	f.Hold(false, time.Minute)
+	f.Hold(true, time.Second)
+	f.ExpectEvent(AppDoorSensorEvent, 1)
+	f.ExpectEvent(AppDoorForcedOpenAlarm, 1)
+	f.ExpectNoMoreEvents()
+}
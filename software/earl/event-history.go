@@ -0,0 +1,75 @@
+// Bounded history of the events posted to the ApplicationBus, so that
+// clients connecting late (or reconnecting) can catch up on what happened.
+//
+// Events are numbered by the bus with an increasing sequence number; a
+// client that remembers the last number it has seen can resume from there
+// without gaps, as long as the events are still in the history.
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultEventHistorySize = 1000
+
+type EventHistory struct {
+	lock   sync.Mutex
+	size   int
+	events []*AppEvent // Ordered by Seq, oldest first.
+	latest map[AppEventType]*AppEvent
+}
+
+func NewEventHistory(size int) *EventHistory {
+	return &EventHistory{
+		size:   size,
+		latest: make(map[AppEventType]*AppEvent),
+	}
+}
+
+func (h *EventHistory) Add(event *AppEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.events = append(h.events, event)
+	if len(h.events) > h.size {
+		h.events = h.events[len(h.events)-h.size:]
+	}
+	h.latest[event.Ev] = event
+}
+
+// Events after the one with the given sequence number. If that is too old,
+// this starts with the oldest we have.
+func (h *EventHistory) Since(seq uint64) []*AppEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	first := sort.Search(len(h.events), func(i int) bool {
+		return h.events[i].Seq > seq
+	})
+	return append([]*AppEvent{}, h.events[first:]...)
+}
+
+// Events posted at or after the given time.
+func (h *EventHistory) SinceTime(since time.Time) []*AppEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	first := sort.Search(len(h.events), func(i int) bool {
+		return !h.events[i].Timestamp.Before(since)
+	})
+	return append([]*AppEvent{}, h.events[first:]...)
+}
+
+// The last event of each type, even if it is long gone from the rest of
+// the history. Oldest first.
+func (h *EventHistory) Latest() []*AppEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	result := []*AppEvent{}
+	for _, event := range h.latest {
+		result = append(result, event)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Seq < result[j].Seq
+	})
+	return result
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHistory(t *testing.T) {
+	history := NewEventHistory(3)
+	start := time.Date(2026, 10, 1, 20, 0, 0, 0, time.UTC)
+	for seq := uint64(1); seq <= 5; seq++ {
+		ev := AppDoorbellTriggerEvent
+		if seq == 1 {
+			ev = AppEarlStarted
+		}
+		history.Add(&AppEvent{
+			Seq:       seq,
+			Ev:        ev,
+			Timestamp: start.Add(time.Duration(seq) * time.Minute),
+		})
+	}
+
+	since := history.Since(3)
+	ExpectTrue(t, len(since) == 2 && since[0].Seq == 4 && since[1].Seq == 5,
+		"Since sequence number")
+	since = history.Since(0)
+	ExpectTrue(t, len(since) == 3 && since[0].Seq == 3, "Oldest are gone")
+	ExpectTrue(t, len(history.Since(5)) == 0, "Nothing new")
+
+	since = history.SinceTime(start.Add(4 * time.Minute))
+	ExpectTrue(t, len(since) == 2 && since[0].Seq == 4, "Since time")
+
+	latest := history.Latest()
+	ExpectTrue(t, len(latest) == 2, "One per type")
+	ExpectTrue(t, latest[0].Ev == AppEarlStarted && latest[0].Seq == 1,
+		"Kept, even if gone from history")
+	ExpectTrue(t, latest[1].Seq == 5, "Latest doorbell")
+}
+
+func TestBusReplay(t *testing.T) {
+	bus := NewApplicationBus()
+	for i := 0; i < 5; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Value: i})
+	}
+	bus.Flush()
+
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events, ReplaySince(3))
+	bus.Post(&AppEvent{Ev: AppOpenRequest})
+	bus.Flush()
+
+	ExpectTrue(t, len(events) == 3, "Replay, then new event")
+	for seq := uint64(4); seq <= 6; seq++ {
+		event := <-events
+		ExpectTrue(t, event.Seq == seq, "No gaps")
+		ExpectTrue(t, event.Replayed == (seq < 6), "Replayed flag")
+	}
+}
+
+func TestBusReplayDoesNotGrowQueue(t *testing.T) {
+	bus := NewApplicationBus()
+	for i := 0; i < 5; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+	}
+	bus.Flush()
+
+	slow := make(AppEventChannel)
+	bus.Subscribe(slow, QueueSize(2), ReplaySince(0))
+	for seq := uint64(1); seq <= 5; seq++ {
+		event := receiveEvent(slow)
+		ExpectTrue(t, event != nil && event.Seq == seq, "Full replay")
+	}
+
+	// Once the replay is through, the queue is back to its size.
+	for i := 0; i < 10; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+	}
+	fast := make(AppEventChannel, 1)
+	bus.Subscribe(fast)
+	bus.Post(&AppEvent{Ev: AppOpenRequest})
+	receiveEvent(fast)
+	received := 0
+	for event := receiveEvent(slow); event != nil && event.Ev != AppOpenRequest; event = receiveEvent(slow) {
+		received++
+	}
+	ExpectTrue(t, received <= 3, fmt.Sprintf("Queue limited, got %d", received))
+}
+
+// Read the next event from the stream.
+func readJsonEvent(t *testing.T, reader *bufio.Reader) *JsonAppEvent {
+	t.Helper()
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("Reading event: %v", err)
+	}
+	event := &JsonAppEvent{}
+	if err := json.Unmarshal(line, event); err != nil {
+		t.Fatalf("Parsing '%s': %v", line, err)
+	}
+	return event
+}
+
+func TestEventApiResumes(t *testing.T) {
+	bus := NewApplicationBus()
+	mux := http.NewServeMux()
+	NewApiServer(&Backends{appEventBus: bus}, mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	bus.Post(&AppEvent{Ev: AppEarlStarted})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetUpstairs})
+
+	// New clients see the last event of each type.
+	response, err := http.Get(server.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(response.Body)
+	event := readJsonEvent(t, reader)
+	ExpectTrue(t, event.Ev == AppEarlStarted && event.IsHistoricEvent, "Latest start")
+	event = readJsonEvent(t, reader)
+	ExpectTrue(t, event.Target == TargetUpstairs && event.Seq == 3, "Latest bell")
+	response.Body.Close()
+
+	// Meanwhile...
+	bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetDownstairs})
+
+	// ... a client resuming gets all it missed, then new events.
+	response, err = http.Get(server.URL + "/api/events?since_seq=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader = bufio.NewReader(response.Body)
+	for seq := uint64(2); seq <= 4; seq++ {
+		event = readJsonEvent(t, reader)
+		ExpectTrue(t, event.Seq == seq && event.IsHistoricEvent, "Replayed")
+	}
+	bus.Post(&AppEvent{Ev: AppHushBellRequest})
+	event = readJsonEvent(t, reader)
+	ExpectTrue(t, event.Seq == 5 && !event.IsHistoricEvent, "New event")
+
+	response, err = http.Get(server.URL + "/api/events?since_seq=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	ExpectTrue(t, response.StatusCode == http.StatusBadRequest, "Bad since_seq")
+}
+
+func TestTcpEventsResume(t *testing.T) {
+	bus := NewApplicationBus()
+	server := NewTcpServer(&Backends{appEventBus: bus}, 0)
+	bus.Post(&AppEvent{Ev: AppEarlStarted})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleTcpConnection(conn)
+	reader := bufio.NewReader(client)
+	ExpectTrue(t, readJsonEvent(t, reader).Seq == 1, "Latest start")
+	ExpectTrue(t, readJsonEvent(t, reader).Seq == 3, "Latest bell")
+
+	client.Write([]byte("since_seq 1\n"))
+	ExpectTrue(t, readJsonEvent(t, reader).Seq == 2, "Replay from 2")
+	ExpectTrue(t, readJsonEvent(t, reader).Seq == 3, "Replay 3")
+
+	client.Write([]byte("since_seq foo\n"))
+	line, _ := reader.ReadString('\n')
+	ExpectTrue(t, strings.Contains(line, `"error":"since_seq:`), "Error reply")
+}
@@ -0,0 +1,396 @@
+// Transports for the stream of events. Clients can get them as
+//
+//   - one JSON object per line, over HTTP (/api/events) or TCP,
+//   - Server-Sent Events (/api/events with Accept: text/event-stream),
+//   - JSONP long polling (/api/events?callback=...),
+//   - WebSocket messages (/api/events/ws).
+//
+// All of them use the same JSON for an event (see encodeEvent()) and the
+// same way to ask for a replay of past events (see replayFromRequest()).
+// Over TCP and WebSocket, clients can also send commands; see
+// streamSession.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// Comment lines sent on an idle Server-Sent Events stream, so that
+	// proxies don't close it and clients notice if we are gone.
+	sseKeepAliveInterval = 15 * time.Second
+
+	// How long browsers wait before reconnecting a Server-Sent Events
+	// stream.
+	sseRetryInterval = 3 * time.Second
+
+	// A JSONP request with nothing to replay waits this long for an event.
+	jsonpPollTimeout = 30 * time.Second
+
+	webSocketPingInterval = 30 * time.Second
+)
+
+const webSocketWriteTimeout = 10 * time.Second
+
+// Browsers let scripts of any web page open WebSockets, and they'd get
+// to send commands once authenticated. So only pages from here or from the
+// configured websocket_origins may use them. Other programs don't send an
+// Origin header.
+func newWebSocketUpgrader(origins []string) *websocket.Upgrader {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[strings.ToLower(origin)] = true
+	}
+	return &websocket.Upgrader{
+		CheckOrigin: func(req *http.Request) bool {
+			origin := req.Header.Get("Origin")
+			if origin == "" || allowed[strings.ToLower(origin)] {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, req.Host)
+		},
+	}
+}
+
+// The JSON for an event, as sent by all transports.
+func encodeEvent(event *AppEvent) ([]byte, error) {
+	return json.Marshal(JsonEventFromAppEvent(event))
+}
+
+// The JSON replies to commands.
+func encodeStreamError(err error) []byte {
+	json, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return json
+}
+
+func encodeStreamOk(msg string) []byte {
+	json, _ := json.Marshal(map[string]string{"ok": msg})
+	return json
+}
+
+// Write the event as a line of JSON, optionally wrapped in a JSONP callback.
+// Returns false if the client is gone.
+func writeJSONEvent(out io.Writer, event *AppEvent, jsonp_callback string) bool {
+	json, err := encodeEvent(event)
+	if err != nil {
+		// Funny event, let's just ignore.
+		return true
+	}
+	return writeJSONLine(out, json, jsonp_callback)
+}
+
+func writeJSONLine(out io.Writer, json []byte, jsonp_callback string) bool {
+	if jsonp_callback != "" {
+		json = []byte(fmt.Sprintf("%s(%s);", jsonp_callback, json))
+	}
+	if _, err := out.Write(append(json, '\n')); err != nil {
+		return false
+	}
+	if w, ok := out.(http.ResponseWriter); ok {
+		flushResponse(w)
+	}
+	return true
+}
+
+// The replay a client asks for with the (optional)
+//
+//	Last-Event-ID : header sent by browsers reconnecting a Server-Sent
+//	                Events stream; like since_seq.
+//	since_seq     : events after the one with this sequence number; for
+//	                clients resuming where they left off.
+//	since         : events since this time; RFC3339 or unix time.
+//
+// Without any of these, the client starts with the last event of each type.
+func replayFromRequest(req *http.Request) (SubscribeOption, error) {
+	if value := req.Header.Get("Last-Event-ID"); value != "" {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Last-Event-ID: %v", err)
+		}
+		return ReplaySince(seq), nil
+	}
+	req.ParseForm()
+	if value := req.Form.Get("since_seq"); value != "" {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("since_seq: %v", err)
+		}
+		return ReplaySince(seq), nil
+	}
+	if value := req.Form.Get("since"); value != "" {
+		since, err := parseTimeParam(value)
+		if err != nil {
+			return nil, fmt.Errorf("since: %v", err)
+		}
+		return ReplaySinceTime(since), nil
+	}
+	return ReplayLatest(), nil
+}
+
+// A TCP or WebSocket connection, over which clients can send commands; one
+// per line or message. Asking for a replay of past events, after which the
+// stream continues:
+//
+//	since_seq <seq>   : events after the one with this sequence number
+//	since <time>      : events since this time; RFC3339 or unix time.
+//
+// Posting events, for API clients (see remote-commands.go):
+//
+//	auth <token>                   : authenticate for the commands below
+//	open <target>
+//	trigger-bell <target>
+//	hush-bell <target> [duration]  : e.g. 5m
+type streamSession struct {
+	commands *RemoteCommands  // nil: no API clients configured.
+	client   *ApiClientConfig // Once authenticated.
+}
+
+// Handle the command. Returns the replay the stream continues with if one is
+// asked for; otherwise the reply for the client, a JSON object with either an
+// "ok" or an "error" field.
+func (s *streamSession) handle(line string) (SubscribeOption, []byte) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, encodeStreamError(errors.New("empty command"))
+	}
+	switch command := fields[0]; {
+	case command == "since_seq" || command == "since":
+		replay, err := parseReplayCommand(fields)
+		if err != nil {
+			return nil, encodeStreamError(err)
+		}
+		return replay, nil
+	case command == "auth":
+		if s.commands == nil {
+			return nil, encodeStreamError(errNotPermitted)
+		}
+		if len(fields) != 2 {
+			return nil, encodeStreamError(errors.New("usage: auth <token>"))
+		}
+		if s.client = s.commands.Authenticate(fields[1]); s.client == nil {
+			return nil, encodeStreamError(errBadToken)
+		}
+		return nil, encodeStreamOk("authenticated as " + s.client.Name)
+	case isRemoteCommand(AppEventType(command)):
+		if s.client == nil {
+			return nil, encodeStreamError(errors.New("Authorization required."))
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, encodeStreamError(fmt.Errorf("usage: %s <target>", command))
+		}
+		var hush time.Duration
+		if len(fields) == 3 {
+			var err error
+			if hush, err = time.ParseDuration(fields[2]); err != nil {
+				return nil, encodeStreamError(fmt.Errorf("duration: %v", err))
+			}
+		}
+		err := s.commands.Execute(s.client, AppEventType(command), Target(fields[1]), hush)
+		if err != nil {
+			return nil, encodeStreamError(err)
+		}
+		return nil, encodeStreamOk(command + " " + fields[1])
+	}
+	return nil, encodeStreamError(fmt.Errorf("unknown command '%s'", fields[0]))
+}
+
+func parseReplayCommand(fields []string) (SubscribeOption, error) {
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("usage: %s <%s>", fields[0],
+			strings.TrimPrefix(fields[0], "since_"))
+	}
+	if fields[0] == "since_seq" {
+		seq, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("since_seq: %v", err)
+		}
+		return ReplaySince(seq), nil
+	}
+	since, err := parseTimeParam(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("since: %v", err)
+	}
+	return ReplaySinceTime(since), nil
+}
+
+// Clients that can't keep up are disconnected, so that they know they
+// missed events; they can come back with since_seq.
+func subscribeStream(bus *ApplicationBus, name string, replay ...SubscribeOption) AppEventChannel {
+	appEvents := make(AppEventChannel, 3)
+	options := append([]SubscribeOption{SubscriberName(name),
+		WithDropPolicy(DisconnectSlow)}, replay...)
+	bus.Subscribe(appEvents, options...)
+	return appEvents
+}
+
+// Streams only end when the client goes away, so they are exempt from the
+// server's write timeout.
+func disableWriteTimeout(out http.ResponseWriter) {
+	http.NewResponseController(out).SetWriteDeadline(time.Time{})
+}
+
+// Server-Sent Events: each event with its sequence number as id, so that
+// browsers resume where they left off when reconnecting.
+func (a *ApiServer) serveEventSource(out http.ResponseWriter, req *http.Request, replay SubscribeOption) {
+	out.Header()["Content-Type"] = []string{"text/event-stream"}
+	out.Header()["Cache-Control"] = []string{"no-cache"}
+	allowOrigin(out, req)
+	disableWriteTimeout(out)
+
+	fmt.Fprintf(out, "retry: %d\n\n", sseRetryInterval.Milliseconds())
+	flushResponse(out)
+
+	appEvents := subscribeStream(a.bus, "sse-events", replay)
+	defer a.bus.Unsubscribe(appEvents)
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case event, ok := <-appEvents:
+			if !ok {
+				return // Disconnected by the bus.
+			}
+			json, jsonErr := encodeEvent(event)
+			if jsonErr != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(out, "id: %d\ndata: %s\n\n", event.Seq, json)
+		case <-keepAlive.C:
+			_, err = io.WriteString(out, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return // Client went away.
+		}
+		if err != nil {
+			return
+		}
+		flushResponse(out)
+	}
+}
+
+// A JSONP script only runs once it has been loaded completely, so instead of
+// a never ending stream, we answer with the events to replay. If there are
+// none, we wait for the next one (long polling). Clients come back with the
+// seq of the last event they got as since_seq.
+func (a *ApiServer) serveJSONP(out http.ResponseWriter, req *http.Request, replay SubscribeOption, cb string) {
+	disableWriteTimeout(out)
+
+	// Sent by the bus when subscribing, so we learn how many events
+	// belong to the replay without missing anything posted meanwhile.
+	replayCount := make(chan int, 1)
+	appEvents := subscribeStream(a.bus, "jsonp-events", replay, CountReplay(replayCount))
+	defer a.bus.Unsubscribe(appEvents)
+
+	count := <-replayCount
+	if count == 0 {
+		count = 1
+	}
+	timeout := time.NewTimer(jsonpPollTimeout)
+	defer timeout.Stop()
+	for ; count > 0; count-- {
+		select {
+		case event, ok := <-appEvents:
+			if !ok || !writeJSONEvent(out, event, cb) {
+				return
+			}
+		case <-timeout.C:
+			return // Nothing happened; client polls again.
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Events as WebSocket text messages, one event each. Takes the same
+// parameters for the replay as /api/events; later, clients can send the
+// commands of streamSession as text messages, and get the replies as such.
+func (a *ApiServer) ServeWebSocket(out http.ResponseWriter, req *http.Request) {
+	replay, err := replayFromRequest(req)
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := a.webSocketUpgrader.Upgrade(out, req, nil)
+	if err != nil {
+		return // Upgrade() already replied.
+	}
+	defer conn.Close()
+	// The connection is hijacked; the server's timeouts don't apply anymore.
+	conn.SetWriteDeadline(time.Time{})
+
+	commands := make(chan string)
+	readerDone := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go readWebSocketCommands(conn, commands, readerDone, done)
+
+	session := &streamSession{commands: a.commands}
+	appEvents := subscribeStream(a.bus, "websocket-events", replay)
+	defer func() { a.bus.Unsubscribe(appEvents) }()
+	ping := time.NewTicker(webSocketPingInterval)
+	defer ping.Stop()
+	for {
+		var message []byte
+		select {
+		case event, ok := <-appEvents:
+			if !ok {
+				return // Disconnected by the bus.
+			}
+			if message, err = encodeEvent(event); err != nil {
+				continue
+			}
+		case command := <-commands:
+			var replay SubscribeOption
+			if replay, message = session.handle(command); replay == nil {
+				break
+			}
+			// Events still in the old channel are part of the replay.
+			a.bus.Unsubscribe(appEvents)
+			appEvents = subscribeStream(a.bus, "websocket-events", replay)
+			continue
+		case <-ping.C:
+			deadline := time.Now().Add(webSocketWriteTimeout)
+			if conn.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+				return
+			}
+			continue
+		case <-readerDone:
+			return // Client closed the connection.
+		}
+		conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+		if conn.WriteMessage(websocket.TextMessage, message) != nil {
+			return
+		}
+	}
+}
+
+// Pass text messages from the client on as commands until the connection is
+// closed. This also handles the control messages, e.g. the pongs to our pings.
+func readWebSocketCommands(conn *websocket.Conn, commands chan<- string, readerDone chan<- struct{}, done <-chan struct{}) {
+	defer close(readerDone)
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		select {
+		case commands <- string(message):
+		case <-done:
+			return
+		}
+	}
+}
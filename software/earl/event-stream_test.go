@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func NewEventStreamServer(t *testing.T) (*ApplicationBus, *httptest.Server) {
+	bus := NewApplicationBus()
+	mux := http.NewServeMux()
+	NewApiServer(&Backends{appEventBus: bus}, mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return bus, server
+}
+
+// Read the lines of the next Server-Sent Event or comment.
+func readSSE(t *testing.T, reader *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func getEventSource(t *testing.T, url string, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	ExpectTrue(t, response.Header.Get("Content-Type") == "text/event-stream",
+		"Content-Type")
+	return bufio.NewReader(response.Body)
+}
+
+func TestServerSentEvents(t *testing.T) {
+	defer func(interval time.Duration) { sseKeepAliveInterval = interval }(sseKeepAliveInterval)
+	sseKeepAliveInterval = 100 * time.Millisecond
+
+	bus, server := NewEventStreamServer(t)
+	bus.Post(&AppEvent{Ev: AppEarlStarted})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetUpstairs})
+
+	reader := getEventSource(t, server.URL+"/api/events", "")
+	ExpectTrue(t, readSSE(t, reader)[0] == "retry: 3000", "Retry interval")
+	lines := readSSE(t, reader)
+	ExpectTrue(t, len(lines) == 2 && lines[0] == "id: 1", "Event id")
+	event := &JsonAppEvent{}
+	err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), event)
+	ExpectTrue(t, err == nil && event.Ev == AppEarlStarted && event.Seq == 1,
+		"Same JSON as the other transports")
+	ExpectTrue(t, readSSE(t, reader)[0] == "id: 3", "Latest bell")
+
+	// Nothing happening: keep-alive comments.
+	ExpectTrue(t, readSSE(t, reader)[0] == ": keep-alive", "Keep-alive")
+
+	// Browsers reconnecting say where they left off.
+	reader = getEventSource(t, server.URL+"/api/events", "1")
+	readSSE(t, reader) // retry
+	ExpectTrue(t, readSSE(t, reader)[0] == "id: 2", "Resumed")
+	ExpectTrue(t, readSSE(t, reader)[0] == "id: 3", "Resumed 3")
+	bus.Post(&AppEvent{Ev: AppHushBellRequest})
+	ExpectTrue(t, readSSE(t, reader)[0] == "id: 4", "New event")
+}
+
+func TestJSONPTerminates(t *testing.T) {
+	bus, server := NewEventStreamServer(t)
+	bus.Post(&AppEvent{Ev: AppEarlStarted})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+
+	response, err := http.Get(server.URL + "/api/events?callback=cb&since_seq=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readAll(t, response)
+	ExpectTrue(t, strings.Count(body, "cb(") == 2, "Replay")
+	ExpectTrue(t, strings.Contains(body, `"seq":2`), "Up to latest")
+
+	// Nothing new yet: wait for the next event.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		bus.Post(&AppEvent{Ev: AppHushBellRequest})
+	}()
+	response, err = http.Get(server.URL + "/api/events?callback=cb&since_seq=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readAll(t, response)
+	ExpectTrue(t, strings.Count(body, "cb(") == 1 && strings.Contains(body, `"seq":3`),
+		"Long poll")
+}
+
+func readAll(t *testing.T, response *http.Response) string {
+	t.Helper()
+	defer response.Body.Close()
+	var body strings.Builder
+	if _, err := bufio.NewReader(response.Body).WriteTo(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.String()
+}
+
+func readWebSocketEvent(t *testing.T, conn *websocket.Conn) *JsonAppEvent {
+	t.Helper()
+	event := &JsonAppEvent{}
+	if err := conn.ReadJSON(event); err != nil {
+		t.Fatalf("Reading event: %v", err)
+	}
+	return event
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	bus, server := NewEventStreamServer(t)
+	bus.Post(&AppEvent{Ev: AppEarlStarted})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent})
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/events/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ExpectTrue(t, readWebSocketEvent(t, conn).Seq == 1, "Latest start")
+	ExpectTrue(t, readWebSocketEvent(t, conn).Seq == 3, "Latest bell")
+	bus.Post(&AppEvent{Ev: AppHushBellRequest})
+	event := readWebSocketEvent(t, conn)
+	ExpectTrue(t, event.Seq == 4 && event.Ev == AppHushBellRequest, "New event")
+
+	conn.WriteMessage(websocket.TextMessage, []byte("since_seq 1"))
+	for seq := uint64(2); seq <= 4; seq++ {
+		event = readWebSocketEvent(t, conn)
+		ExpectTrue(t, event.Seq == seq && event.IsHistoricEvent, "Replayed")
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("frobnicate now"))
+	var reply map[string]string
+	conn.ReadJSON(&reply)
+	ExpectTrue(t, reply["error"] == "unknown command 'frobnicate'", "Error reply")
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	bus := NewApplicationBus()
+	config := DefaultConfig()
+	config.WebSocketOrigins = []string{"https://noisebridge.net"}
+	mux := http.NewServeMux()
+	NewApiServer(&Backends{appEventBus: bus, config: config}, mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/events/ws"
+	dial := func(origin string) error {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	ExpectTrue(t, dial("") == nil, "No origin: not a browser")
+	ExpectTrue(t, dial(server.URL) == nil, "Same origin")
+	ExpectTrue(t, dial("https://noisebridge.net") == nil, "Configured origin")
+	ExpectTrue(t, dial("https://evil.example") != nil, "Other origin refused")
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+func NewChardevGPIO(device string) (GPIO, error) {
+	return nil, fmt.Errorf("GPIO character device only available on Linux")
+}
@@ -0,0 +1,134 @@
+//go:build linux
+
+// GPIO through the /dev/gpiochipN character device, using the v2 of the
+// kernel uAPI (Linux 5.10+). See <linux/gpio.h> for the structs below.
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	gpioV2LinesMax          = 64
+	gpioV2LineAttrsMax      = 10
+	gpioMaxNameSize         = 32
+	gpioV2LineFlagActiveLow = 1 << 1
+	gpioV2LineFlagInput     = 1 << 2
+	gpioV2LineFlagOutput    = 1 << 3
+
+	gpioConsumerName = "earl"
+)
+
+type gpioV2LineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64 // flags, values or debounce_period_us
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [gpioV2LineAttrsMax]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [gpioV2LinesMax]uint32
+	Consumer        [gpioMaxNameSize]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+// _IOWR(0xB4, nr, type)
+func gpioIOWR(nr uintptr, size uintptr) uintptr {
+	return (3 << 30) | (size << 16) | (0xB4 << 8) | nr
+}
+
+var (
+	gpioV2GetLineIoctl = gpioIOWR(0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioV2GetValues    = gpioIOWR(0x0E, unsafe.Sizeof(gpioV2LineValues{}))
+	gpioV2SetValues    = gpioIOWR(0x0F, unsafe.Sizeof(gpioV2LineValues{}))
+)
+
+type chardevGPIO struct {
+	chip *os.File
+}
+
+// A single requested line. The kernel releases it when the file is closed.
+type chardevLine struct {
+	file *os.File
+}
+
+func NewChardevGPIO(device string) (GPIO, error) {
+	chip, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &chardevGPIO{chip: chip}, nil
+}
+
+func (g *chardevGPIO) Output(pin int, activeLow bool) (DigitalOutput, error) {
+	// Output lines start out inactive.
+	return g.requestLine(pin, activeLow, gpioV2LineFlagOutput)
+}
+
+func (g *chardevGPIO) Input(pin int, activeLow bool) (DigitalInput, error) {
+	return g.requestLine(pin, activeLow, gpioV2LineFlagInput)
+}
+
+func (g *chardevGPIO) requestLine(pin int, activeLow bool, flags uint64) (*chardevLine, error) {
+	if pin < 0 || pin > 0xffff {
+		return nil, fmt.Errorf("invalid GPIO line %d", pin)
+	}
+	if activeLow {
+		flags |= gpioV2LineFlagActiveLow
+	}
+	request := gpioV2LineRequest{NumLines: 1}
+	request.Offsets[0] = uint32(pin)
+	copy(request.Consumer[:], gpioConsumerName)
+	request.Config.Flags = flags
+	if err := gpioIoctl(g.chip.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&request)); err != nil {
+		return nil, fmt.Errorf("%s: requesting line %d: %v", g.chip.Name(), pin, err)
+	}
+	name := fmt.Sprintf("%s:%d", g.chip.Name(), pin)
+	return &chardevLine{file: os.NewFile(uintptr(request.Fd), name)}, nil
+}
+
+func (l *chardevLine) Set(active bool) error {
+	values := gpioV2LineValues{Mask: 1}
+	if active {
+		values.Bits = 1
+	}
+	return gpioIoctl(l.file.Fd(), gpioV2SetValues, unsafe.Pointer(&values))
+}
+
+func (l *chardevLine) Read() (bool, error) {
+	values := gpioV2LineValues{Mask: 1}
+	err := gpioIoctl(l.file.Fd(), gpioV2GetValues, unsafe.Pointer(&values))
+	return values.Bits&1 != 0, err
+}
+
+func gpioIoctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
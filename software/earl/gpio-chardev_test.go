@@ -0,0 +1,20 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// The structs are passed to the kernel as-is, so need to have the exact
+// size of their C counterparts.
+func TestGPIOChardevStructSizes(t *testing.T) {
+	ExpectTrue(t, unsafe.Sizeof(gpioV2LineAttribute{}) == 16, "line attribute")
+	ExpectTrue(t, unsafe.Sizeof(gpioV2LineConfigAttribute{}) == 24, "config attribute")
+	ExpectTrue(t, unsafe.Sizeof(gpioV2LineConfig{}) == 272, "line config")
+	ExpectTrue(t, unsafe.Sizeof(gpioV2LineRequest{}) == 592, "line request")
+	ExpectTrue(t, unsafe.Sizeof(gpioV2LineValues{}) == 16, "line values")
+	ExpectTrue(t, gpioV2GetLineIoctl == 0xc250b407, "GPIO_V2_GET_LINE_IOCTL")
+	ExpectTrue(t, gpioV2SetValues == 0xc010b40f, "GPIO_V2_LINE_SET_VALUES_IOCTL")
+}
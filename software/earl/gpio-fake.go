@@ -0,0 +1,77 @@
+// In-memory GPIO, for tests and for running earl without hardware
+// (-gpio=fake). Keeps the electrical level of each pin.
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+type FakeGPIO struct {
+	lock      sync.Mutex
+	levels    map[int]bool // High or low.
+	activeLow map[int]bool
+}
+
+type fakeLine struct {
+	gpio *FakeGPIO
+	pin  int
+}
+
+func NewFakeGPIO() *FakeGPIO {
+	return &FakeGPIO{
+		levels:    make(map[int]bool),
+		activeLow: make(map[int]bool),
+	}
+}
+
+func (g *FakeGPIO) Output(pin int, activeLow bool) (DigitalOutput, error) {
+	g.lock.Lock()
+	g.activeLow[pin] = activeLow
+	g.lock.Unlock()
+	line := &fakeLine{gpio: g, pin: pin}
+	return line, line.Set(false)
+}
+
+func (g *FakeGPIO) Input(pin int, activeLow bool) (DigitalInput, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.activeLow[pin] = activeLow
+	if _, exists := g.levels[pin]; !exists {
+		g.levels[pin] = activeLow // Inactive, until told otherwise.
+	}
+	return &fakeLine{gpio: g, pin: pin}, nil
+}
+
+// Electrical level of the pin.
+func (g *FakeGPIO) Level(pin int) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.levels[pin]
+}
+
+// Set the electrical level of an input pin, as if a contact closed or opened.
+func (g *FakeGPIO) SetLevel(pin int, level bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.levels[pin] = level
+}
+
+func (l *fakeLine) Set(active bool) error {
+	g := l.gpio
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	level := active != g.activeLow[l.pin]
+	if g.levels[l.pin] != level {
+		log.Printf("Fake GPIO %d: active=%t", l.pin, active)
+	}
+	g.levels[l.pin] = level
+	return nil
+}
+
+func (l *fakeLine) Read() (bool, error) {
+	g := l.gpio
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.levels[l.pin] != g.activeLow[l.pin], nil
+}
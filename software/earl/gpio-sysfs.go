@@ -0,0 +1,85 @@
+// GPIO through the /sys/class/gpio interface. Deprecated and gone in newer
+// kernels; kept for the old installations.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+type sysfsGPIO struct {
+	base string
+}
+
+type sysfsLine struct {
+	valueFile string
+}
+
+func NewSysfsGPIO() GPIO {
+	return &sysfsGPIO{base: "/sys/class/gpio"}
+}
+
+func (g *sysfsGPIO) Output(pin int, activeLow bool) (DigitalOutput, error) {
+	line, err := g.export(pin, activeLow, "out")
+	if err != nil {
+		return nil, err
+	}
+	return line, line.Set(false) // initial state.
+}
+
+func (g *sysfsGPIO) Input(pin int, activeLow bool) (DigitalInput, error) {
+	return g.export(pin, activeLow, "in")
+}
+
+func (g *sysfsGPIO) export(pin int, activeLow bool, direction string) (*sysfsLine, error) {
+	// Create gpio pin if it doesn't exist. Fails if already exported,
+	// which is fine.
+	pinDir := fmt.Sprintf("%s/gpio%d", g.base, pin)
+	if _, err := os.Stat(pinDir); err != nil {
+		if err := writeSysfs(g.base+"/export", fmt.Sprintf("%d", pin)); err != nil {
+			log.Print("Creating GPIO-pin failed - continuing...", pin, err)
+		}
+	}
+	// The kernel inverts the value for us.
+	polarity := "0"
+	if activeLow {
+		polarity = "1"
+	}
+	if err := writeSysfs(pinDir+"/active_low", polarity); err != nil {
+		return nil, err
+	}
+	if err := writeSysfs(pinDir+"/direction", direction); err != nil {
+		return nil, err
+	}
+	return &sysfsLine{valueFile: pinDir + "/value"}, nil
+}
+
+func (l *sysfsLine) Set(active bool) error {
+	if active {
+		return writeSysfs(l.valueFile, "1")
+	}
+	return writeSysfs(l.valueFile, "0")
+}
+
+func (l *sysfsLine) Read() (bool, error) {
+	content, err := ioutil.ReadFile(l.valueFile)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(content)) == "1", nil
+}
+
+func writeSysfs(filename string, value string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0444)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(value + "\n"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
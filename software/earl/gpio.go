@@ -0,0 +1,107 @@
+// Access to the GPIO pins of the Raspberry Pi: relays as outputs, reed
+// contacts and push buttons as inputs.
+//
+// Lines are requested with their polarity, so users only deal with the
+// logical state: with activeLow, a low level on the pin is 'active'.
+//
+// There are several backends:
+//   - "chardev": the /dev/gpiochipN character device (gpio-chardev.go).
+//   - "sysfs": the deprecated /sys/class/gpio interface, removed in newer
+//     kernels, but the only thing available on old ones (gpio-sysfs.go).
+//   - "fake": in memory, for tests or running without hardware
+//     (gpio-fake.go).
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	gpioInputPollInterval = 50 * time.Millisecond
+	gpioInputDebounce     = 150 * time.Millisecond
+)
+
+type GPIO interface {
+	// Request pin as output. Initially inactive.
+	Output(pin int, activeLow bool) (DigitalOutput, error)
+
+	// Request pin as input.
+	Input(pin int, activeLow bool) (DigitalInput, error)
+}
+
+// A digital output, e.g. a GPIO pin driving a relay.
+type DigitalOutput interface {
+	Set(active bool) error
+}
+
+// A digital input, e.g. a GPIO pin.
+type DigitalInput interface {
+	Read() (bool, error)
+}
+
+// Open GPIO backend by name. The chip device is only used by the chardev
+// backend. "auto" chooses chardev if available, sysfs otherwise.
+func OpenGPIO(backend string, chip string) (GPIO, error) {
+	switch backend {
+	case "auto":
+		gpio, err := NewChardevGPIO(chip)
+		if err == nil {
+			return gpio, nil
+		}
+		log.Printf("Can't use %s (%v); falling back to sysfs GPIO", chip, err)
+		return NewSysfsGPIO(), nil
+	case "chardev":
+		return NewChardevGPIO(chip)
+	case "sysfs":
+		return NewSysfsGPIO(), nil
+	case "fake":
+		return NewFakeGPIO(), nil
+	}
+	return nil, fmt.Errorf("unknown GPIO backend '%s'", backend)
+}
+
+// Debounces an input: a new state is only accepted after it has been stable
+// for gpioInputDebounce. Contacts tend to bounce for a few milliseconds.
+// Not thread-safe; meant to be polled from one goroutine.
+type debouncedInput struct {
+	name  string // For logging.
+	input DigitalInput
+
+	known          bool
+	active         bool
+	candidate      bool // State seen last, but not yet stable.
+	candidateSince time.Time
+	lastReadError  error
+}
+
+// Read the input and return if the debounced state changed and the new
+// state. The first stable reading counts as a change.
+func (d *debouncedInput) Update(now time.Time) (changed bool, active bool) {
+	active, err := d.input.Read()
+	if err != nil {
+		if d.lastReadError == nil || err.Error() != d.lastReadError.Error() {
+			log.Printf("%s: can't read input: %v", d.name, err)
+		}
+		d.lastReadError = err
+		return false, d.active
+	}
+	d.lastReadError = nil
+
+	if d.known && active == d.active {
+		d.candidateSince = time.Time{}
+		return false, d.active
+	}
+	if active != d.candidate || d.candidateSince.IsZero() {
+		d.candidate = active
+		d.candidateSince = now
+	}
+	if now.Sub(d.candidateSince) < gpioInputDebounce {
+		return false, d.active
+	}
+	d.known = true
+	d.active = active
+	d.candidateSince = time.Time{}
+	return true, active
+}
@@ -1,14 +1,14 @@
 // These are actions wired to GPIO ports of the Raspberry Pi.
 // The EventLoop listens for incoming requests on the ApplicationBus, but
-// also can send events to the ApplicationBus from input-GPIO pins, e.g.
-// reed contacts or independent doorbell buttons.
+// also sends events to the ApplicationBus from input-GPIO pins, e.g.
+// reed contacts (see door-sensor.go) or push buttons (see button.go).
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 )
 
@@ -25,33 +25,79 @@ const (
 
 type GPIOActions struct {
 	doorbellDirectory   string
+	config              *Config
+	gpio                GPIO
+	relays              map[Target]DigitalOutput
+	spareRelays         []DigitalOutput
+	auditLog            *AuditLog // Optional, can be nil.
+	doorSensors         map[Target]*DoorSensor
 	nextAllowedOpenTime map[Target]time.Time
 	nextAllowedRingTime map[Target]time.Time
 }
 
 // Create this, then call EventLoop() to hook into system.
-func NewGPIOActions(wavDir string) *GPIOActions {
+func NewGPIOActions(wavDir string, config *Config, gpio GPIO, auditLog *AuditLog) *GPIOActions {
 	result := &GPIOActions{
 		doorbellDirectory:   wavDir,
+		config:              config,
+		gpio:                gpio,
+		relays:              make(map[Target]DigitalOutput),
+		auditLog:            auditLog,
+		doorSensors:         make(map[Target]*DoorSensor),
 		nextAllowedOpenTime: make(map[Target]time.Time),
 		nextAllowedRingTime: make(map[Target]time.Time),
 	}
-	result.initGPIO(7)
-	result.initGPIO(8)
-	result.initGPIO(9)
-	result.initGPIO(11)
+	for _, target := range config.Targets {
+		if target.RelayPin != nil {
+			result.initGPIO(target)
+		}
+	}
+	for _, spare := range config.SpareRelays {
+		relay, err := gpio.Output(spare.Pin, spare.ActiveLow)
+		if err != nil {
+			log.Printf("Could not switch off spare relay %d: %v", spare.Pin, err)
+			continue
+		}
+		result.spareRelays = append(result.spareRelays, relay)
+	}
 	return result
 }
 
-// Receive events from the bus and act on it.
-// (later: if we read reed contacts, send AppDoorSensorEvents)
+// Receive events from the bus and act on it. Door sensors and buttons send
+// their events to the bus.
 func (g *GPIOActions) EventLoop(bus *ApplicationBus) {
+	for _, target := range g.config.Targets {
+		if target.Sensor == nil {
+			continue
+		}
+		input, err := g.gpio.Input(target.Sensor.Pin, target.Sensor.ActiveLow)
+		if err != nil {
+			log.Printf("%s: can't set up door sensor: %v", target.Name, err)
+			continue
+		}
+		sensor := NewDoorSensor(target, input, bus)
+		g.doorSensors[target.Name] = sensor
+		go sensor.Run()
+	}
+	for _, config := range g.config.Buttons {
+		input, err := g.gpio.Input(config.Pin, config.ActiveLow)
+		if err != nil {
+			log.Printf("%s: can't set up button: %v", config.source(), err)
+			continue
+		}
+		button := NewButton(config, input, bus, g.auditLog)
+		go button.Run()
+	}
 	appEvents := make(AppEventChannel, 2)
-	bus.Subscribe(appEvents)
+	bus.Subscribe(appEvents, SubscriberName("gpio"),
+		OnlyEvents(AppOpenRequest, AppDoorbellTriggerEvent, AppHushBellRequest))
 	for {
 		event := <-appEvents
 		switch event.Ev {
 		case AppOpenRequest:
+			if sensor := g.doorSensors[event.Target]; sensor != nil {
+				sensor.NoteOpenRequest()
+			}
 			g.openDoor(event.Target)
 		case AppDoorbellTriggerEvent:
 			g.ringBell(event.Target)
@@ -62,35 +108,24 @@ func (g *GPIOActions) EventLoop(bus *ApplicationBus) {
 }
 
 func (g *GPIOActions) openDoor(which Target) {
+	target := g.config.Target(which)
+	if target == nil || target.RelayPin == nil {
+		log.Printf("DoorAction: Don't know how to open '%s'", which)
+		return
+	}
 	if time.Now().Before(g.nextAllowedOpenTime[which]) {
 		// We don't want to interfere with ourself currently opening.
 		return
 	}
-	g.nextAllowedOpenTime[which] = time.Now().Add(defaultDoorOpenTime + defaultDoorOpenRateLimit)
+	g.nextAllowedOpenTime[which] = time.Now().Add(target.OpenDuration + target.RateLimit)
 
-	gpio_pin := -1
-	switch which {
-	case TargetDownstairs:
-		gpio_pin = 7
-
-	case TargetUpstairs:
-		gpio_pin = 11
-
-	case TargetElevator:
-		gpio_pin = 9
-
-	default:
-		log.Printf("DoorAction: Don't know how to open '%s'", which)
-	}
 	// Maybe when we see a door-open event for this target, fall back
 	// to non-buzzing immediately after ?
-	if gpio_pin > 0 {
-		go func() {
-			g.switchRelay(true, gpio_pin)
-			time.Sleep(defaultDoorOpenTime)
-			g.switchRelay(false, gpio_pin)
-		}()
-	}
+	go func() {
+		g.switchRelay(true, target)
+		time.Sleep(target.OpenDuration)
+		g.switchRelay(false, target)
+	}()
 
 	// The door was opened, so allow the doorbell to ring again right away.
 	g.nextAllowedRingTime[which] = time.Now()
@@ -101,14 +136,17 @@ func (g *GPIOActions) ringBell(which Target) {
 		return // Hushed.
 	}
 	filename := g.doorbellDirectory + "/" + string(which) + ".wav"
+	if target := g.config.Target(which); target != nil {
+		filename = target.Bell
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(g.doorbellDirectory, filename)
+		}
+	}
 	_, err := os.Stat(filename)
 	msg := ""
 	if err == nil {
-		// Inform pegasus about doorbell, so that it can ring. But
-		// time-out so that network issues don't cause thread-eating.
-		// (there is a delay currently in the network set-up. Disable
-		// for now)
-		//go exec.Command("/usr/bin/curl", "-q", "-m", "3", "http://pegasus.noise/bell/?tone="+string(which)).Run()
+		// Other machines that want to ring (pegasus) get a webhook;
+		// see webhooks.go.
 		go exec.Command(WavPlayer, filename).Run()
 	} else {
 		msg = ": [ugh, file not found!]"
@@ -117,43 +155,22 @@ func (g *GPIOActions) ringBell(which Target) {
 	g.nextAllowedRingTime[which] = time.Now().Add(defaultDoorbellRatelimit)
 }
 
-func (g *GPIOActions) initGPIO(gpio_pin int) {
-	// Initialize the GPIO stuffs
-	// Create gpio_pin if it doesn't exist
-	f, err := os.OpenFile("/sys/class/gpio/export", os.O_WRONLY, 0444)
-	if err != nil {
-		log.Print("Creating GPIO-pin failed - continuing...", gpio_pin, err)
-	} else {
-		f.Write([]byte(fmt.Sprintf("%d\n", gpio_pin)))
-		f.Close()
-	}
-
-	// Put GPIO in Out mode
-	f, err = os.OpenFile(fmt.Sprintf("/sys/class/gpio/gpio%d/direction", gpio_pin), os.O_WRONLY, 0444)
+func (g *GPIOActions) initGPIO(target *TargetConfig) {
+	relay, err := g.gpio.Output(*target.RelayPin, target.ActiveLow)
 	if err != nil {
-		log.Print("Error! Could not configure GPIO", err)
+		log.Printf("%s: could not configure relay: %v", target.Name, err)
+		return
 	}
-	f.Write([]byte("out\n"))
-	f.Close()
-
-	g.switchRelay(false, gpio_pin) // initial state.
+	g.relays[target.Name] = relay
 }
 
-func (g *GPIOActions) switchRelay(switch_on bool, gpio_pin int) {
-	if gpio_pin != 7 && gpio_pin != 8 && gpio_pin != 9 && gpio_pin != 11 {
-		log.Print("GPIO needs to be one of 7,8,9,11!")
-	}
-
-	gpioFile := fmt.Sprintf("/sys/class/gpio/gpio%d/value", gpio_pin)
-	f, err := os.OpenFile(gpioFile, os.O_WRONLY, 0444)
-	if err != nil {
-		log.Printf("Error! Could not activate relay (%t): %s", switch_on, err)
+func (g *GPIOActions) switchRelay(switch_on bool, target *TargetConfig) {
+	relay := g.relays[target.Name]
+	if relay == nil {
+		log.Printf("Error! No relay for %s", target.Name)
 		return
 	}
-	if switch_on {
-		f.Write([]byte("0\n")) // negative logic.
-	} else {
-		f.Write([]byte("1\n"))
+	if err := relay.Set(switch_on); err != nil {
+		log.Printf("Error! Could not activate relay (%t): %s", switch_on, err)
 	}
-	f.Close()
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayOpensDoor(t *testing.T) {
+	gpio := NewFakeGPIO()
+	config := &Config{
+		Targets: []*TargetConfig{
+			{Name: TargetDownstairs, RelayPin: relayPin(7), ActiveLow: true},
+			{Name: TargetUpstairs, RelayPin: relayPin(11)},
+		},
+		SpareRelays: []*SpareRelayConfig{{Pin: 8, ActiveLow: true}},
+	}
+	config.applyDefaults()
+	config.Targets[0].OpenDuration = 50 * time.Millisecond
+	actions := NewGPIOActions("", config, gpio, nil)
+
+	// Relays are initially off, active-low one has high level.
+	ExpectTrue(t, gpio.Level(7), "Gate relay off")
+	ExpectFalse(t, gpio.Level(11), "Upstairs relay off")
+	ExpectTrue(t, gpio.Level(8), "Spare relay off")
+
+	actions.openDoor(TargetDownstairs)
+	time.Sleep(10 * time.Millisecond)
+	ExpectFalse(t, gpio.Level(7), "Gate relay on")
+	ExpectFalse(t, gpio.Level(11), "Upstairs relay still off")
+
+	time.Sleep(100 * time.Millisecond)
+	ExpectTrue(t, gpio.Level(7), "Gate relay off again")
+}
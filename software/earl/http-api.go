@@ -1,13 +1,17 @@
 // API to see events fly by.
+// Also allows to look at the access audit trail if enabled, the
+// upcoming closures of the space and the status of the terminals.
 package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"sort"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -24,12 +28,14 @@ var (
 )
 
 type ApiServer struct {
-	bus *ApplicationBus
+	bus       *ApplicationBus
+	auditLog  *AuditLog
+	members   *BearerAuth // Who may see the audit log.
+	closures  *ClosureCalendar
+	terminals *TerminalRegistry
+	commands  *RemoteCommands // Optional, can be nil.
 
-	// Remember the last event for each type. Already JSON prepared
-	eventChannel   AppEventChannel
-	lastEvents     map[AppEventType]*JsonAppEvent
-	lastEventsLock sync.Mutex
+	webSocketUpgrader *websocket.Upgrader
 }
 
 func init() {
@@ -45,6 +51,7 @@ type JsonAppEvent struct {
 	// conneect
 	IsHistoricEvent bool `json:",omitempty"`
 
+	Seq       uint64       `json:"seq"`
 	Timestamp time.Time    `json:"timestamp"`
 	Ev        AppEventType `json:"type"`
 	Target    Target       `json:"target"`
@@ -56,12 +63,14 @@ type JsonAppEvent struct {
 
 func JsonEventFromAppEvent(event *AppEvent) *JsonAppEvent {
 	jev := &JsonAppEvent{
-		Timestamp: event.Timestamp,
-		Ev:        event.Ev,
-		Target:    event.Target,
-		Source:    event.Source,
-		Msg:       event.Msg,
-		Value:     event.Value,
+		IsHistoricEvent: event.Replayed,
+		Seq:             event.Seq,
+		Timestamp:       event.Timestamp,
+		Ev:              event.Ev,
+		Target:          event.Target,
+		Source:          event.Source,
+		Msg:             event.Msg,
+		Value:           event.Value,
 	}
 	if !event.Timeout.IsZero() {
 		jev.Timeout = &event.Timeout
@@ -69,39 +78,31 @@ func JsonEventFromAppEvent(event *AppEvent) *JsonAppEvent {
 	return jev
 }
 
-func NewApiServer(bus *ApplicationBus, mux *http.ServeMux) *ApiServer {
+func NewApiServer(backends *Backends, mux *http.ServeMux) *ApiServer {
 	newObject := &ApiServer{
-		bus:          bus,
-		eventChannel: make(AppEventChannel),
-		lastEvents:   make(map[AppEventType]*JsonAppEvent),
+		bus:       backends.appEventBus,
+		auditLog:  backends.auditLog,
+		members:   NewBearerAuth(backends.authenticator),
+		closures:  backends.closures,
+		terminals: backends.terminals,
+		commands:  backends.remoteCommands,
 	}
+	var origins []string
+	if backends.config != nil {
+		origins = backends.config.WebSocketOrigins
+	}
+	newObject.webSocketUpgrader = newWebSocketUpgrader(origins)
 	mux.Handle("/api/events", newObject)
-	bus.Subscribe(newObject.eventChannel)
-	go newObject.collectLastEvents()
-	return newObject
-}
-
-func (a *ApiServer) collectLastEvents() {
-	for {
-		ev := <-a.eventChannel
-		// Remember the last event of each type.
-		a.lastEventsLock.Lock()
-		jsonified := JsonEventFromAppEvent(ev)
-		jsonified.IsHistoricEvent = true
-		a.lastEvents[ev.Ev] = jsonified
-		a.lastEventsLock.Unlock()
+	mux.HandleFunc("/api/events/ws", newObject.ServeWebSocket)
+	if newObject.auditLog != nil {
+		mux.HandleFunc("/api/audit", newObject.ServeAudit)
 	}
-}
-
-func (a *ApiServer) getHistory() []*JsonAppEvent {
-	result := EventList{}
-	a.lastEventsLock.Lock()
-	for _, ev := range a.lastEvents {
-		result = append(result, ev)
+	if newObject.commands != nil {
+		mux.HandleFunc("/api/commands/", newObject.ServeCommand)
 	}
-	a.lastEventsLock.Unlock()
-	sort.Sort(result) // Show old events first
-	return result
+	mux.HandleFunc("/api/closures", newObject.ServeClosures)
+	mux.HandleFunc("/api/terminals", newObject.ServeTerminals)
+	return newObject
 }
 
 func flushResponse(out http.ResponseWriter) {
@@ -110,27 +111,22 @@ func flushResponse(out http.ResponseWriter) {
 	}
 }
 
-func (event *JsonAppEvent) writeJSONEvent(out http.ResponseWriter, jsonp_callback string) bool {
-	json, err := json.Marshal(event)
-	if err != nil {
-		// Funny event, let's just ignore.
-		return true
-	}
-	if jsonp_callback != "" {
-		out.Write([]byte(jsonp_callback + "("))
-	}
-	_, err = out.Write(json)
-	if err != nil {
-		return false
-	}
-	if jsonp_callback != "" {
-		out.Write([]byte(");"))
+// Make browsers happy.
+func allowOrigin(out http.ResponseWriter, req *http.Request) {
+	allowOrigin := req.Header.Get("Origin")
+	if allowOrigin == "" {
+		allowOrigin = "*"
 	}
-	out.Write([]byte("\n"))
-	flushResponse(out)
-	return true
+	out.Header()["Access-Control-Allow-Origin"] = []string{allowOrigin}
 }
 
+// Stream of events, one JSON object per line. For the parameters to ask for
+// a replay of past events, see replayFromRequest(). Also (optional)
+//
+//	callback  : JSONP callback; answers with the replay or the next event
+//	            instead of a stream.
+//
+// Clients sending "Accept: text/event-stream" get Server-Sent Events instead.
 func (a *ApiServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 	begin := time.Now()
 	defer func() {
@@ -142,38 +138,127 @@ func (a *ApiServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	req.ParseForm()
+	replay, err := replayFromRequest(req)
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		a.serveEventSource(out, req, replay)
+		return
+	}
+
 	cb := req.Form.Get("callback")
 	if cb == "" {
 		out.Header()["Content-Type"] = []string{"application/json"}
 	} else {
 		out.Header()["Content-Type"] = []string{"application/javascript"}
 	}
+	allowOrigin(out, req)
 
-	// Make browsers happy.
-	allowOrigin := req.Header.Get("Origin")
-	if allowOrigin == "" {
-		allowOrigin = "*"
+	if cb != "" {
+		a.serveJSONP(out, req, replay, cb)
+		return
 	}
-	out.Header()["Access-Control-Allow-Origin"] = []string{allowOrigin}
 
-	for _, event := range a.getHistory() {
-		if !event.writeJSONEvent(out, cb) {
-			break
-		}
-	}
+	disableWriteTimeout(out)
 	flushResponse(out)
 
-	// TODO: for JSONP, do we essentially have to close the connection after
-	// we emit an event, otherwise the browser never knows when things
-	// finish ?
-	appEvents := make(AppEventChannel, 3)
-	a.bus.Subscribe(appEvents)
+	appEvents := subscribeStream(a.bus, "http-events", replay)
+	defer a.bus.Unsubscribe(appEvents)
 	for {
-		event := <-appEvents
-		if !JsonEventFromAppEvent(event).writeJSONEvent(out, cb) {
-			break
+		select {
+		case event, ok := <-appEvents:
+			if !ok {
+				return // Disconnected by the bus.
+			}
+			if !writeJSONEvent(out, event, cb) {
+				return
+			}
+		case <-req.Context().Done():
+			return // Client went away.
 		}
 	}
-	a.bus.Unsubscribe(appEvents)
+}
+
+// Parse time given either as RFC3339 or as unix timestamp.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Query the audit log. Parameters (all optional)
+//
+//	from, to : time range; RFC3339 or unix time.
+//	target   : only this target
+//	result   : only this AuthResult, e.g. "ok" or "failed"
+//	limit    : only the last number of records
+//
+// Like listing /api/users, needs an "Authorization: Bearer <code>" header
+// with the code of a member (or philanthropist).
+func (a *ApiServer) ServeAudit(out http.ResponseWriter, req *http.Request) {
+	begin := time.Now()
+	defer func() {
+		httpRequestDurationSeconds.With(prometheus.Labels{"method": req.Method}).Observe(time.Since(begin).Seconds())
+	}()
+
+	if req.Method != "GET" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if code, _ := a.members.authenticate(out, req, CanLevelModify); code == "" {
+		return
+	}
+	req.ParseForm()
+	var filter AuditFilter
+	var err error
+	if filter.From, err = parseTimeParam(req.Form.Get("from")); err != nil {
+		http.Error(out, fmt.Sprintf("from: %v", err), http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseTimeParam(req.Form.Get("to")); err != nil {
+		http.Error(out, fmt.Sprintf("to: %v", err), http.StatusBadRequest)
+		return
+	}
+	filter.Target = Target(req.Form.Get("target"))
+	filter.Result = req.Form.Get("result")
+	if limit := req.Form.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(out, "limit: expected number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := a.auditLog.Query(filter)
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out.Header()["Content-Type"] = []string{"application/json"}
+	json.NewEncoder(out).Encode(records)
+}
+
+// List closures that are not over yet, in chronological order.
+func (a *ApiServer) ServeClosures(out http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	out.Header()["Content-Type"] = []string{"application/json"}
+	json.NewEncoder(out).Encode(a.closures.Upcoming(time.Now()))
+}
+
+// List the serial devices and the terminals connected to them.
+func (a *ApiServer) ServeTerminals(out http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	out.Header()["Content-Type"] = []string{"application/json"}
+	json.NewEncoder(out).Encode(a.terminals.List())
 }
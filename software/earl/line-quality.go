@@ -0,0 +1,220 @@
+// Line-quality checks and baud rate negotiation with the terminals.
+//
+// The firmware echoes lines starting with 'e', so we can check how many
+// lines make it through the cable intact. With long cables or noisy
+// surroundings, a lower baud rate can make a flaky line reliable.
+//
+// In auto-baud mode, we step the rate up as long as the line stays clean or
+// down until it is. A rate change with 'B' only lasts until the terminal
+// is reset; sending the same 'B' command again at the new rate stores it
+// in the EEPROM. We only do that once the echo check passed at the new rate,
+// so a rate that doesn't work is gone after a power cycle.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// Echo lines per check. They are kept shorter than the line
+	// buffer of the firmware.
+	lineCheckCount = 20
+
+	// After this many echos got lost in a row, the line is dead.
+	lineCheckMaxLost = 3
+
+	// Shorter than responseTimeout, as we expect many to fail while
+	// looking for the right rate.
+	baudProbeTimeout = 500 * time.Millisecond
+
+	// Time for the terminal to switch after replying to 'B'.
+	baudSwitchTime = 50 * time.Millisecond
+)
+
+// What the firmware supports, slowest first.
+var terminalBaudrates = []int{300, 600, 1200, 2400, 4800, 9600, 19200, 38400}
+
+var errLineCheckFailed = errors.New("line check failed")
+
+// A test line with varying content; 'U' is 0x55, alternating bits.
+func lineCheckPattern(i int) string {
+	const chars = "UUUU0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	offset := i % len(chars)
+	pattern := (chars + chars)[offset : offset+24]
+	return fmt.Sprintf("e%02d %s", i, pattern)
+}
+
+// Let the terminal echo test lines and count how many don't come back
+// intact. Returns the fraction of bad lines, which is also recorded in the
+// status.
+func (t *SerialTerminal) checkLineQuality() float64 {
+	bad, lost := 0, 0
+	for i := 0; i < lineCheckCount; i++ {
+		if lost >= lineCheckMaxLost {
+			bad += lineCheckCount - i // No point in waiting for the rest.
+			break
+		}
+		line := lineCheckPattern(i)
+		reply, err := t.exchange(line, responseTimeout)
+		if err != nil {
+			bad++
+			lost++
+			continue
+		}
+		lost = 0
+		if strings.TrimRight(reply, "\r\n") != line {
+			bad++
+		}
+	}
+	if bad > 0 {
+		// Mangled echos might have ended up looking like events.
+		t.discardEvents()
+	}
+	rate := float64(bad) / lineCheckCount
+	log.Printf("%s: line check: %d of %d echo lines bad",
+		t.logPrefix, bad, lineCheckCount)
+	t.status.SetLineQuality(t.baud, rate)
+	return rate
+}
+
+func (t *SerialTerminal) discardEvents() {
+	for {
+		select {
+		case <-t.eventChannel:
+		default:
+			return
+		}
+	}
+}
+
+// Find the baud rate the terminal talks at, starting with the current one.
+// Returns the name of the terminal or an empty string if it is nowhere to
+// be found.
+func (t *SerialTerminal) findBaudrate() string {
+	rates := []int{t.baud}
+	for _, rate := range terminalBaudrates {
+		if rate != t.baud {
+			rates = append(rates, rate)
+		}
+	}
+	for _, rate := range rates {
+		if rate != t.baud && t.setHostBaud(rate) != nil {
+			continue
+		}
+		reply, err := t.exchange("n", baudProbeTimeout)
+		if err == nil && reply[0] == 'n' {
+			if rate != rates[0] {
+				log.Printf("%s: terminal found at %d baud", t.port, rate)
+			}
+			return strings.TrimSpace(reply[1:])
+		}
+	}
+	log.Printf("%s: no terminal answering at any baud rate", t.port)
+	return ""
+}
+
+// Step the baud rate up while the line is clean, or down until it is, and
+// store the rate in the terminal once verified. Returns an error if we lost
+// the terminal on the way.
+func (t *SerialTerminal) negotiateBaud() error {
+	initial := t.baud
+	clean := t.checkLineQuality() == 0
+	if clean {
+		for next := adjacentBaudrate(t.baud, +1); next != 0; next = adjacentBaudrate(t.baud, +1) {
+			previous := t.baud
+			if err := t.changeBaud(next); err != nil {
+				return err
+			}
+			if t.checkLineQuality() > 0 {
+				// Too fast. Go back to what worked.
+				if err := t.changeBaud(previous); err != nil {
+					return err
+				}
+				if t.checkLineQuality() > 0 {
+					return errLineCheckFailed
+				}
+				break
+			}
+		}
+	} else {
+		for next := adjacentBaudrate(t.baud, -1); !clean && next != 0; next = adjacentBaudrate(t.baud, -1) {
+			if err := t.changeBaud(next); err != nil {
+				return err
+			}
+			clean = t.checkLineQuality() == 0
+		}
+		if !clean {
+			// Not stored, so the terminal is back at the initial
+			// rate after the next reset.
+			log.Printf("%s: line not clean at any baud rate", t.logPrefix)
+			return nil
+		}
+	}
+	if t.baud == initial {
+		return nil
+	}
+	return t.storeBaud()
+}
+
+// The next faster (direction +1) or slower (-1) rate; 0 if there is none.
+func adjacentBaudrate(baud int, direction int) int {
+	for i, rate := range terminalBaudrates {
+		if rate == baud {
+			if next := i + direction; next >= 0 && next < len(terminalBaudrates) {
+				return terminalBaudrates[next]
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Tell the terminal to switch to the new rate and follow it. The new rate
+// is not stored in the terminal yet.
+func (t *SerialTerminal) changeBaud(baud int) error {
+	command := fmt.Sprintf("B%d", baud)
+	reply, err := t.exchange(command, responseTimeout)
+	if err != nil || reply[0] != 'B' {
+		// Might be a noisy line; the command could have reached the
+		// terminal anyway. Best guess is that it did.
+		log.Printf("%s: no confirmation for %s (%v); switching anyway",
+			t.logPrefix, command, err)
+	}
+	time.Sleep(baudSwitchTime)
+	if err := t.setHostBaud(baud); err != nil {
+		return err
+	}
+	log.Printf("%s: switched to %d baud", t.port, baud)
+	return nil
+}
+
+// Send the 'B' command again at the current rate, which makes the terminal
+// store it.
+func (t *SerialTerminal) storeBaud() error {
+	command := fmt.Sprintf("B%d", t.baud)
+	reply, err := t.exchange(command, responseTimeout)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "Baud rate stored") {
+		return fmt.Errorf("unexpected reply to %s: %s",
+			command, strings.TrimSpace(reply))
+	}
+	log.Printf("%s: %d baud stored in terminal", t.logPrefix, t.baud)
+	return nil
+}
+
+func (t *SerialTerminal) setHostBaud(baud int) error {
+	if err := setSerialBaud(t.serialFile, baud); err != nil {
+		log.Printf("%s: %v", t.logPrefix, err)
+		return err
+	}
+	t.baud = baud
+	t.logPrefix = fmt.Sprintf("%s:%d", t.port, baud)
+	t.status.SetBaud(baud)
+	return nil
+}
@@ -26,7 +26,8 @@ var Version string
 var metricNamespace = "earl"
 
 // Each access point has their own name. The terminals can identify
-// by that name.
+// by that name. Which targets exist is configured (see config.go), these
+// are the ones at Noisebridge.
 
 type Target string // TODO: find better name for this type
 func (s Target) String() string {
@@ -40,31 +41,31 @@ const (
 	TargetControlUI  = Target("control") // UI to add new users.
 )
 
-var (
-	targets = []Target{
-		TargetDownstairs,
-		TargetUpstairs,
-		TargetElevator,
-		TargetControlUI,
-	}
+const (
+	maxLCDRows      = 2
+	maxLCDCols      = 24
+	defaultBaudrate = 9600
+	idleTickTime    = 500 * time.Millisecond
 )
 
-const (
-	maxLCDRows                  = 2
-	maxLCDCols                  = 24
-	defaultBaudrate             = 9600
+// Variables, so that tests don't have to wait that long.
+var (
 	initialReconnectOnErrorTime = 2 * time.Second
 	maxReconnectOnErrorTime     = 60 * time.Second
-	idleTickTime                = 500 * time.Millisecond
 )
 
-func parseArg(arg string) (devicepath string, baudrate int) {
+// Parse <serial-device>[:baudrate][:auto]
+func parseArg(arg string) (devicepath string, baudrate int, autoBaud bool) {
 	split := strings.Split(arg, ":")
 	devicepath = split[0]
 	baudrate = defaultBaudrate
-	if len(split) > 1 {
+	for _, option := range split[1:] {
+		if option == "auto" {
+			autoBaud = true
+			continue
+		}
 		var err error
-		if baudrate, err = strconv.Atoi(split[1]); err != nil {
+		if baudrate, err = strconv.Atoi(option); err != nil {
 			panic(err)
 		}
 	}
@@ -72,15 +73,21 @@ func parseArg(arg string) (devicepath string, baudrate int) {
 }
 
 type Backends struct {
-	authenticator Authenticator
-	appEventBus   *ApplicationBus
+	authenticator  Authenticator
+	appEventBus    *ApplicationBus
+	auditLog       *AuditLog // Optional, can be nil.
+	config         *Config
+	spaceStatus    *SpaceStatus
+	closures       *ClosureCalendar  // Optional, can be nil.
+	terminals      *TerminalRegistry // Optional, can be nil.
+	remoteCommands *RemoteCommands   // Optional, can be nil.
 }
 
 func printVersionInfo() {
 	fmt.Printf("Version: %s\n", Version)
 }
 
-func printUserList(auth *FileBasedAuthenticator) {
+func printUserList(auth Authenticator) {
 	longest_name := 1
 	longest_contact := 1
 	auth.IterateUsers(func(user User) {
@@ -96,8 +103,15 @@ func printUserList(auth *FileBasedAuthenticator) {
 		fmt.Printf("%*s %*s %-14s ",
 			-longest_name, user.Name,
 			-longest_contact, user.ContactInfo, user.UserLevel)
-		timeFrom, timeTo := user.AccessHours()
-		fmt.Printf("\u231a %02d:00..%02d:00 ", timeFrom, timeTo)
+		if user.Schedule != nil {
+			fmt.Printf("\u231a %s ", user.Schedule)
+		} else {
+			timeFrom, timeTo := user.AccessHours()
+			fmt.Printf("\u231a %02d:00..%02d:00 ", timeFrom, timeTo)
+		}
+		if len(user.Targets) > 0 {
+			fmt.Printf("\U0001f6aa %s ", joinTargets(user.Targets))
+		}
 
 		exp := user.ExpiryDate(time.Now())
 		validityPeriod := user.InValidityPeriod(time.Now())
@@ -114,13 +128,48 @@ func printUserList(auth *FileBasedAuthenticator) {
 	})
 }
 
-func handleSerialDevice(devicepath string, baud int, backends *Backends) {
+func printClosureList(closures *ClosureCalendar) {
+	for _, closure := range closures.Upcoming(time.Now()) {
+		levels := "all but member"
+		if len(closure.Levels) > 0 {
+			levels = fmt.Sprint(closure.Levels)
+		}
+		targets := "all"
+		if len(closure.Targets) > 0 {
+			targets = fmt.Sprint(closure.Targets)
+		}
+		fmt.Printf("%s .. %s  %-30s levels: %s; targets: %s\n",
+			closure.From.Format("2006-01-02 15:04"),
+			closure.To.Format("2006-01-02 15:04"),
+			closure.Description, levels, targets)
+	}
+}
+
+// Connect to the terminal at the serial device and keep reconnecting if
+// the connection is lost. Returns once the stop channel is closed; nil to run
+// forever.
+func handleSerialDevice(devicepath string, baud int, autoBaud bool, backends *Backends, stop <-chan struct{}) {
 	var t *SerialTerminal
+	status := backends.terminals.Device(devicepath, baud)
 	connect_successful := true
+	first_attempt := true
 	retry_time := initialReconnectOnErrorTime
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !first_attempt {
+			status.NoteReconnect()
+		}
+		first_attempt = false
 		if !connect_successful {
-			time.Sleep(retry_time)
+			select {
+			case <-stop:
+				return
+			case <-time.After(retry_time):
+			}
 			retry_time *= 2 // exponential backoff.
 			if retry_time > maxReconnectOnErrorTime {
 				retry_time = maxReconnectOnErrorTime
@@ -129,7 +178,7 @@ func handleSerialDevice(devicepath string, baud int, backends *Backends) {
 
 		connect_successful = false
 
-		t, _ = NewSerialTerminal(devicepath, baud)
+		t, _ = NewSerialTerminal(devicepath, baud, autoBaud, status)
 		if t == nil {
 			continue
 		}
@@ -138,35 +187,59 @@ func handleSerialDevice(devicepath string, baud int, backends *Backends) {
 		// for the name e.g. handlers that deal with reading codes
 		// and opening doors, but also the UI handler dealing with
 		// adding new users.
+		// Which handler runs for which name is configured.
 		var handler TerminalEventHandler
-		switch Target(t.GetTerminalName()) {
-		case TargetDownstairs, TargetUpstairs, TargetElevator:
+		target := backends.config.Target(Target(t.GetTerminalName()))
+		switch {
+		case target == nil:
+			log.Printf("%s: Terminal with unrecognized name '%s'",
+				t.logPrefix, t.GetTerminalName())
+			status.NoteError("unrecognized name '%s'", t.GetTerminalName())
+
+		case target.Handler == HandlerAccess:
 			handler = NewAccessHandler(backends)
 
-		case TargetControlUI:
+		case target.Handler == HandlerControl:
 			handler = NewControlHandler(backends)
 
-		default:
-			log.Printf("%s:%d: Terminal with unrecognized name '%s'",
-				devicepath, baud, t.GetTerminalName())
+		case target.Handler == HandlerDebug:
+			handler = &DebugHandler{}
+		}
+
+		if handler != nil {
+			status.Connected(t.GetTerminalName())
+			if autoBaud {
+				err := t.negotiateBaud()
+				baud = t.baud // Start here next time.
+				if err != nil {
+					log.Printf("%s: lost terminal while negotiating baud rate: %v",
+						t.logPrefix, err)
+					status.NoteError("baud negotiation: %v", err)
+					status.Disconnected()
+					handler = nil
+				}
+			} else {
+				t.checkLineQuality()
+			}
 		}
 
 		if handler != nil {
 			connect_successful = true
 			retry_time = initialReconnectOnErrorTime
-			log.Printf("%s:%d: connected to '%s'",
-				devicepath, baud, t.GetTerminalName())
+			log.Printf("%s: connected to '%s'",
+				t.logPrefix, t.GetTerminalName())
 			backends.appEventBus.Post(&AppEvent{
 				Ev:     AppTerminalConnect,
 				Target: Target(t.GetTerminalName()),
-				Msg:    fmt.Sprintf("%s:%d", devicepath, baud),
+				Msg:    t.logPrefix,
 				Source: "serialdevice",
 			})
-			t.RunEventLoop(handler, backends.appEventBus)
+			t.RunEventLoop(handler, backends.appEventBus, stop)
+			status.Disconnected()
 			backends.appEventBus.Post(&AppEvent{
 				Ev:     AppTerminalDisconnect,
 				Target: Target(t.GetTerminalName()),
-				Msg:    fmt.Sprintf("%s:%d", devicepath, baud),
+				Msg:    t.logPrefix,
 				Source: "serialdevice",
 			})
 		}
@@ -185,11 +258,27 @@ func init() {
 
 func main() {
 	userFileName := flag.String("users", "", "User Authentication file.")
+	userDBName := flag.String("userdb", "", "SQLite user database. If given, used instead of -users file.")
+	import_users := flag.Bool("import-users", false, "Import users from the -users file into the (empty) -userdb and exit")
 	logFileName := flag.String("logfile", "", "The log file, default = stdout")
+	configFileName := flag.String("config", "", "YAML file configuring targets. Default: Noisebridge set-up.")
+	gpioBackend := flag.String("gpio", "auto", "GPIO backend: chardev, sysfs, fake or auto (chardev if available).")
+	gpioChip := flag.String("gpiochip", "/dev/gpiochip0", "GPIO character device for the chardev backend.")
+	watchSerial := flag.String("watch-serial", "", "Watch directory for serial devices coming and going: <dir>[:baudrate][:auto], e.g. /dev/serial/by-id")
 	doorbellDir := flag.String("belldir", "", "Directory that contains upstairs.wav, gate.wav etc. Wav needs to be named like")
 	httpPort := flag.Int("httpport", -1, "Port to listen HTTP requests on")
 	tcpPort := flag.Int("tcpport", -1, "Port to listen for TCP requests on")
+	mqttBroker := flag.String("mqtt", "", "MQTT broker to publish events to, e.g. tcp://broker:1883")
+	mqttPrefix := flag.String("mqtt-prefix", defaultMqttTopicPrefix, "Prefix of the MQTT topics.")
+	auditFileName := flag.String("auditlog", "", "File to record access attempts to (JSON lines).")
+	auditRetention := flag.Duration("audit-retention", 90*24*time.Hour, "Prune audit records older than this. 0 to keep forever.")
+	spaceStateFileName := flag.String("spacestate", "", "File to keep the open-to-public state across restarts.")
+	openCheckins := flag.Int("open-checkins", defaultOpenSpaceCheckins, "Number of members to check in to open space to public.")
+	openSoloDuration := flag.Duration("open-solo-duration", defaultOpenSpaceSoloDuration, "How long a single member can open the space to public.")
+	closureFileName := flag.String("closures", "", "CSV calendar of periods the space is closed.")
+	policyFileName := flag.String("acl", "", "CSV file with rules who may open which target.")
 	list_users := flag.Bool("list-users", false, "List users and exit")
+	list_closures := flag.Bool("list-closures", false, "List upcoming closures and exit")
 	show_version := flag.Bool("version", false, "Print version info")
 
 	flag.Parse()
@@ -210,25 +299,95 @@ func main() {
 
 	log.Printf("Starting... version: %s\n", Version)
 
-	if len(flag.Args()) < 1 && !*list_users {
+	if len(flag.Args()) < 1 && *watchSerial == "" && !*list_users && !*import_users && !*list_closures {
 		fmt.Fprintf(os.Stderr,
-			"Expected list of serial ports."+
-				"usage: %s [options] <serial-device>[:baudrate] [<serial-device>[:baudrate]...]\nOptions\n",
+			"Expected list of serial ports or -watch-serial."+
+				"usage: %s [options] <serial-device>[:baudrate][:auto] [<serial-device>[:baudrate][:auto]...]\nOptions\n",
 			os.Args[0])
 		flag.PrintDefaults()
 		return
 	}
 
+	config := DefaultConfig()
+	if *configFileName != "" {
+		var err error
+		if config, err = LoadConfig(*configFileName); err != nil {
+			log.Fatalf("%s: %v", *configFileName, err)
+		}
+	}
+	initAuthCounter(config.TargetNames())
+
+	var closures *ClosureCalendar
+	if *closureFileName != "" {
+		closures = NewClosureCalendar(*closureFileName)
+		if closures == nil {
+			log.Fatal("Can't read closure calendar.")
+		}
+	}
+	if *list_closures {
+		printClosureList(closures)
+		return
+	}
+
 	appEventBus := NewApplicationBus()
-	authenticator := NewFileBasedAuthenticator(*userFileName,
-		appEventBus)
+	spaceStatus := NewSpaceStatus(*spaceStateFileName, *openCheckins,
+		*openSoloDuration, appEventBus)
+	accessRules := AccessRules{
+		space:    spaceStatus,
+		closures: closures,
+	}
+	if *policyFileName != "" {
+		if accessRules.policy = NewAccessPolicy(*policyFileName); accessRules.policy == nil {
+			log.Fatal("Can't read access policy.")
+		}
+	}
+
+	// Choose the user storage: either the SQLite database or the CSV file.
+	// Careful to not assign nil pointers to the interface.
+	var authenticator Authenticator
+	if *userDBName != "" {
+		sqliteAuth := NewSQLiteAuthenticator(*userDBName, appEventBus)
+		if sqliteAuth == nil {
+			log.Fatal("Can't continue without authenticator.")
+		}
+		defer sqliteAuth.Close()
+		if *import_users {
+			count, err := sqliteAuth.ImportCSV(*userFileName)
+			if err != nil {
+				log.Fatalf("Import from %s failed: %v", *userFileName, err)
+			}
+			log.Printf("Imported %d users from %s into %s",
+				count, *userFileName, *userDBName)
+			return
+		}
+		sqliteAuth.AccessRules = accessRules
+		authenticator = sqliteAuth
+	} else {
+		if *import_users {
+			log.Fatal("-import-users needs a -userdb to import into.")
+		}
+		fileAuth := NewFileBasedAuthenticator(*userFileName, appEventBus)
+		if fileAuth == nil {
+			log.Fatal("Can't continue without authenticator.")
+		}
+		fileAuth.AccessRules = accessRules
+		authenticator = fileAuth
+	}
+
 	backends := &Backends{
 		authenticator: authenticator,
 		appEventBus:   appEventBus,
+		spaceStatus:   spaceStatus,
+		closures:      closures,
+		config:        config,
+		terminals:     NewTerminalRegistry(),
 	}
-
-	if authenticator == nil {
-		log.Fatal("Can't continue without authenticator.")
+	if *auditFileName != "" {
+		backends.auditLog = NewAuditLog(*auditFileName, *auditRetention)
+	}
+	if len(config.ApiClients) > 0 {
+		backends.remoteCommands = NewRemoteCommands(config, appEventBus,
+			backends.auditLog)
 	}
 
 	// If we just requested to list users, do this and exit.
@@ -237,34 +396,79 @@ func main() {
 		return
 	}
 
-	actions := NewGPIOActions(*doorbellDir)
+	go spaceStatus.RunExpiryLoop()
+
+	gpio, err := OpenGPIO(*gpioBackend, *gpioChip)
+	if err != nil {
+		log.Fatalf("GPIO: %v", err)
+	}
+	actions := NewGPIOActions(*doorbellDir, config, gpio, backends.auditLog)
 	go actions.EventLoop(appEventBus)
 
+	var watcher *SerialDeviceWatcher
+	if *watchSerial != "" {
+		dir, baudrate, autoBaud := parseArg(*watchSerial)
+		watcher = NewSerialDeviceWatcher(dir, baudrate, autoBaud, backends)
+	}
+
 	// For each serial interface, we run an indepenent loop
 	// making sure we are constantly connected.
 	for _, arg := range flag.Args() {
-		devicepath, baudrate := parseArg(arg)
-		go handleSerialDevice(devicepath, baudrate, backends)
+		devicepath, baudrate, autoBaud := parseArg(arg)
+		if watcher != nil {
+			watcher.Ignore(devicepath)
+		}
+		go handleSerialDevice(devicepath, baudrate, autoBaud, backends, nil)
+	}
+	if watcher != nil {
+		go watcher.Run()
+	}
+
+	var chat *ChatNotifier
+	if config.Chat != nil {
+		chat = NewChatNotifier(config.Chat, backends)
+		go chat.Run()
 	}
 
 	if *httpPort > 0 && *httpPort <= 65535 {
 		mux := http.NewServeMux()
 		server := &http.Server{
 			Addr: fmt.Sprintf(":%d", *httpPort),
-			// JSON events listeners should be kept open for a while
-			WriteTimeout: 3600 * time.Second,
+			// Event streams lift this for themselves; see disableWriteTimeout()
+			WriteTimeout: 60 * time.Second,
 			Handler:      mux,
 		}
 		mux.Handle("/metrics", promhttp.Handler())
-		NewApiServer(appEventBus, mux)
+		NewApiServer(backends, mux)
+		NewUserApiServer(authenticator, mux)
+		if config.SpaceApi != nil {
+			spaceApi := NewSpaceApi(config.SpaceApi, spaceStatus, appEventBus)
+			go spaceApi.Run()
+			mux.Handle("/spaceapi.json", spaceApi)
+		}
+		if chat != nil && config.Chat.ReplyTokenHash != "" {
+			mux.Handle("/api/chat", chat)
+		}
 		go server.ListenAndServe()
 	}
 
 	if *tcpPort > 0 && *tcpPort <= 65535 {
-		tcpServer := NewTcpServer(appEventBus, *tcpPort)
+		tcpServer := NewTcpServer(backends, *tcpPort)
 		go tcpServer.Run()
 	}
 
+	if *mqttBroker != "" {
+		bridge, err := NewMqttBridge(*mqttBroker, *mqttPrefix, backends)
+		if err != nil {
+			log.Fatalf("MQTT: %v", err)
+		}
+		go bridge.Run()
+	}
+
+	if len(config.Webhooks) > 0 {
+		NewWebhookDispatcher(config.Webhooks, appEventBus).Run()
+	}
+
 	log.Println("Ready.")
 	backends.appEventBus.Post(&AppEvent{
 		Ev:     AppEarlStarted,
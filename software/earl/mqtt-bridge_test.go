@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Just enough of an MQTT broker to test against: QoS 0 delivery, retained
+// messages, wildcard subscriptions.
+type TestBroker struct {
+	listener net.Listener
+
+	lock          sync.Mutex
+	retained      map[string]*packets.PublishPacket
+	subscriptions map[*testBrokerConn][]string
+}
+
+type testBrokerConn struct {
+	net.Conn
+	writeLock sync.Mutex
+}
+
+func (c *testBrokerConn) send(packet packets.ControlPacket) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	packet.Write(c)
+}
+
+func NewTestBroker(t *testing.T) *TestBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &TestBroker{
+		listener:      listener,
+		retained:      make(map[string]*packets.PublishPacket),
+		subscriptions: make(map[*testBrokerConn][]string),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&testBrokerConn{Conn: conn})
+		}
+	}()
+	return b
+}
+
+func (b *TestBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *TestBroker) serve(conn *testBrokerConn) {
+	defer func() {
+		b.lock.Lock()
+		delete(b.subscriptions, conn)
+		b.lock.Unlock()
+		conn.Close()
+	}()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			conn.send(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = make([]byte, len(p.Topics))
+			conn.send(suback)
+			b.lock.Lock()
+			b.subscriptions[conn] = append(b.subscriptions[conn], p.Topics...)
+			for topic, retained := range b.retained {
+				if matchesAny(p.Topics, topic) {
+					conn.send(retained)
+				}
+			}
+			b.lock.Unlock()
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				conn.send(puback)
+			}
+			b.publish(p)
+		case *packets.PingreqPacket:
+			conn.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *TestBroker) publish(p *packets.PublishPacket) {
+	out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	out.TopicName = p.TopicName
+	out.Payload = p.Payload
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for conn, topics := range b.subscriptions {
+		if matchesAny(topics, p.TopicName) {
+			conn.send(out)
+		}
+	}
+	if p.Retain {
+		retained := out.Copy()
+		retained.Retain = true
+		b.retained[p.TopicName] = retained
+	}
+}
+
+func matchesAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if matchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTopic(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) || (part != "+" && part != topicParts[i]) {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+// A client watching what is published.
+type MqttWatcher struct {
+	t        *testing.T
+	client   mqtt.Client
+	messages chan mqtt.Message
+}
+
+func NewMqttWatcher(t *testing.T, broker *TestBroker, filter string) *MqttWatcher {
+	w := &MqttWatcher{
+		t:        t,
+		messages: make(chan mqtt.Message, 100),
+	}
+	options := mqtt.NewClientOptions().AddBroker(broker.URL())
+	w.client = mqtt.NewClient(options)
+	if token := w.client.Connect(); !token.WaitTimeout(asyncTestTimeout) || token.Error() != nil {
+		t.Fatalf("Can't connect to broker: %v", token.Error())
+	}
+	token := w.client.Subscribe(filter, 0, func(client mqtt.Client, message mqtt.Message) {
+		w.messages <- message
+	})
+	token.WaitTimeout(asyncTestTimeout)
+	t.Cleanup(func() { w.client.Disconnect(0) })
+	return w
+}
+
+// Wait for a message on the topic, skipping others. Returns its payload.
+func (w *MqttWatcher) Expect(topic string) string {
+	w.t.Helper()
+	timeout := time.After(asyncTestTimeout)
+	for {
+		select {
+		case message := <-w.messages:
+			if message.Topic() == topic {
+				return string(message.Payload())
+			}
+		case <-timeout:
+			w.t.Errorf("Timeout waiting for message on %s", topic)
+			return ""
+		}
+	}
+}
+
+func (w *MqttWatcher) Publish(topic string, payload string) {
+	w.client.Publish(topic, 1, false, payload).WaitTimeout(asyncTestTimeout)
+}
+
+func TestMqttBridgePublishesEvents(t *testing.T) {
+	broker := NewTestBroker(t)
+	bus := NewApplicationBus()
+	bridge, err := NewMqttBridge(broker.URL(), "earl", &Backends{appEventBus: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := NewMqttWatcher(t, broker, "earl/#")
+	go bridge.Run()
+	ExpectTrue(t, watcher.Expect("earl/status") == "online", "Online")
+
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs, Msg: "ring"})
+	event := &JsonAppEvent{}
+	json.Unmarshal([]byte(watcher.Expect("earl/gate/trigger-bell")), event)
+	ExpectTrue(t, event.Ev == AppDoorbellTriggerEvent && event.Msg == "ring" && event.Seq == 1,
+		"Event as JSON")
+
+	bus.Post(&AppEvent{Ev: AppEarlStarted})
+	watcher.Expect("earl/earl-started")
+
+	bus.Post(&AppEvent{Ev: AppDoorSensorEvent, Target: TargetDownstairs, Value: 1})
+	ExpectTrue(t, watcher.Expect("earl/gate/door") == "open", "Door state")
+	bus.Post(&AppEvent{Ev: AppTerminalConnect, Target: TargetUpstairs})
+	ExpectTrue(t, watcher.Expect("earl/upstairs/terminal") == "connected", "Terminal")
+	until := time.Now().Add(200 * time.Millisecond).Truncate(time.Second).Add(time.Second)
+	bus.Post(&AppEvent{Ev: AppHushBellRequest, Target: TargetDownstairs, Timeout: until})
+	ExpectTrue(t, watcher.Expect("earl/gate/hush") == until.Format(time.RFC3339), "Hushed")
+	ExpectTrue(t, watcher.Expect("earl/gate/hush") == "off", "Hush expired")
+
+	// Clients coming later see the state.
+	late := NewMqttWatcher(t, broker, "earl/+/door")
+	ExpectTrue(t, late.Expect("earl/gate/door") == "open", "Retained door state")
+
+	bridge.Shutdown()
+	ExpectTrue(t, watcher.Expect("earl/status") == "offline", "Offline")
+}
+
+func TestMqttBridgeCommands(t *testing.T) {
+	broker := NewTestBroker(t)
+	f := NewRemoteCommandsFixture(t)
+	bridge, err := NewMqttBridge(broker.URL(), "earl",
+		&Backends{appEventBus: f.bus, remoteCommands: f.commands})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := NewMqttWatcher(t, broker, "earl/#")
+	go bridge.Run()
+	defer bridge.Shutdown()
+	watcher.Expect("earl/status")
+
+	expectReply := func(client string, command string, expected string) {
+		t.Helper()
+		watcher.Publish("earl/command/"+client, command)
+		reply := watcher.Expect("earl/command/" + client + "/reply")
+		ExpectTrue(t, strings.Contains(reply, expected), command+": "+reply)
+	}
+	// Tokens on the shared topic are readable by everyone; not accepted.
+	watcher.Publish("earl/command", `{"token": "test", "type": "open", "target": "gate"}`)
+	expectReply("guess", `{"type": "open", "target": "gate", "id": "1"}`,
+		`"error":"Not permitted","id":"1"`)
+	expectReply("web", `{"type": "open", "target": "gate"}`,
+		`"error":"Not permitted"`)
+	expectReply("doorbot", `{"type": "open", "target": "upstairs"}`,
+		`"error":"Not permitted"`)
+	f.ExpectNoEvent()
+	expectReply("doorbot", `{"type": "open", "target": "gate", "id": "2"}`,
+		`"id":"2","ok":"open gate"`)
+	f.ExpectEvent(AppOpenRequest, TargetDownstairs, "api:doorbot")
+	expectReply("bell-only", `{"type": "hush-bell", "target": "gate", "duration": "1m"}`,
+		`"ok":"hush-bell gate"`)
+	event := f.ExpectEvent(AppHushBellRequest, TargetDownstairs, "api:bell-only")
+	ExpectTrue(t, event.Timeout.Equal(f.clock.now.Add(time.Minute)), "Hush duration")
+	expectReply("doorbot", `not json`, `"error"`)
+}
@@ -0,0 +1,251 @@
+// Commands sent by scripts and services over the network, e.g. a chat bot
+// that opens the gate, or a doorbell button in the web.
+//
+// Clients are configured in the -config file (see ApiClientConfig) with a
+// token, which they present as "Authorization: Bearer <token>" over HTTP
+//
+//	POST /api/commands/open?target=gate
+//	POST /api/commands/hush-bell?target=gate&duration=5m
+//	POST /api/commands/trigger-bell?target=gate
+//
+// or with an "auth <token>" command over TCP and WebSocket; see
+// streamSession. Over MQTT, the broker authenticates the client; see
+// mqtt-bridge.go. Each client may only send the commands to the targets it is
+// configured for, and only once per rate_limit.
+//
+// The events posted have the Source "api:<name>", and opening doors is
+// recorded in the audit log, so that it is clear who opened remotely.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultApiClientRateLimit = 2 * time.Second
+
+	// Slow down guessing tokens over the network.
+	remoteCommandAuthFailureDelay = 1 * time.Second
+)
+
+// Events clients can post to the bus.
+var remoteCommandTypes = []AppEventType{
+	AppOpenRequest, AppHushBellRequest, AppDoorbellTriggerEvent,
+}
+
+var (
+	errUnknownCommand = errors.New("Unknown command")
+	errUnknownTarget  = errors.New("Unknown target")
+	errNotPermitted   = errors.New("Not permitted")
+	errRateLimited    = errors.New("Too many requests")
+	errBadToken       = errors.New("Invalid token")
+)
+
+func isRemoteCommand(ev AppEventType) bool {
+	for _, command := range remoteCommandTypes {
+		if command == ev {
+			return true
+		}
+	}
+	return false
+}
+
+type RemoteCommands struct {
+	config   *Config
+	bus      *ApplicationBus
+	auditLog *AuditLog // Optional, can be nil.
+	clock    Clock
+
+	// Held while delaying a failed authentication, so that failures are
+	// serialized and can't be parallelized.
+	authFailureLock  sync.Mutex
+	authFailureDelay time.Duration
+
+	lock               sync.Mutex
+	nextAllowedCommand map[string]time.Time // By client name.
+}
+
+func NewRemoteCommands(config *Config, bus *ApplicationBus, auditLog *AuditLog) *RemoteCommands {
+	return &RemoteCommands{
+		config:             config,
+		bus:                bus,
+		auditLog:           auditLog,
+		clock:              RealClock{},
+		authFailureDelay:   remoteCommandAuthFailureDelay,
+		nextAllowedCommand: make(map[string]time.Time),
+	}
+}
+
+func hashApiToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Find the client with the given token. Returns nil (after a delay) if there
+// is none.
+func (r *RemoteCommands) Authenticate(token string) *ApiClientConfig {
+	hash := hashApiToken(token)
+	var found *ApiClientConfig
+	for _, client := range r.config.ApiClients {
+		// Comparing all in constant time; don't reveal how close it was.
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(client.TokenHash))) == 1 {
+			found = client
+		}
+	}
+	if found == nil {
+		log.Printf("API: invalid token (%s)", scrubLogValue(token))
+		r.auditLog.RecordAttempt(r.clock.Now(), "", "api", token, nil, AuthFail, "Invalid token")
+		r.authFailureLock.Lock()
+		time.Sleep(r.authFailureDelay)
+		r.authFailureLock.Unlock()
+	}
+	return found
+}
+
+// The client with the given name, nil if there is none. For transports that
+// authenticate the client themselves.
+func (r *RemoteCommands) Client(name string) *ApiClientConfig {
+	for _, client := range r.config.ApiClients {
+		if client.Name == name {
+			return client
+		}
+	}
+	return nil
+}
+
+func (c *ApiClientConfig) source() string {
+	return "api:" + c.Name
+}
+
+func (c *ApiClientConfig) allows(ev AppEventType, target Target) bool {
+	commandOk := false
+	for _, command := range c.Commands {
+		commandOk = commandOk || command == ev
+	}
+	if !commandOk {
+		return false
+	}
+	if len(c.Targets) == 0 {
+		return true
+	}
+	for _, allowed := range c.Targets {
+		if allowed == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Post the event for the client, if it is allowed to. The hush duration is
+// only used for AppHushBellRequest; it is capped like on the control
+// terminal.
+func (r *RemoteCommands) Execute(client *ApiClientConfig, ev AppEventType,
+	target Target, hush time.Duration) error {
+	if !isRemoteCommand(ev) {
+		return errUnknownCommand
+	}
+	if r.config.Target(target) == nil {
+		return errUnknownTarget
+	}
+	if !client.allows(ev, target) {
+		log.Printf("%s: %s denied for %s", target, ev, client.source())
+		if ev == AppOpenRequest {
+			r.auditLog.RecordAttempt(r.clock.Now(), target, client.source(), "", nil,
+				AuthTargetDenied, "")
+		}
+		return errNotPermitted
+	}
+
+	now := r.clock.Now()
+	r.lock.Lock()
+	if now.Before(r.nextAllowedCommand[client.Name]) {
+		r.lock.Unlock()
+		return errRateLimited
+	}
+	r.nextAllowedCommand[client.Name] = now.Add(client.RateLimit)
+	r.lock.Unlock()
+
+	event := &AppEvent{
+		Ev:     ev,
+		Target: target,
+		Source: client.source(),
+		Msg:    "remote",
+	}
+	switch ev {
+	case AppOpenRequest:
+		log.Printf("%s: opened by %s", target, client.source())
+		r.auditLog.RecordAttempt(r.clock.Now(), target, client.source(), "", nil, AuthOk, "")
+	case AppHushBellRequest:
+		if hush <= 0 || hush > maxSilenceDoorbell {
+			hush = maxSilenceDoorbell
+		}
+		event.Timeout = now.Add(hush)
+	}
+	r.bus.Post(event)
+	return nil
+}
+
+// HTTP status for the errors returned by Execute().
+func remoteCommandStatus(err error) int {
+	switch err {
+	case errUnknownCommand, errUnknownTarget:
+		return http.StatusNotFound
+	case errNotPermitted:
+		return http.StatusForbidden
+	case errRateLimited:
+		return http.StatusTooManyRequests
+	case errBadToken:
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+// POST /api/commands/<type>?target=<target>[&duration=<hush duration>]
+func (a *ApiServer) ServeCommand(out http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		out.Header()["WWW-Authenticate"] = []string{"Bearer"}
+		writeJSONError(out, http.StatusUnauthorized, "Authorization required.")
+		return
+	}
+	client := a.commands.Authenticate(strings.TrimSpace(header[len("Bearer "):]))
+	if client == nil {
+		writeJSONError(out, http.StatusUnauthorized, errBadToken.Error())
+		return
+	}
+
+	req.ParseForm()
+	var hush time.Duration
+	if value := req.Form.Get("duration"); value != "" {
+		var err error
+		if hush, err = time.ParseDuration(value); err != nil {
+			writeJSONError(out, http.StatusBadRequest, "duration: "+err.Error())
+			return
+		}
+	}
+	ev := AppEventType(strings.TrimPrefix(req.URL.Path, "/api/commands/"))
+	target := Target(req.Form.Get("target"))
+	if err := a.commands.Execute(client, ev, target, hush); err != nil {
+		if err == errRateLimited {
+			out.Header()["Retry-After"] = []string{
+				fmt.Sprintf("%.0f", client.RateLimit.Seconds()+0.5)}
+		}
+		writeJSONError(out, remoteCommandStatus(err), err.Error())
+		return
+	}
+	writeJSONResponse(out, http.StatusOK,
+		map[string]string{"ok": string(ev) + " " + string(target)})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testToken     = "test"
+	testTokenHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+)
+
+type RemoteCommandsFixture struct {
+	t        *testing.T
+	clock    *MockClock
+	bus      *ApplicationBus
+	events   AppEventChannel
+	auditLog *AuditLog
+	commands *RemoteCommands
+	server   *httptest.Server
+}
+
+func NewRemoteCommandsFixture(t *testing.T) *RemoteCommandsFixture {
+	config, err := ParseConfig([]byte(`
+targets:
+  - name: gate
+  - name: upstairs
+api_clients:
+  - name: doorbot
+    token_sha256: ` + testTokenHash + `
+    targets: [gate]
+    rate_limit: 10s
+    mqtt: true
+  - name: bell-only
+    token_sha256: ` + hashApiToken("ring-ring") + `
+    commands: [trigger-bell, hush-bell]
+    mqtt: true
+  - name: web
+    token_sha256: ` + hashApiToken("web-token") + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &RemoteCommandsFixture{
+		t:      t,
+		clock:  &MockClock{now: time.Date(2026, 10, 1, 20, 0, 0, 0, time.UTC)},
+		bus:    NewApplicationBus(),
+		events: make(AppEventChannel, 10),
+	}
+	var dir string
+	f.auditLog, dir = CreateTempAuditLog(f.clock)
+	if !keepGeneratedFiles {
+		t.Cleanup(func() { os.RemoveAll(dir) })
+	}
+	f.bus.Subscribe(f.events, OnlyEvents(remoteCommandTypes...))
+	f.commands = NewRemoteCommands(config, f.bus, f.auditLog)
+	f.commands.clock = f.clock
+	f.commands.authFailureDelay = 0
+
+	mux := http.NewServeMux()
+	NewApiServer(&Backends{appEventBus: f.bus, remoteCommands: f.commands}, mux)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *RemoteCommandsFixture) Post(path string, token string) int {
+	req, _ := http.NewRequest("POST", f.server.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func (f *RemoteCommandsFixture) ExpectEvent(ev AppEventType, target Target, source string) *AppEvent {
+	f.t.Helper()
+	f.bus.Flush()
+	select {
+	case event := <-f.events:
+		if event.Ev != ev || event.Target != target || event.Source != source {
+			f.t.Errorf("Expected %s for %s from %s, got %s for %s from %s",
+				ev, target, source, event.Ev, event.Target, event.Source)
+		}
+		return event
+	default:
+		f.t.Errorf("Expected %s for %s, got nothing", ev, target)
+		return nil
+	}
+}
+
+func (f *RemoteCommandsFixture) ExpectNoEvent() {
+	f.t.Helper()
+	f.bus.Flush()
+	select {
+	case event := <-f.events:
+		f.t.Errorf("Unexpected event %s for %s", event.Ev, event.Target)
+	default:
+	}
+}
+
+func TestRemoteCommandsHttp(t *testing.T) {
+	f := NewRemoteCommandsFixture(t)
+
+	ExpectTrue(t, f.Post("/api/commands/open?target=gate", "") == http.StatusUnauthorized,
+		"No token")
+	ExpectTrue(t, f.Post("/api/commands/open?target=gate", "guess") == http.StatusUnauthorized,
+		"Wrong token")
+	f.ExpectNoEvent()
+
+	ExpectTrue(t, f.Post("/api/commands/open?target=gate", testToken) == http.StatusOK,
+		"Open")
+	f.ExpectEvent(AppOpenRequest, TargetDownstairs, "api:doorbot")
+
+	ExpectTrue(t, f.Post("/api/commands/open?target=gate", testToken) == http.StatusTooManyRequests,
+		"Rate limited")
+	f.clock.now = f.clock.now.Add(10 * time.Second)
+	ExpectTrue(t, f.Post("/api/commands/open?target=upstairs", testToken) == http.StatusForbidden,
+		"Other target")
+	ExpectTrue(t, f.Post("/api/commands/open?target=basement", testToken) == http.StatusNotFound,
+		"Unknown target")
+	ExpectTrue(t, f.Post("/api/commands/explode?target=gate", testToken) == http.StatusNotFound,
+		"Unknown command")
+	f.ExpectNoEvent()
+
+	ExpectTrue(t, f.Post("/api/commands/open?target=upstairs", "ring-ring") == http.StatusForbidden,
+		"Command not permitted")
+	ExpectTrue(t, f.Post("/api/commands/hush-bell?target=upstairs&duration=1m", "ring-ring") == http.StatusOK,
+		"Hush")
+	event := f.ExpectEvent(AppHushBellRequest, TargetUpstairs, "api:bell-only")
+	ExpectTrue(t, event.Timeout.Equal(f.clock.now.Add(time.Minute)), "Hush duration")
+
+	// The audit trail shows who opened the door remotely, or tried.
+	records, _ := f.auditLog.Query(AuditFilter{})
+	ExpectTrue(t, len(records) == 4, "Audit records")
+	ExpectTrue(t, records[1].Origin == "api:doorbot" && records[1].Result == "ok" &&
+		records[1].Target == TargetDownstairs, "Audited open")
+	ExpectTrue(t, records[2].Origin == "api:doorbot" && records[2].Result == "target-denied",
+		"Audited denial")
+	ExpectTrue(t, records[0].Origin == "api" && records[0].Result == "failed",
+		"Audited bad token")
+}
+
+func TestRemoteCommandsTcp(t *testing.T) {
+	f := NewRemoteCommandsFixture(t)
+	server := NewTcpServer(&Backends{appEventBus: f.bus, remoteCommands: f.commands}, 0)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleTcpConnection(conn)
+	reader := bufio.NewReader(client)
+	expectReply := func(command string, expected string) {
+		t.Helper()
+		client.Write([]byte(command + "\n"))
+		line, _ := reader.ReadString('\n')
+		ExpectTrue(t, strings.Contains(line, expected), command+": "+line)
+	}
+
+	expectReply("open gate", `"error":"Authorization required."`)
+	expectReply("auth guess", `"error":"Invalid token"`)
+	expectReply("auth "+testToken, `"ok":"authenticated as doorbot"`)
+	expectReply("open upstairs", `"error":"Not permitted"`)
+	f.ExpectNoEvent()
+	expectReply("open gate", `"ok":"open gate"`)
+	f.ExpectEvent(AppOpenRequest, TargetDownstairs, "api:doorbot")
+
+	// The event also shows up in the stream.
+	event := readJsonEvent(t, reader)
+	ExpectTrue(t, event.Ev == AppOpenRequest && event.Source == "api:doorbot", "Streamed")
+}
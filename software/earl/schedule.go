@@ -0,0 +1,128 @@
+// Weekly access schedules.
+//
+// By default, the access times of a user are derived from their level (see
+// User.AccessHours()). Some users, e.g. participants of a class, only
+// should get in at particular times, so users can have a custom schedule:
+// a semicolon separated list of weekdays with an hour range each, e.g.
+//
+//	Mon-Fri 18-22;Sat,Sun 10-18
+//
+// Hour ranges include the 'from' hour and exclude the 'to' hour, so
+// "18-22" means >= 18:00 && < 22:00. Day ranges can wrap around the end of
+// the week ("Fri-Mon").
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scheduleDayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+type HourRange struct {
+	From, To int // [From, To)
+}
+
+type Schedule struct {
+	text string         // As parsed; for display and storage.
+	days [7][]HourRange // Indexed by time.Weekday
+}
+
+// A schedule that allows the same hours every day.
+func NewDailySchedule(from int, to int) *Schedule {
+	result := &Schedule{text: fmt.Sprintf("Sun-Sat %d-%d", from, to)}
+	if from < to {
+		for day := range result.days {
+			result.days[day] = []HourRange{{from, to}}
+		}
+	}
+	return result
+}
+
+func parseScheduleDay(name string) (int, error) {
+	for i, day := range scheduleDayNames {
+		if strings.EqualFold(day, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day '%s'", name)
+}
+
+func parseScheduleHours(spec string) (HourRange, error) {
+	fromTo := strings.Split(spec, "-")
+	if len(fromTo) != 2 {
+		return HourRange{}, fmt.Errorf("invalid hour range '%s'", spec)
+	}
+	from, err1 := strconv.Atoi(fromTo[0])
+	to, err2 := strconv.Atoi(fromTo[1])
+	if err1 != nil || err2 != nil || from < 0 || to > 24 || from >= to {
+		return HourRange{}, fmt.Errorf("invalid hour range '%s'", spec)
+	}
+	return HourRange{from, to}, nil
+}
+
+// Parse a schedule such as "Mon-Fri 18-22;Sat 10-18". Returns nil for an
+// empty string, meaning: no custom schedule.
+func ParseSchedule(text string) (*Schedule, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+	result := &Schedule{text: text}
+	for _, entry := range strings.Split(text, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected '<days> <hours>', got '%s'", entry)
+		}
+		hours, err := parseScheduleHours(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, daySpec := range strings.Split(fields[0], ",") {
+			fromTo := strings.Split(daySpec, "-")
+			if len(fromTo) > 2 {
+				return nil, fmt.Errorf("invalid day range '%s'", daySpec)
+			}
+			first, err := parseScheduleDay(fromTo[0])
+			if err != nil {
+				return nil, err
+			}
+			last := first
+			if len(fromTo) == 2 {
+				if last, err = parseScheduleDay(fromTo[1]); err != nil {
+					return nil, err
+				}
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				result.days[day] = append(result.days[day], hours)
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Is access allowed at the given time ? A nil schedule never allows access.
+func (s *Schedule) Allows(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	hour := now.Hour()
+	for _, hours := range s.days[now.Weekday()] {
+		if hour >= hours.From && hour < hours.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.text
+}
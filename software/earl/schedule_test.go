@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleParse(t *testing.T) {
+	for _, broken := range []string{
+		"Mon",
+		"Mon 18",
+		"Mon 22-18",
+		"Mon 10-25",
+		"Foo 10-18",
+		"Mon-Tue-Wed 10-18",
+		"Mon 10-18;",
+	} {
+		s, err := ParseSchedule(broken)
+		ExpectTrue(t, s == nil && err != nil, "Expected error for "+broken)
+	}
+
+	s, err := ParseSchedule("")
+	ExpectTrue(t, s == nil && err == nil, "Empty schedule")
+
+	s, err = ParseSchedule(" Mon-Fri 18-22;sat,SUN 10-18 ")
+	ExpectTrue(t, s != nil && err == nil, "Valid schedule")
+	ExpectTrue(t, s.String() == "Mon-Fri 18-22;sat,SUN 10-18", "String")
+}
+
+func TestScheduleAllows(t *testing.T) {
+	// 2014-10-10 was a Friday.
+	friday, _ := time.Parse("2006-01-02", "2014-10-10")
+	s, _ := ParseSchedule("Mon-Thu 18-22;Fri-Sun 10-18;Sat 20-24")
+
+	ExpectFalse(t, s.Allows(friday.Add(9*time.Hour+59*time.Minute)), "Fri 9:59")
+	ExpectTrue(t, s.Allows(friday.Add(10*time.Hour)), "Fri 10:00")
+	ExpectTrue(t, s.Allows(friday.Add(17*time.Hour+59*time.Minute)), "Fri 17:59")
+	ExpectFalse(t, s.Allows(friday.Add(18*time.Hour)), "Fri 18:00")
+
+	saturday := friday.Add(24 * time.Hour)
+	ExpectTrue(t, s.Allows(saturday.Add(12*time.Hour)), "Sat 12:00")
+	ExpectFalse(t, s.Allows(saturday.Add(19*time.Hour)), "Sat 19:00")
+	ExpectTrue(t, s.Allows(saturday.Add(23*time.Hour)), "Sat 23:00, second range")
+
+	monday := friday.Add(3 * 24 * time.Hour)
+	ExpectTrue(t, s.Allows(monday.Add(20*time.Hour)), "Mon 20:00")
+	ExpectFalse(t, s.Allows(monday.Add(12*time.Hour)), "Mon 12:00; wrapped range ends Sun")
+
+	var noSchedule *Schedule
+	ExpectFalse(t, noSchedule.Allows(monday), "nil schedule")
+	ExpectTrue(t, NewDailySchedule(0, 24).Allows(monday), "All day")
+	ExpectFalse(t, NewDailySchedule(0, 0).Allows(monday), "Never")
+}
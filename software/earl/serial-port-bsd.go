@@ -0,0 +1,65 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Here, the speed flags are just the baud rate.
+var serialBauds = map[int]bool{
+	300: true, 600: true, 1200: true, 2400: true,
+	4800: true, 9600: true, 19200: true, 38400: true,
+}
+
+// The termios fields have different types on the different systems.
+func setTermiosSpeed[T ~int32 | ~uint32 | ~uint64](ispeed *T, ospeed *T, baud int) {
+	*ispeed = T(baud)
+	*ospeed = T(baud)
+}
+
+// Open the device as raw 8N1 line with the given baud rate.
+func OpenSerialPort(device string, baud int) (*os.File, error) {
+	if !serialBauds[baud] {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	// Must not call Fd() on the file, as that would make it blocking.
+	// Non-blocking also means not waiting for the carrier on open.
+	file, err := os.OpenFile(device, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = controlSerialPort(file, func(fd int) error {
+		termios := &unix.Termios{
+			Iflag: unix.IGNPAR,
+			Cflag: unix.CS8 | unix.CREAD | unix.CLOCAL,
+		}
+		setTermiosSpeed(&termios.Ispeed, &termios.Ospeed, baud)
+		termios.Cc[unix.VMIN] = 1
+		termios.Cc[unix.VTIME] = 0
+		return unix.IoctlSetTermios(fd, unix.TIOCSETA, termios)
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", device, err)
+	}
+	return file, nil
+}
+
+func setSerialBaud(port *os.File, baud int) error {
+	if !serialBauds[baud] {
+		return fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	return controlSerialPort(port, func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, unix.TIOCGETA)
+		if err != nil {
+			return err
+		}
+		setTermiosSpeed(&termios.Ispeed, &termios.Ospeed, baud)
+		// Let pending output go out at the old rate first.
+		return unix.IoctlSetTermios(fd, unix.TIOCSETAW, termios)
+	})
+}
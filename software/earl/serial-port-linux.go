@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var serialBaudFlags = map[int]uint32{
+	300:   unix.B300,
+	600:   unix.B600,
+	1200:  unix.B1200,
+	2400:  unix.B2400,
+	4800:  unix.B4800,
+	9600:  unix.B9600,
+	19200: unix.B19200,
+	38400: unix.B38400,
+}
+
+// Open the device as raw 8N1 line with the given baud rate.
+func OpenSerialPort(device string, baud int) (*os.File, error) {
+	flag, ok := serialBaudFlags[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	// Must not call Fd() on the file, as that would make it blocking.
+	file, err := os.OpenFile(device, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = controlSerialPort(file, func(fd int) error {
+		termios := &unix.Termios{
+			Iflag:  unix.IGNPAR,
+			Cflag:  unix.CS8 | unix.CREAD | unix.CLOCAL | flag,
+			Ispeed: flag,
+			Ospeed: flag,
+		}
+		termios.Cc[unix.VMIN] = 1
+		termios.Cc[unix.VTIME] = 0
+		return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", device, err)
+	}
+	return file, nil
+}
+
+func setSerialBaud(port *os.File, baud int) error {
+	flag, ok := serialBaudFlags[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	return controlSerialPort(port, func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		termios.Cflag = termios.Cflag&^unix.CBAUD | flag
+		termios.Ispeed = flag
+		termios.Ospeed = flag
+		// Let pending output go out at the old rate first.
+		return unix.IoctlSetTermios(fd, unix.TCSETSW, termios)
+	})
+}
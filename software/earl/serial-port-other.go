@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func OpenSerialPort(device string, baud int) (*os.File, error) {
+	return nil, fmt.Errorf("serial ports only available on Linux, macOS and the BSDs")
+}
+
+func setSerialBaud(port *os.File, baud int) error {
+	return fmt.Errorf("changing the baud rate only available on Linux, macOS and the BSDs")
+}
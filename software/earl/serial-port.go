@@ -0,0 +1,24 @@
+// Serial ports, opened non-blocking so that they are handled by the Go
+// runtime poller: a Read() pending in one goroutine returns as soon as
+// another one calls Close(), and we can change the baud rate of an open port
+// to follow the terminal when it switches with the 'B' command.
+//
+// The termios details are in serial-port-linux.go and serial-port-bsd.go
+// (macOS and the BSDs). Other systems have no serial ports.
+package main
+
+import (
+	"os"
+)
+
+func controlSerialPort(port *os.File, f func(fd int) error) error {
+	conn, err := port.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := conn.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -4,41 +4,71 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"github.com/tarm/goserial"
-	"io"
 	"log"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// Terminal should reply immediately; if it doesn't, it is gone.
+	responseTimeout = 2 * time.Second
+)
+
+var errResponseTimeout = errors.New("timeout waiting for reply")
+
 type SerialTerminal struct {
-	serialFile      io.ReadWriteCloser
-	responseChannel chan string // Strings coming as response to requests
-	eventChannel    chan string // Strings representing input events.
-	errorState      bool
+	serialFile      *os.File
+	port            string
+	baud            int
+	responseChannel chan string   // Strings coming as response to requests
+	eventChannel    chan string   // Strings representing input events.
+	errorState      atomic.Bool   // Set by the reader and the event loop.
+	closed          chan struct{} // Closed by shutdown()
+	readerDone      chan struct{} // Closed once inputScanLoop() returned.
+	shutdownOnce    sync.Once
 	name            string             // The name of the terminal e.g. 'upstairs'
 	lastLCDContent  [maxLCDRows]string // last content sent to lcd
 	logPrefix       string
+	status          *TerminalStatus
+	noStats         bool // Firmware does not know the 's' command.
 }
 
-func NewSerialTerminal(port string, baudrate int) (*SerialTerminal, error) {
+// Connect to the terminal at the port. With autoBaud, other baud rates are
+// tried if the terminal does not answer at the given one.
+// Health information is recorded in status; if nil, it is not recorded
+// anywhere.
+func NewSerialTerminal(port string, baudrate int, autoBaud bool, status *TerminalStatus) (*SerialTerminal, error) {
+	if status == nil {
+		status = newTerminalStatus(port, baudrate)
+	}
 	t := &SerialTerminal{
-		errorState:      false,
 		eventChannel:    make(chan string, 10),
 		responseChannel: make(chan string, 10),
+		closed:          make(chan struct{}),
+		readerDone:      make(chan struct{}),
+		port:            port,
+		baud:            baudrate,
 		logPrefix:       fmt.Sprintf("%s:%d", port, baudrate),
+		status:          status,
 	}
-	c := &serial.Config{Name: port, Baud: baudrate}
 	var err error
-	t.serialFile, err = serial.OpenPort(c)
+	t.serialFile, err = OpenSerialPort(port, baudrate)
 	if err != nil {
+		status.NoteError("%v", err)
 		return nil, err
 	}
 	go t.inputScanLoop()
 	t.discardInitialInput()
-	t.name = t.requestName()
-	if t.errorState {
+	if autoBaud {
+		t.name = t.findBaudrate()
+	} else {
+		t.name = t.requestName()
+	}
+	if t.errorState.Load() {
 		t.shutdown()
 		return nil, errors.New("Couldn't get name of terminal.")
 	}
@@ -47,18 +77,19 @@ func NewSerialTerminal(port string, baudrate int) (*SerialTerminal, error) {
 
 // Deliver events received from the hardware to the TerminalEventHandler.
 // Run until we encounter an IO problem or we can't verify to be
-// connected anymore. So the only reason for this loop exiting would be
-// an error condition.
+// connected anymore; or until the stop channel is closed (nil to never
+// stop).
 func (t *SerialTerminal) RunEventLoop(handler TerminalEventHandler,
-	appEventBus *ApplicationBus) {
+	appEventBus *ApplicationBus, stop <-chan struct{}) {
 	var tick_count uint32
 	lastTickTime := time.Now()
+	lastStatsTime := time.Now()
 	handler.Init(t)
 	defer handler.HandleShutdown()
 	appEvents := make(AppEventChannel, 2)
-	appEventBus.Subscribe(appEvents)
+	appEventBus.Subscribe(appEvents, SubscriberName("terminal:"+t.name))
 	defer appEventBus.Unsubscribe(appEvents)
-	for !t.errorState {
+	for !t.errorState.Load() {
 		// If the events come in very quickly, the idle tick might
 		// be starved. So make sure to inject some.
 		if time.Now().Sub(lastTickTime) > 4*idleTickTime {
@@ -81,6 +112,12 @@ func (t *SerialTerminal) RunEventLoop(handler TerminalEventHandler,
 		case event := <-appEvents:
 			handler.HandleAppEvent(event)
 
+		case <-t.readerDone:
+			return // Line is gone.
+
+		case <-stop:
+			return
+
 		case <-time.After(idleTickTime):
 			handler.HandleTick()
 			lastTickTime = time.Now()
@@ -88,6 +125,10 @@ func (t *SerialTerminal) RunEventLoop(handler TerminalEventHandler,
 			if tick_count%10 == 0 && !t.verifyConnected() {
 				return
 			}
+			if time.Since(lastStatsTime) > terminalStatsInterval {
+				t.requestStats()
+				lastStatsTime = time.Now()
+			}
 		}
 	}
 }
@@ -125,29 +166,43 @@ func (t *SerialTerminal) ShowColor(colors string) {
 
 // Read data coming from the terminal and stuff it into the right
 // channels (we distinguish responses of commands from event notifications)
+// Runs until reading fails, which it does at the latest when shutdown()
+// closes the port.
 func (t *SerialTerminal) inputScanLoop() {
+	defer close(t.readerDone)
 	reader := bufio.NewReader(t.serialFile)
-	for !t.errorState {
+	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			if !t.errorState {
-				log.Printf("%s: reading input: %v", t.logPrefix, err)
+			select {
+			case <-t.closed:
+				// Expected, we closed the port.
+			default:
+				log.Printf("%s: reading input: %v", t.port, err)
+				t.status.NoteError("reading input: %v", err)
 			}
-			t.errorState = true
+			t.errorState.Store(true)
 			return
 		}
+		var channel chan string
 		switch line[0] {
 		case '#', 0:
 			// ignore comment lines and obvious garbage.
+			continue
 		case 'I', 'K':
 			// These are events sent asynchronously from the
 			// terminal to signify incoming key-presses or RFID
 			// reads
-			t.eventChannel <- line
+			channel = t.eventChannel
 		default:
 			// Everything else coming from the terminal is in
 			// response to something we requested.
-			t.responseChannel <- line
+			channel = t.responseChannel
+		}
+		select {
+		case channel <- line:
+		case <-t.closed:
+			return // Nobody is listening anymore.
 		}
 	}
 }
@@ -155,32 +210,67 @@ func (t *SerialTerminal) inputScanLoop() {
 // Line-level interaction with the terminal. The protocol encodes
 // the command as the first character, and the reply of the terminal
 // (which arrives in the responseChannel) echos that character as first char.
-// If that is not the case, we're in some error condition.
+// If that is not the case, we're in some error condition; unless it
+// is an 'E' error reply, which tells us that the terminal is still there,
+// but didn't like the command.
 // This function sends the request and verifies that the response
 // is as expected.
 func (t *SerialTerminal) sendAndAwaitResponse(toSend string) string {
-	_, err := t.serialFile.Write([]byte(toSend + "\n"))
-	if err != nil {
-		t.errorState = true
+	result, err := t.exchange(toSend, responseTimeout)
+	switch {
+	case err == errResponseTimeout:
+		// Terminal should've returned immediately. Timeout: bad.
+		t.status.NoteTimeout(toSend[:1])
+		t.errorState.Store(true)
+		return ""
+	case err != nil:
+		t.status.NoteError("%v", err)
+		t.errorState.Store(true)
+		return ""
+	case result[0] == toSend[0]:
+		return result
+	case result[0] == 'E':
+		result = strings.TrimSpace(result)
+		log.Printf("%s: Error reply to '%c': %s",
+			t.logPrefix, toSend[0], result)
+		t.status.NoteErrorReply(result)
+		return ""
+	default:
+		log.Printf("%s: Unexpected result. Expected '%c', got '%s'",
+			t.logPrefix, toSend[0], result)
+		t.status.NoteError("unexpected reply to '%c': %s",
+			toSend[0], strings.TrimSpace(result))
+		t.errorState.Store(true)
 		return ""
 	}
+}
 
+// Send the request and return whatever comes back first, without drawing
+// conclusions about the state of the connection. Replies that arrived too
+// late for earlier requests are discarded first.
+func (t *SerialTerminal) exchange(toSend string, timeout time.Duration) (string, error) {
+	t.discardResponses()
+	begin := time.Now()
+	if _, err := t.serialFile.Write([]byte(toSend + "\n")); err != nil {
+		return "", fmt.Errorf("writing: %v", err)
+	}
 	select {
 	case result := <-t.responseChannel:
-		if result[0] == toSend[0] {
-			return result
-		} else {
-			log.Printf("%s: Unexpected result. Expected '%c', got '%s'",
-				t.logPrefix, toSend[0], result)
-			t.errorState = true
-			return ""
+		t.status.NoteRoundTrip(time.Since(begin))
+		return result, nil
+	case <-time.After(timeout):
+		return "", errResponseTimeout
+	}
+}
+
+func (t *SerialTerminal) discardResponses() {
+	for {
+		select {
+		case <-t.responseChannel:
+		default:
+			return
 		}
-	case <-time.After(2 * time.Second):
-		// Terminal should've returned immediately. Timeout: bad.
-		t.errorState = true
-		return ""
 	}
-	return "" // make old compiler happy
 }
 
 // Blow out the tubes.
@@ -217,7 +307,7 @@ func (t *SerialTerminal) parseRFIDResponse(from_terminal string) (string, bool)
 // i.e. if connectors are disconnected or plugged around.
 func (t *SerialTerminal) verifyConnected() bool {
 	new_name := t.requestName()
-	if t.errorState {
+	if t.errorState.Load() {
 		log.Printf("%s: Error pinging terminal '%s'",
 			t.logPrefix, t.name)
 		return false
@@ -225,32 +315,29 @@ func (t *SerialTerminal) verifyConnected() bool {
 	if new_name != t.name {
 		log.Printf("%s: Name change ('%s', was '%s')",
 			t.logPrefix, new_name, t.name)
+		t.status.NoteError("name change ('%s', was '%s')", new_name, t.name)
 		return false
 	}
 	return true
 }
 
+// Close the connection. The reader goroutine is finished once this returns.
+// Can be called more than once.
 func (t *SerialTerminal) shutdown() {
-	// Not logging to not trash SD card.
-	//log.Printf("%s: Shutdown '%s'", t.logPrefix, t.GetTerminalName())
-	t.errorState = true
-
-	// TODO: ideally, we want a clean shutdown of the reader
-	// in inputScanLoop() which is blocking at this moment.
-	// We would like to send it a message telling to stop
-	// reading and closing the channel.
-	// However, this doesn't work: reader.ReadString() is blocking and
-	// we can't select on it, thus also not a way to select
-	// in parallel on some <-shutdownRequested channel.
-	// The only chance I see is to close the channel here and
-	// expect the Read() to return with an error (it does not,
-	// immediately,  so the ReaderWriterCloser in the serial package
-	// has to be adapted).
-	// Maybe there is a better solution ?
-	t.serialFile.Close()
+	t.shutdownOnce.Do(func() {
+		// Not logging to not trash SD card.
+		//log.Printf("%s: Shutdown '%s'", t.logPrefix, t.GetTerminalName())
+		t.errorState.Store(true)
+		close(t.closed)
+		// The port is in the runtime poller, so this makes the
+		// pending Read() in inputScanLoop() return.
+		t.serialFile.Close()
+		<-t.readerDone
+	})
 }
 
-// Ask the terminal about its name. Returns true if we ran into a timeout.
+// Ask the terminal about its name. Returns the empty string if there was no
+// answer in time.
 func (t *SerialTerminal) requestName() string {
 	result := t.sendAndAwaitResponse("n")
 	if result == "" {
@@ -258,3 +345,22 @@ func (t *SerialTerminal) requestName() string {
 	}
 	return strings.TrimSpace(result[1:])
 }
+
+// Ask the terminal for its statistics and record them. Older firmware
+// doesn't know the command; then we don't ask again.
+func (t *SerialTerminal) requestStats() {
+	if t.noStats {
+		return
+	}
+	result := t.sendAndAwaitResponse("s")
+	if result == "" {
+		t.noStats = !t.errorState.Load()
+		return
+	}
+	stats, err := parseTerminalStats(strings.TrimSpace(result))
+	if err != nil {
+		log.Printf("%s: %v", t.logPrefix, err)
+		return
+	}
+	t.status.SetStats(stats)
+}
@@ -0,0 +1,421 @@
+//go:build linux
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSerialTerminalProtocol(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, false, nil)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+	ExpectTrue(t, term.GetTerminalName() == "gate", "Terminal name")
+
+	term.WriteLCD(0, "Hello")
+	term.WriteLCD(1, "A line much too long for the LCD")
+	ExpectTrue(t, sim.LCD(0) == "Hello", "LCD row 0")
+	ExpectTrue(t, sim.LCD(1) == "A line much too long for", "LCD row 1")
+
+	// Unchanged content is not sent again.
+	commands := sim.CommandCount()
+	term.WriteLCD(0, "Hello")
+	ExpectTrue(t, sim.CommandCount() == commands, "No repeated LCD write")
+
+	term.ShowColor("RG")
+	ExpectTrue(t, sim.LEDs() == "RG", "LEDs")
+
+	term.BuzzSpeaker("H", 500*time.Millisecond)
+	tones := sim.Tones()
+	ExpectTrue(t, len(tones) == 1 && tones[0] == "H500", "Tone")
+
+	ExpectTrue(t, term.verifyConnected(), "Still connected")
+	ExpectFalse(t, term.errorState.Load(), "No error")
+}
+
+func TestSerialTerminalStats(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	status := newTerminalStatus(sim.Path(), defaultBaudrate)
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, false, status)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+
+	term.requestStats()
+	json := status.Json()
+	ExpectTrue(t, json.Stats["commands-seen"] == uint64(sim.CommandCount()),
+		"Commands seen")
+	ExpectTrue(t, json.RoundTripMs > 0, "Round trip time")
+
+	// Error replies are recorded, but we are still connected.
+	ExpectTrue(t, term.sendAndAwaitResponse("X") == "", "Unknown command")
+	ExpectFalse(t, term.errorState.Load(), "Still fine")
+	json = status.Json()
+	ExpectTrue(t, json.ErrorReplies == 1, "Error reply counted")
+	ExpectTrue(t, strings.HasPrefix(json.LastError, "E Unknown command 'X'"),
+		"Last error")
+
+	// Terminals that don't know 's' are not asked again.
+	sim.DisableStats()
+	term.requestStats()
+	ExpectTrue(t, term.noStats, "No stats")
+	commands := sim.CommandCount()
+	term.requestStats()
+	ExpectTrue(t, sim.CommandCount() == commands, "Not asked again")
+}
+
+func TestSerialTerminalNameChangeDisconnects(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, false, nil)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+
+	term.sendAndAwaitResponse("Nupstairs")
+	term.sendAndAwaitResponse("Nupstairs")
+	ExpectFalse(t, term.verifyConnected(), "Renamed terminal")
+}
+
+func TestSerialTerminalLineCheck(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	status := newTerminalStatus(sim.Path(), defaultBaudrate)
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, false, status)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+
+	ExpectTrue(t, term.checkLineQuality() == 0, "Clean line")
+	json := status.Json()
+	ExpectTrue(t, json.LineErrorRate != nil && *json.LineErrorRate == 0,
+		"Line quality recorded")
+	ExpectTrue(t, json.LineCheckBaud == defaultBaudrate, "Checked baud")
+
+	sim.SetMaxGoodBaud(4800)
+	ExpectTrue(t, term.checkLineQuality() == 1, "Mangled echos")
+	ExpectTrue(t, *status.Json().LineErrorRate == 1, "Bad line recorded")
+
+	// Bad echos don't mean that we lost the terminal.
+	ExpectTrue(t, term.verifyConnected(), "Still connected")
+}
+
+func TestSerialTerminalNegotiatesBaudUp(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	sim.SetMaxGoodBaud(19200)
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, true, nil)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+
+	ExpectTrue(t, term.negotiateBaud() == nil, "Negotiated")
+	ExpectTrue(t, term.baud == 19200, "Fastest clean rate")
+	ExpectTrue(t, sim.Baud() == 19200, "Terminal switched")
+	ExpectTrue(t, sim.StoredBaud() == 19200, "Stored after verification")
+	ExpectTrue(t, term.verifyConnected(), "Still talking")
+}
+
+func TestSerialTerminalNegotiatesBaudDown(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	sim.SetMaxGoodBaud(2400)
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, true, nil)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+
+	ExpectTrue(t, term.negotiateBaud() == nil, "Negotiated")
+	ExpectTrue(t, term.baud == 2400, "Clean rate")
+	ExpectTrue(t, sim.StoredBaud() == 2400, "Stored after verification")
+	ExpectTrue(t, term.verifyConnected(), "Still talking")
+}
+
+func TestSerialTerminalNegotiationNotStoredIfNeverClean(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	sim.SetMaxGoodBaud(100) // Hopeless.
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, true, nil)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+
+	ExpectTrue(t, term.negotiateBaud() == nil, "Negotiated")
+	ExpectTrue(t, term.baud == 300, "Slowest rate")
+	ExpectTrue(t, sim.StoredBaud() == defaultBaudrate, "Nothing stored")
+}
+
+func TestSerialTerminalFindsBaudrate(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	sim.SetBaud(19200)
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, true, nil)
+	if err != nil {
+		sim.Unplug()
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer term.shutdown()
+	defer sim.Unplug()
+	ExpectTrue(t, term.GetTerminalName() == "gate", "Terminal name")
+	ExpectTrue(t, term.baud == 19200, "Found rate")
+}
+
+type SerialDeviceFixture struct {
+	t         *testing.T
+	link      string
+	bus       *ApplicationBus
+	auth      *MockAuthenticator
+	terminals *TerminalRegistry
+	autoBaud  bool
+	events    AppEventChannel
+	stop      chan struct{}
+	done      chan bool
+}
+
+func NewSerialDeviceFixture(t *testing.T) *SerialDeviceFixture {
+	f := &SerialDeviceFixture{
+		t:         t,
+		link:      simulatorLinkPath(t),
+		bus:       NewApplicationBus(),
+		auth:      NewMockAuthenticator(),
+		terminals: NewTerminalRegistry(),
+		events:    make(AppEventChannel, 100),
+		stop:      make(chan struct{}),
+		done:      make(chan bool),
+	}
+	f.bus.Subscribe(f.events)
+	return f
+}
+
+func (f *SerialDeviceFixture) Start() {
+	backends := &Backends{
+		authenticator: f.auth,
+		appEventBus:   f.bus,
+		config:        DefaultConfig(),
+		terminals:     f.terminals,
+	}
+	go func() {
+		handleSerialDevice(f.link, defaultBaudrate, f.autoBaud, backends, f.stop)
+		close(f.done)
+	}()
+}
+
+// Stop handling the device, then pull the plug.
+func (f *SerialDeviceFixture) Stop(sim *TerminalSimulator) {
+	close(f.stop)
+	select {
+	case <-f.done:
+	case <-time.After(simulatorTimeout):
+		f.t.Errorf("handleSerialDevice() did not stop")
+	}
+	sim.Unplug()
+}
+
+// Wait for event, skipping others.
+func (f *SerialDeviceFixture) ExpectEvent(ev AppEventType, target Target) *AppEvent {
+	f.t.Helper()
+	timeout := time.After(simulatorTimeout)
+	for {
+		select {
+		case event := <-f.events:
+			if event.Ev == ev && event.Target == target {
+				return event
+			}
+		case <-timeout:
+			f.t.Fatalf("Timeout waiting for %s for %s", ev, target)
+			return nil
+		}
+	}
+}
+
+func TestHandleSerialDeviceDispatchesByName(t *testing.T) {
+	f := NewSerialDeviceFixture(t)
+	f.auth.allow[ACKey{"c0ffee42", TargetDownstairs}] = AuthOk
+
+	sim := NewTerminalSimulator(t, "gate")
+	linkSimulator(t, sim, f.link)
+	f.Start()
+	f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+	status := f.terminals.List()[0]
+	ExpectTrue(t, status.Name == "gate" && status.Connected, "Terminal status")
+
+	// The gate runs an AccessHandler.
+	sim.SwipeCard("c0ffee42")
+	event := f.ExpectEvent(AppOpenRequest, TargetDownstairs)
+	ExpectTrue(t, event.Source == "gate", "Opened by terminal")
+	sim.ExpectLEDs("G")
+
+	sim.PressKeys("#")
+	f.ExpectEvent(AppDoorbellTriggerEvent, TargetDownstairs)
+
+	f.Stop(sim)
+	f.ExpectEvent(AppTerminalDisconnect, TargetDownstairs)
+}
+
+func TestHandleSerialDeviceControlTerminal(t *testing.T) {
+	f := NewSerialDeviceFixture(t)
+	sim := NewTerminalSimulator(t, "control")
+	linkSimulator(t, sim, f.link)
+	f.Start()
+	f.ExpectEvent(AppTerminalConnect, TargetControlUI)
+
+	// Idle screen of the UIControlHandler.
+	sim.ExpectLCD(0, "      Noisebridge")
+	sim.SwipeCard("12345678")
+	sim.ExpectLCD(0, "Howdy ") // MockAuthenticator user has no name.
+
+	f.Stop(sim)
+}
+
+func TestHandleSerialDeviceReconnects(t *testing.T) {
+	defer func(initial, max time.Duration) {
+		initialReconnectOnErrorTime = initial
+		maxReconnectOnErrorTime = max
+	}(initialReconnectOnErrorTime, maxReconnectOnErrorTime)
+	initialReconnectOnErrorTime = 10 * time.Millisecond
+	maxReconnectOnErrorTime = 40 * time.Millisecond
+
+	f := NewSerialDeviceFixture(t)
+
+	// Terminals with unknown names are not served; we keep retrying.
+	sim := NewTerminalSimulator(t, "mystery")
+	linkSimulator(t, sim, f.link)
+	f.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	// Someone swaps in the gate terminal.
+	sim.Unplug()
+	sim = NewTerminalSimulator(t, "gate")
+	linkSimulator(t, sim, f.link)
+	f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+
+	// Cable pulled and put back.
+	sim.Unplug()
+	f.ExpectEvent(AppTerminalDisconnect, TargetDownstairs)
+	sim = NewTerminalSimulator(t, "upstairs")
+	linkSimulator(t, sim, f.link)
+	f.ExpectEvent(AppTerminalConnect, TargetUpstairs)
+
+	status := f.terminals.List()[0]
+	ExpectTrue(t, status.Name == "upstairs" && status.Connected, "Terminal status")
+	ExpectTrue(t, status.Reconnects >= 2, "Reconnects counted")
+
+	f.Stop(sim)
+}
+
+func TestHandleSerialDeviceAutoBaud(t *testing.T) {
+	f := NewSerialDeviceFixture(t)
+	f.autoBaud = true
+	sim := NewTerminalSimulator(t, "gate")
+	sim.SetBaud(19200)
+	linkSimulator(t, sim, f.link)
+	f.Start()
+	f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+
+	status := f.terminals.List()[0]
+	ExpectTrue(t, status.Baud == 38400, "Negotiated baud rate")
+	ExpectTrue(t, sim.StoredBaud() == 38400, "Stored in terminal")
+	ExpectTrue(t, status.LineErrorRate != nil && *status.LineErrorRate == 0,
+		"Line quality")
+
+	f.Stop(sim)
+}
+
+func TestSerialTerminalShutdownWhileReading(t *testing.T) {
+	sim := NewTerminalSimulator(t, "gate")
+	defer sim.Unplug()
+	term, err := NewSerialTerminal(sim.Path(), defaultBaudrate, false, nil)
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+
+	// The terminal is still there, the reader waits for input.
+	done := make(chan bool)
+	go func() {
+		term.shutdown()
+		term.shutdown() // Harmless.
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(simulatorTimeout):
+		t.Fatal("shutdown() blocks")
+	}
+	ExpectTrue(t, term.errorState.Load(), "Error state after shutdown")
+}
+
+// Best run with -race (make test-race).
+func TestHandleSerialDeviceReconnectsWithoutLeaks(t *testing.T) {
+	defer func(initial, max time.Duration) {
+		initialReconnectOnErrorTime = initial
+		maxReconnectOnErrorTime = max
+	}(initialReconnectOnErrorTime, maxReconnectOnErrorTime)
+	initialReconnectOnErrorTime = 10 * time.Millisecond
+	maxReconnectOnErrorTime = 10 * time.Millisecond
+
+	f := NewSerialDeviceFixture(t)
+	f.bus.Flush() // Subscriber goroutine started.
+	goroutines := runtime.NumGoroutine()
+	sim := NewTerminalSimulator(t, "gate")
+	linkSimulator(t, sim, f.link)
+	f.Start()
+	for i := 0; i < 25; i++ {
+		f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+		sim.SwipeCard("c0ffee42") // Some traffic while pulling the plug.
+		sim.Unplug()
+		f.ExpectEvent(AppTerminalDisconnect, TargetDownstairs)
+		if i%5 == 0 {
+			// Sometimes nobody is there for a while.
+			time.Sleep(50 * time.Millisecond)
+		}
+		sim = NewTerminalSimulator(t, "gate")
+		linkSimulator(t, sim, f.link)
+	}
+	f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+	status := f.terminals.List()[0]
+	ExpectTrue(t, status.Reconnects >= 25, "Reconnects counted")
+
+	// Stopped without pulling the plug first.
+	close(f.stop)
+	select {
+	case <-f.done:
+	case <-time.After(simulatorTimeout):
+		t.Fatal("handleSerialDevice() did not stop")
+	}
+	// Only the simulator is left.
+	ExpectGoroutinesEventually(t, goroutines+1)
+	sim.Unplug()
+}
+
+func TestNewSerialTerminalFailuresWithoutLeaks(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		sim := NewTerminalSimulator(t, "gate")
+		sim.SetBaud(19200) // We can't understand each other.
+		_, err := NewSerialTerminal(sim.Path(), defaultBaudrate, false, nil)
+		ExpectTrue(t, err != nil, "Wrong baud rate")
+		// The simulator is still running, but nothing of earl.
+		ExpectGoroutinesEventually(t, goroutines+1)
+		sim.Unplug()
+	}
+}
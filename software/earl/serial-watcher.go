@@ -0,0 +1,136 @@
+// Watching a directory such as /dev/serial/by-id for serial devices coming
+// and going, so that terminals can be plugged in without restarting earl
+// with another list of devices.
+//
+// For each device appearing, there is a handleSerialDevice() loop, which is
+// stopped once the device is gone again.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const serialWatchInterval = 2 * time.Second
+
+type watchedSerialDevice struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopping bool // stop is closed.
+}
+
+type SerialDeviceWatcher struct {
+	dir      string
+	baud     int
+	autoBaud bool
+	backends *Backends
+
+	lock    sync.Mutex
+	ignore  map[string]bool // Resolved paths handled elsewhere.
+	devices map[string]*watchedSerialDevice
+}
+
+// Watch dir for devices, connecting with the given baud rate.
+func NewSerialDeviceWatcher(dir string, baud int, autoBaud bool, backends *Backends) *SerialDeviceWatcher {
+	return &SerialDeviceWatcher{
+		dir:      dir,
+		baud:     baud,
+		autoBaud: autoBaud,
+		backends: backends,
+		ignore:   make(map[string]bool),
+		devices:  make(map[string]*watchedSerialDevice),
+	}
+}
+
+// Don't handle the device if it shows up, because it is given explicitly
+// on the command line.
+func (w *SerialDeviceWatcher) Ignore(devicepath string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.ignore[resolveDevicePath(devicepath)] = true
+}
+
+// Watch forever. Call in its own goroutine.
+func (w *SerialDeviceWatcher) Run() {
+	for {
+		w.Scan()
+		time.Sleep(serialWatchInterval)
+	}
+}
+
+// Look at the directory once, starting to handle new devices and stopping
+// to handle those that went away.
+func (w *SerialDeviceWatcher) Scan() {
+	present := make(map[string]bool)
+	// The directory itself goes away with the last device; that is just
+	// no devices.
+	entries, err := os.ReadDir(w.dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Watching serial devices: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		present[filepath.Join(w.dir, entry.Name())] = true
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for devicepath, device := range w.devices {
+		select {
+		case <-device.done:
+			// Only forget finished loops; a device coming back
+			// right away must not get a second one meanwhile.
+			delete(w.devices, devicepath)
+			continue
+		default:
+		}
+		if !present[devicepath] && !device.stopping {
+			log.Printf("%s: serial device gone", devicepath)
+			close(device.stop)
+			device.stopping = true
+		}
+	}
+	for devicepath := range present {
+		if _, running := w.devices[devicepath]; running ||
+			w.ignore[resolveDevicePath(devicepath)] {
+			continue
+		}
+		log.Printf("%s: new serial device", devicepath)
+		device := &watchedSerialDevice{
+			stop: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		w.devices[devicepath] = device
+		go func(devicepath string) {
+			handleSerialDevice(devicepath, w.baud, w.autoBaud, w.backends, device.stop)
+			w.backends.terminals.Remove(devicepath)
+			close(device.done)
+		}(devicepath)
+	}
+}
+
+// Stop handling all devices and wait until their loops are finished.
+func (w *SerialDeviceWatcher) Shutdown() {
+	w.lock.Lock()
+	devices := w.devices
+	w.devices = make(map[string]*watchedSerialDevice)
+	w.lock.Unlock()
+	for _, device := range devices {
+		if !device.stopping {
+			close(device.stop)
+		}
+	}
+	for _, device := range devices {
+		<-device.done
+	}
+}
+
+func resolveDevicePath(devicepath string) string {
+	if resolved, err := filepath.EvalSymlinks(devicepath); err == nil {
+		return resolved
+	}
+	return devicepath
+}
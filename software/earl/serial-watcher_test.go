@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func ExpectDevices(t *testing.T, terminals *TerminalRegistry, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(simulatorTimeout); len(terminals.List()) != count; {
+		if time.Now().After(deadline) {
+			t.Errorf("Expected %d devices, got %d", count, len(terminals.List()))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSerialDeviceWatcher(t *testing.T) {
+	f := NewSerialDeviceFixture(t)
+	dir := filepath.Dir(f.link)
+	watcher := NewSerialDeviceWatcher(dir, defaultBaudrate, false, &Backends{
+		authenticator: f.auth,
+		appEventBus:   f.bus,
+		config:        DefaultConfig(),
+		terminals:     f.terminals,
+	})
+
+	// Nothing plugged in yet.
+	watcher.Scan()
+	ExpectDevices(t, f.terminals, 0)
+
+	gate := NewTerminalSimulator(t, "gate")
+	linkSimulator(t, gate, filepath.Join(dir, "usb-gate"))
+	watcher.Scan()
+	f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+
+	upstairs := NewTerminalSimulator(t, "upstairs")
+	linkSimulator(t, upstairs, filepath.Join(dir, "usb-upstairs"))
+	watcher.Scan()
+	f.ExpectEvent(AppTerminalConnect, TargetUpstairs)
+	ExpectDevices(t, f.terminals, 2)
+
+	// Scanning again does not start a second loop for the same device.
+	watcher.Scan()
+	ExpectDevices(t, f.terminals, 2)
+
+	// Unplugging the adapter removes the link.
+	os.Remove(filepath.Join(dir, "usb-gate"))
+	gate.Unplug()
+	watcher.Scan()
+	f.ExpectEvent(AppTerminalDisconnect, TargetDownstairs)
+	ExpectDevices(t, f.terminals, 1)
+	ExpectTrue(t, f.terminals.List()[0].Name == "upstairs", "Upstairs still there")
+
+	// Plugged in again: the new loop starts once the old one is through,
+	// and the old one doesn't remove the status of the new one.
+	gate = NewTerminalSimulator(t, "gate")
+	linkSimulator(t, gate, filepath.Join(dir, "usb-gate"))
+	for deadline := time.Now().Add(simulatorTimeout); len(f.terminals.List()) != 2 &&
+		time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		watcher.Scan()
+	}
+	f.ExpectEvent(AppTerminalConnect, TargetDownstairs)
+	time.Sleep(50 * time.Millisecond)
+	ExpectDevices(t, f.terminals, 2)
+	gate.Unplug()
+
+	upstairs.Unplug()
+	watcher.Shutdown()
+	ExpectDevices(t, f.terminals, 0)
+}
+
+func TestSerialDeviceWatcherIgnoresExplicitDevices(t *testing.T) {
+	f := NewSerialDeviceFixture(t)
+	dir := filepath.Dir(f.link)
+	watcher := NewSerialDeviceWatcher(dir, defaultBaudrate, false, &Backends{
+		authenticator: f.auth,
+		appEventBus:   f.bus,
+		config:        DefaultConfig(),
+		terminals:     f.terminals,
+	})
+
+	sim := NewTerminalSimulator(t, "gate")
+	defer sim.Unplug()
+	watcher.Ignore(sim.Path())
+	linkSimulator(t, sim, filepath.Join(dir, "usb-gate"))
+	watcher.Scan()
+	time.Sleep(100 * time.Millisecond)
+	ExpectDevices(t, f.terminals, 0)
+	watcher.Shutdown()
+}
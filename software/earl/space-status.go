@@ -0,0 +1,237 @@
+// Open-to-public status of the space.
+//
+// If responsible members are in the space, they can declare it open to the
+// public. While open, users also get in outside of their regular access hours.
+//
+// Opening needs a number of members to check in on the control terminal
+// within a short time window; it stays open until closed explicitly. A single
+// member can also open the space alone, but only for a limited time.
+//
+// The state is stored in a small JSON file so that it survives a restart.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Check-ins of members older than this don't count anymore.
+	spaceCheckinWindow = 15 * time.Minute
+
+	defaultOpenSpaceCheckins     = 2
+	defaultOpenSpaceSoloDuration = 3 * time.Hour
+
+	spaceExpiryCheckInterval = 30 * time.Second
+)
+
+// The persisted part of the state.
+type spaceState struct {
+	Open     bool      `json:"open"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"` // Zero: until closed explicitly.
+	OpenedBy []string  `json:"opened_by"`
+}
+
+type spaceCheckin struct {
+	name string
+	when time.Time
+}
+
+type SpaceStatus struct {
+	stateFilename    string // Optional; can be empty.
+	requiredCheckins int
+	soloDuration     time.Duration
+	bus              *ApplicationBus
+	clock            Clock
+
+	lock     sync.Mutex
+	state    spaceState
+	checkins map[string]*spaceCheckin // By hashed code of the member.
+}
+
+func NewSpaceStatus(stateFilename string, requiredCheckins int,
+	soloDuration time.Duration, bus *ApplicationBus) *SpaceStatus {
+	s := &SpaceStatus{
+		stateFilename:    stateFilename,
+		requiredCheckins: requiredCheckins,
+		soloDuration:     soloDuration,
+		bus:              bus,
+		clock:            RealClock{},
+		checkins:         make(map[string]*spaceCheckin),
+	}
+	if stateFilename != "" {
+		if content, err := ioutil.ReadFile(stateFilename); err == nil {
+			if err = json.Unmarshal(content, &s.state); err != nil {
+				log.Printf("Ignoring broken %s: %v", stateFilename, err)
+				s.state = spaceState{}
+			}
+		}
+	}
+	if s.state.Open {
+		log.Printf("Space open since %s by %s",
+			s.state.Since.Format("2006-01-02 15:04"),
+			strings.Join(s.state.OpenedBy, ", "))
+	}
+	return s
+}
+
+// Regularly check if an opening has timed out, so that the closing
+// is announced in time. Call in its own goroutine.
+func (s *SpaceStatus) RunExpiryLoop() {
+	for {
+		time.Sleep(spaceExpiryCheckInterval)
+		s.IsOpen()
+	}
+}
+
+// Is the space currently open to the public ? Can be called on nil
+// SpaceStatus, which is never open.
+func (s *SpaceStatus) IsOpen() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	event := s.expireRequiresLock()
+	open := s.state.Open
+	s.lock.Unlock()
+	s.post(event)
+	return open
+}
+
+// Return if open, and if so, until when (zero time: until closed).
+func (s *SpaceStatus) OpenUntil() (bool, time.Time) {
+	if s == nil {
+		return false, time.Time{}
+	}
+	s.lock.Lock()
+	event := s.expireRequiresLock()
+	open, until := s.state.Open, s.state.Until
+	s.lock.Unlock()
+	s.post(event)
+	return open, until
+}
+
+// A member checks in. If enough members did so within the check-in window,
+// the space is opened. Returns if the space is open now and the number of
+// check-ins so far.
+func (s *SpaceStatus) CheckIn(member *User) (bool, int) {
+	s.lock.Lock()
+	now := s.clock.Now()
+	s.checkins[checkinKey(member)] = &spaceCheckin{name: member.Name, when: now}
+	var names []string
+	for key, checkin := range s.checkins {
+		if now.Sub(checkin.when) > spaceCheckinWindow {
+			delete(s.checkins, key)
+			continue
+		}
+		names = append(names, checkin.name)
+	}
+	var event *AppEvent
+	if len(names) >= s.requiredCheckins {
+		event = s.openRequiresLock(names, time.Time{})
+	}
+	s.lock.Unlock()
+	s.post(event)
+	return event != nil, len(names)
+}
+
+// Members are told apart by their (hashed) code; names need not be unique.
+func checkinKey(member *User) string {
+	if len(member.Codes) == 0 {
+		return member.Name
+	}
+	return member.Codes[0]
+}
+
+// A single member opens the space for the limited solo time.
+func (s *SpaceStatus) OpenSolo(member *User) time.Time {
+	s.lock.Lock()
+	until := s.clock.Now().Add(s.soloDuration)
+	event := s.openRequiresLock([]string{member.Name}, until)
+	s.lock.Unlock()
+	s.post(event)
+	return until
+}
+
+func (s *SpaceStatus) Close(by string) {
+	s.lock.Lock()
+	var event *AppEvent
+	if s.state.Open {
+		event = s.closeRequiresLock("Closed by " + by)
+	}
+	s.lock.Unlock()
+	s.post(event)
+}
+
+// Post the event returned by the ...RequiresLock() functions. Called after
+// unlocking, so that subscribers can ask for the status.
+func (s *SpaceStatus) post(event *AppEvent) {
+	if event != nil {
+		s.bus.Post(event)
+	}
+}
+
+// Returns the event to post.
+func (s *SpaceStatus) openRequiresLock(names []string, until time.Time) *AppEvent {
+	if !s.state.Open {
+		s.state.Since = s.clock.Now()
+	}
+	s.state.Open = true
+	s.state.Until = until
+	s.state.OpenedBy = names
+	s.checkins = make(map[string]*spaceCheckin)
+	s.writeStateRequiresLock()
+
+	msg := "Open to public by " + strings.Join(names, ", ")
+	if !until.IsZero() {
+		msg += fmt.Sprintf(" until %s", until.Format("15:04"))
+	}
+	log.Println(msg)
+	return &AppEvent{
+		Ev:      AppSpaceOpened,
+		Source:  "space-status",
+		Msg:     msg,
+		Timeout: until,
+	}
+}
+
+// Returns the event to post.
+func (s *SpaceStatus) closeRequiresLock(msg string) *AppEvent {
+	s.state = spaceState{}
+	s.writeStateRequiresLock()
+	log.Println("Space closed to public. " + msg)
+	return &AppEvent{
+		Ev:     AppSpaceClosed,
+		Source: "space-status",
+		Msg:    msg,
+	}
+}
+
+// Returns the event to post if the opening timed out, nil otherwise.
+func (s *SpaceStatus) expireRequiresLock() *AppEvent {
+	if s.state.Open && !s.state.Until.IsZero() &&
+		!s.clock.Now().Before(s.state.Until) {
+		return s.closeRequiresLock("Timeout")
+	}
+	return nil
+}
+
+func (s *SpaceStatus) writeStateRequiresLock() {
+	if s.stateFilename == "" {
+		return
+	}
+	content, _ := json.Marshal(&s.state)
+	tmpFilename := s.stateFilename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, content, 0644); err != nil {
+		log.Printf("Could not write %s: %v", tmpFilename, err)
+		return
+	}
+	os.Rename(tmpFilename, s.stateFilename)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpaceOpensWithEnoughCheckins(t *testing.T) {
+	mockClock := &MockClock{}
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	space := NewSpaceStatus("", 2, time.Hour, bus)
+	space.clock = mockClock
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(20 * time.Hour)
+	alice := &User{Name: "Alice", UserLevel: LevelMember}
+	alice.SetAuthCode("alice123")
+	bob := &User{Name: "Bob", UserLevel: LevelMember}
+	bob.SetAuthCode("bob12345")
+
+	open, count := space.CheckIn(alice)
+	ExpectFalse(t, open, "One member is not enough")
+	ExpectTrue(t, count == 1, "One check-in")
+
+	// Checking in twice does not count.
+	open, count = space.CheckIn(alice)
+	ExpectFalse(t, open || count != 1, "Same member twice")
+
+	// Check-ins expire.
+	mockClock.now = mockClock.now.Add(spaceCheckinWindow + time.Minute)
+	open, count = space.CheckIn(bob)
+	ExpectFalse(t, open || count != 1, "Alice' check-in expired")
+
+	open, count = space.CheckIn(alice)
+	ExpectTrue(t, open && count == 2, "Two members open the space")
+	ExpectTrue(t, space.IsOpen(), "Space is open")
+
+	// Opened by enough members: no timeout.
+	mockClock.now = mockClock.now.Add(24 * time.Hour)
+	ExpectTrue(t, space.IsOpen(), "Still open next day")
+
+	space.Close("Alice")
+	ExpectFalse(t, space.IsOpen(), "Closed")
+
+	// Members are told apart by code, not by name.
+	otherAlice := &User{Name: "Alice", UserLevel: LevelMember}
+	otherAlice.SetAuthCode("alice456")
+	space.CheckIn(alice)
+	open, count = space.CheckIn(otherAlice)
+	ExpectTrue(t, open && count == 2, "Two members with the same name")
+
+	bus.Flush()
+	ExpectTrue(t, (<-events).Ev == AppSpaceOpened, "Opened event")
+	ExpectTrue(t, (<-events).Ev == AppSpaceClosed, "Closed event")
+	ExpectTrue(t, (<-events).Ev == AppSpaceOpened, "Opened again")
+}
+
+func TestSpaceSoloOpeningTimesOut(t *testing.T) {
+	mockClock := &MockClock{}
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	space := NewSpaceStatus("", 2, time.Hour, bus)
+	space.clock = mockClock
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(20 * time.Hour)
+	until := space.OpenSolo(&User{Name: "Alice", UserLevel: LevelMember})
+	ExpectTrue(t, until.Equal(mockClock.now.Add(time.Hour)), "Solo duration")
+	ExpectTrue(t, space.IsOpen(), "Open")
+
+	mockClock.now = mockClock.now.Add(time.Hour)
+	ExpectFalse(t, space.IsOpen(), "Timed out")
+
+	bus.Flush()
+	ExpectTrue(t, (<-events).Ev == AppSpaceOpened, "Opened event")
+	closeEvent := <-events
+	ExpectTrue(t, closeEvent.Ev == AppSpaceClosed && closeEvent.Msg == "Timeout",
+		"Closed by timeout")
+}
+
+func TestSpaceStatusPersisted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test-space-status")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	stateFile := filepath.Join(dir, "space.json")
+
+	space := NewSpaceStatus(stateFile, 1, time.Hour, NewApplicationBus())
+	space.CheckIn(&User{Name: "Alice", UserLevel: LevelMember})
+	ExpectTrue(t, space.IsOpen(), "Single check-in needed")
+
+	space = NewSpaceStatus(stateFile, 1, time.Hour, NewApplicationBus())
+	ExpectTrue(t, space.IsOpen(), "Still open after restart")
+
+	space.Close("Alice")
+	space = NewSpaceStatus(stateFile, 1, time.Hour, NewApplicationBus())
+	ExpectFalse(t, space.IsOpen(), "Still closed after restart")
+}
+
+func TestOpenSpaceAllowsUsersOutsideTime(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "open-space-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth.space = NewSpaceStatus("", 1, time.Hour, NewApplicationBus())
+	auth.space.clock = mockClock
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+
+	u = User{
+		Name:        "User on Hiatus",
+		ContactInfo: "gone@fishing.net",
+		UserLevel:   LevelHiatus}
+	u.SetAuthCode("hiatus123")
+	auth.AddNewUser("root123", u)
+
+	u = User{
+		Name:        "Class participant",
+		ContactInfo: "class@noisebridge.net",
+		UserLevel:   LevelUser,
+		Targets:     []Target{TargetDownstairs}}
+	u.Schedule, _ = ParseSchedule("Fri 18-22")
+	u.SetAuthCode("class123")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = someMidnight.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside")
+
+	auth.space.OpenSolo(&User{Name: "root"})
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "hiatus123", TargetUpstairs, AuthFail, "hiatus")
+
+	// Open only widens the hours of the level, not custom schedules,
+	// targets or closures.
+	ExpectAuthResult(t, auth, "class123", TargetDownstairs,
+		AuthOkButOutsideTime, "outside Fri 18-22")
+	ExpectAuthResult(t, auth, "class123", TargetUpstairs,
+		AuthTargetDenied, "no access")
+	closureFile := CreateClosureFile("2014-10-10,2014-10-10,user,,Cleaning day\n")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(closureFile)
+	}
+	auth.closures = NewClosureCalendar(closureFile)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "closure")
+	auth.closures = nil
+
+	mockClock.now = mockClock.now.Add(2 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside")
+}
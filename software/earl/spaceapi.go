@@ -0,0 +1,194 @@
+// SpaceAPI (https://spaceapi.io/) endpoint /spaceapi.json, so that the
+// open/closed state of the space shows up in the SpaceAPI directory, apps
+// and on the website without anyone updating it by hand.
+//
+// The static fields (space, logo, url, location, contact, ...) come from the
+// spaceapi section of the -config file; they are passed on as they are:
+//
+//	spaceapi:
+//	  space: Noisebridge
+//	  logo: https://www.noisebridge.net/logo.png
+//	  url: https://www.noisebridge.net/
+//	  location:
+//	    address: 272 Capp St, San Francisco, CA 94110, USA
+//	    lat: 37.7625
+//	    lon: -122.4189
+//	  contact:
+//	    email: info@noisebridge.net
+//
+// The state is kept up to date from the events on the ApplicationBus:
+// open to public or not (see space-status.go), and, as extensions, the doors
+// (door sensors and open requests) and the doorbells.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fields the SpaceAPI schema requires in the static configuration.
+var spaceApiRequiredFields = []string{"space", "logo", "url", "location", "contact"}
+
+type spaceApiDoor struct {
+	Location   Target `json:"location"`
+	Value      string `json:"value,omitempty"` // open, closed; if there is a sensor
+	LastChange int64  `json:"lastchange,omitempty"`
+	LastOpened int64  `json:"last_open_request,omitempty"`
+}
+
+type spaceApiBell struct {
+	Location    Target `json:"location"`
+	LastRung    int64  `json:"last_rung,omitempty"`
+	HushedUntil int64  `json:"hushed_until,omitempty"`
+}
+
+type SpaceApi struct {
+	static    map[string]interface{}
+	clock     Clock
+	appEvents AppEventChannel
+
+	lock       sync.Mutex
+	open       bool
+	openUntil  time.Time
+	lastChange time.Time
+	doors      map[Target]*spaceApiDoor
+	bells      map[Target]*spaceApiBell
+}
+
+// Starts with the state of the space status; call Run() to follow changes.
+func NewSpaceApi(static map[string]interface{}, space *SpaceStatus, bus *ApplicationBus) *SpaceApi {
+	s := &SpaceApi{
+		static:     static,
+		clock:      RealClock{},
+		appEvents:  make(AppEventChannel, 10),
+		lastChange: time.Now(),
+		doors:      make(map[Target]*spaceApiDoor),
+		bells:      make(map[Target]*spaceApiBell),
+	}
+	s.open, s.openUntil = space.OpenUntil()
+	// Whatever happened before is in the history.
+	bus.Subscribe(s.appEvents, SubscriberName("spaceapi"), ReplaySince(0),
+		OnlyEvents(AppSpaceOpened, AppSpaceClosed, AppDoorSensorEvent,
+			AppOpenRequest, AppDoorbellTriggerEvent, AppHushBellRequest))
+	return s
+}
+
+// Follow the events on the bus. Call in its own goroutine.
+func (s *SpaceApi) Run() {
+	for event := range s.appEvents {
+		s.handleEvent(event)
+	}
+}
+
+func (s *SpaceApi) door(target Target) *spaceApiDoor {
+	if s.doors[target] == nil {
+		s.doors[target] = &spaceApiDoor{Location: target}
+	}
+	return s.doors[target]
+}
+
+func (s *SpaceApi) bell(target Target) *spaceApiBell {
+	if s.bells[target] == nil {
+		s.bells[target] = &spaceApiBell{Location: target}
+	}
+	return s.bells[target]
+}
+
+func (s *SpaceApi) handleEvent(event *AppEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch event.Ev {
+	case AppSpaceOpened:
+		if !s.open {
+			s.lastChange = event.Timestamp
+		}
+		s.open = true
+		s.openUntil = event.Timeout
+	case AppSpaceClosed:
+		if s.open {
+			s.lastChange = event.Timestamp
+		}
+		s.open = false
+	case AppDoorSensorEvent:
+		door := s.door(event.Target)
+		door.Value = "closed"
+		if event.Value != 0 {
+			door.Value = "open"
+		}
+		door.LastChange = event.Timestamp.Unix()
+	case AppOpenRequest:
+		s.door(event.Target).LastOpened = event.Timestamp.Unix()
+	case AppDoorbellTriggerEvent:
+		s.bell(event.Target).LastRung = event.Timestamp.Unix()
+	case AppHushBellRequest:
+		s.bell(event.Target).HushedUntil = event.Timeout.Unix()
+	}
+}
+
+// The whole document: static fields with the current state.
+func (s *SpaceApi) document() map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range s.static {
+		result[key] = value
+	}
+	if _, exists := result["api_compatibility"]; !exists {
+		result["api_compatibility"] = []string{"14", "15"}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.clock.Now()
+	open := s.open && (s.openUntil.IsZero() || now.Before(s.openUntil))
+	state := map[string]interface{}{
+		"open":       open,
+		"lastchange": s.lastChange.Unix(),
+	}
+	if open && !s.openUntil.IsZero() {
+		state["message"] = "open until " + s.openUntil.Format("15:04")
+	}
+	result["state"] = state
+
+	sensors := make(map[string]interface{})
+	if static, ok := s.static["sensors"].(map[string]interface{}); ok {
+		for key, value := range static {
+			sensors[key] = value
+		}
+	}
+	doors := []spaceApiDoor{}
+	for _, door := range s.doors {
+		doors = append(doors, *door)
+	}
+	sort.Slice(doors, func(i, j int) bool {
+		return doors[i].Location < doors[j].Location
+	})
+	sensors["ext_doors"] = doors
+	bells := []spaceApiBell{}
+	for _, bell := range s.bells {
+		current := *bell
+		if current.HushedUntil <= now.Unix() {
+			current.HushedUntil = 0 // Not hushed anymore.
+		}
+		bells = append(bells, current)
+	}
+	sort.Slice(bells, func(i, j int) bool {
+		return bells[i].Location < bells[j].Location
+	})
+	sensors["ext_doorbells"] = bells
+	result["sensors"] = sensors
+	return result
+}
+
+func (s *SpaceApi) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// SpaceAPI clients run in all kinds of browsers.
+	out.Header()["Access-Control-Allow-Origin"] = []string{"*"}
+	out.Header()["Content-Type"] = []string{"application/json"}
+	out.Header()["Cache-Control"] = []string{"no-cache"}
+	json.NewEncoder(out).Encode(s.document())
+}
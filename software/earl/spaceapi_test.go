@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSpaceApiConfig = `
+targets:
+  - name: gate
+spaceapi:
+  space: Noisebridge
+  logo: https://www.noisebridge.net/logo.png
+  url: https://www.noisebridge.net/
+  location:
+    address: 272 Capp St, San Francisco
+    lat: 37.7625
+    lon: -122.4189
+  contact:
+    email: info@noisebridge.net
+`
+
+// Get the document as the clients see it.
+func getSpaceApi(t *testing.T, spaceApi *SpaceApi) map[string]interface{} {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	spaceApi.ServeHTTP(recorder, httptest.NewRequest("GET", "/spaceapi.json", nil))
+	ExpectTrue(t, recorder.Code == http.StatusOK, "Status")
+	var document map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+// Wait until the events are processed.
+func waitForSpaceApi(t *testing.T, spaceApi *SpaceApi, condition func(map[string]interface{}) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(asyncTestTimeout); !condition(getSpaceApi(t, spaceApi)); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for events to be processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSpaceApi(t *testing.T) {
+	config, err := ParseConfig([]byte(testSpaceApiConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &MockClock{now: time.Date(2026, 10, 1, 20, 0, 0, 0, time.UTC)}
+	bus := NewApplicationBus()
+	// Happened before we started.
+	bus.Post(&AppEvent{Ev: AppDoorSensorEvent, Target: TargetDownstairs, Value: 1})
+	spaceApi := NewSpaceApi(config.SpaceApi, nil, bus)
+	spaceApi.clock = clock
+	go spaceApi.Run()
+
+	document := getSpaceApi(t, spaceApi)
+	ExpectTrue(t, document["space"] == "Noisebridge", "Static field")
+	location := document["location"].(map[string]interface{})
+	ExpectTrue(t, location["lat"] == 37.7625, "Nested static field")
+	state := document["state"].(map[string]interface{})
+	ExpectTrue(t, state["open"] == false, "Closed")
+
+	until := clock.now.Add(3 * time.Hour)
+	bus.Post(&AppEvent{Ev: AppSpaceOpened, Timestamp: clock.now, Timeout: until,
+		Msg: "Open to public by alice"})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs,
+		Timestamp: clock.now})
+	bus.Post(&AppEvent{Ev: AppHushBellRequest, Target: TargetDownstairs,
+		Timeout: clock.now.Add(time.Minute)})
+	bus.Flush()
+	waitForSpaceApi(t, spaceApi, func(document map[string]interface{}) bool {
+		bells := document["sensors"].(map[string]interface{})["ext_doorbells"].([]interface{})
+		return len(bells) == 1 && bells[0].(map[string]interface{})["hushed_until"] != nil
+	})
+
+	document = getSpaceApi(t, spaceApi)
+	state = document["state"].(map[string]interface{})
+	ExpectTrue(t, state["open"] == true, "Open")
+	ExpectTrue(t, state["lastchange"] == float64(clock.now.Unix()), "Last change")
+	ExpectTrue(t, state["message"] == "open until 23:00", "Message without names")
+	sensors := document["sensors"].(map[string]interface{})
+	doors := sensors["ext_doors"].([]interface{})
+	ExpectTrue(t, len(doors) == 1, "Door")
+	door := doors[0].(map[string]interface{})
+	ExpectTrue(t, door["location"] == "gate" && door["value"] == "open", "Door sensor")
+	bell := sensors["ext_doorbells"].([]interface{})[0].(map[string]interface{})
+	ExpectTrue(t, bell["last_rung"] == float64(clock.now.Unix()), "Doorbell")
+	ExpectTrue(t, bell["hushed_until"] == float64(clock.now.Add(time.Minute).Unix()),
+		"Hushed")
+
+	// Solo opening times out.
+	clock.now = until
+	document = getSpaceApi(t, spaceApi)
+	ExpectTrue(t, document["state"].(map[string]interface{})["open"] == false,
+		"Expired")
+	bell = document["sensors"].(map[string]interface{})["ext_doorbells"].([]interface{})[0].(map[string]interface{})
+	ExpectTrue(t, bell["hushed_until"] == nil, "Not hushed anymore")
+}
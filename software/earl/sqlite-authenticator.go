@@ -0,0 +1,517 @@
+// An Authenticator that keeps the users in an embedded SQLite database.
+//
+// Compared to the FileBasedAuthenticator, lookups of codes go through an
+// index and modifications are done in transactions instead of rewriting the
+// whole CSV file. The downside is, that the database is not hand-editable
+// anymore, so there is a one-shot import from the CSV file to migrate.
+//
+// The users are stored in the same way as in the CSV file: names, levels etc.
+// in the 'users' table and all the (hashed) codes in the 'codes' table,
+// which refer to their user.
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure go, no cgo needed for cross-compile.
+)
+
+const sqliteUserSchema = `
+CREATE TABLE IF NOT EXISTS users (
+  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+  name         TEXT NOT NULL DEFAULT '',
+  contact_info TEXT NOT NULL DEFAULT '',
+  level        TEXT NOT NULL,
+  sponsors     TEXT NOT NULL DEFAULT '', -- semicolon separated hashed codes
+  valid_from   INTEGER,                  -- unix time; NULL if not set
+  valid_to     INTEGER
+);
+CREATE TABLE IF NOT EXISTS codes (
+  code    TEXT PRIMARY KEY,              -- hashAuthCode()
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS codes_by_user ON codes(user_id);
+`
+
+var errDuplicateCode = errors.New("Duplicate codes while adding user")
+
+// Schema changes after the initial version. The database remembers in its
+// user_version how many of these have been applied.
+var sqliteUserMigrations = []string{
+	// 1: custom schedule and allowed targets.
+	`ALTER TABLE users ADD COLUMN schedule TEXT NOT NULL DEFAULT '';
+	 ALTER TABLE users ADD COLUMN targets  TEXT NOT NULL DEFAULT ''; -- semicolon separated`,
+	// 2: limited-use codes.
+	`ALTER TABLE users ADD COLUMN uses_left INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// Columns in the sequence scanUser() expects them.
+const sqliteUserColumns = "users.id, name, contact_info, level, sponsors, valid_from, valid_to, schedule, targets, uses_left"
+
+type SQLiteAuthenticator struct {
+	dbFilename string
+	db         *sql.DB
+
+	eventBus *ApplicationBus
+	clock    Clock // Our source of time. Useful for simulated clock in tests
+
+	AccessRules
+}
+
+func NewSQLiteAuthenticator(dbFilename string, bus *ApplicationBus) *SQLiteAuthenticator {
+	if dbFilename == "" {
+		log.Println("User database not provided")
+		return nil
+	}
+	db, err := sql.Open("sqlite", "file:"+dbFilename+
+		"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		log.Println("Could not open user database", err)
+		return nil
+	}
+	// Transactions are serialized through a single connection; SQLite
+	// can't do concurrent writes anyway.
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteUserSchema); err != nil {
+		log.Println("Could not create user database schema", err)
+		db.Close()
+		return nil
+	}
+	if err = migrateSQLiteSchema(db); err != nil {
+		log.Println("Could not migrate user database schema", err)
+		db.Close()
+		return nil
+	}
+	a := &SQLiteAuthenticator{
+		dbFilename: dbFilename,
+		db:         db,
+		eventBus:   bus,
+		clock:      RealClock{},
+	}
+	var count int
+	a.db.QueryRow("SELECT count(*) FROM users").Scan(&count)
+	log.Printf("Opened %s with %d users", dbFilename, count)
+	return a
+}
+
+func migrateSQLiteSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteUserMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteUserMigrations[version]); err == nil {
+			// Pragmas don't take parameters.
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version=%d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *SQLiteAuthenticator) Close() {
+	a.db.Close()
+}
+
+func (a *SQLiteAuthenticator) FindUser(plain_code string) *User {
+	user, _, err := a.findUser(a.db, plain_code)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("%s: lookup failed: %v", a.dbFilename, err)
+	}
+	return user
+}
+
+// Iterate through users. The users are a copy, you can't modify them.
+func (a *SQLiteAuthenticator) IterateUsers(callback func(user User)) {
+	rows, err := a.db.Query("SELECT " + sqliteUserColumns +
+		" FROM users ORDER BY id")
+	if err != nil {
+		log.Printf("%s: listing users: %v", a.dbFilename, err)
+		return
+	}
+	var users []*User
+	var ids []int64
+	for rows.Next() {
+		user, id, err := scanUser(rows)
+		if err != nil {
+			log.Printf("%s: listing users: %v", a.dbFilename, err)
+			break
+		}
+		users = append(users, user)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	// Codes are fetched after the users, as we only have one connection.
+	for i, user := range users {
+		if user.Codes, err = readCodes(a.db, ids[i]); err != nil {
+			log.Printf("%s: listing users: %v", a.dbFilename, err)
+			return
+		}
+		callback(*user)
+	}
+}
+
+// AuthUser checks if access for a given code is granted to a given Target.
+func (a *SQLiteAuthenticator) AuthUser(code string, target Target) (result AuthResult, message string) {
+	defer func() {
+		authCounter.WithLabelValues(target.String(), result.String()).Inc()
+	}()
+
+	if !hasMinimalCodeRequirements(code) {
+		return AuthFail, "Auth failed: too short code."
+	}
+	now := a.clock.Now()
+	// Decide and count the use of a limited-use code in the same
+	// transaction, so that no use is handed out twice.
+	err := a.inTransaction(func(tx *sql.Tx) error {
+		user, id, err := a.findUser(tx, code)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		result, message = a.authorizeUser(user, target, now)
+		if result != AuthOk || !user.ConsumeUse(now) {
+			return nil
+		}
+		_, err = tx.Exec("UPDATE users SET uses_left=?, valid_to=? WHERE id=?",
+			user.UsesLeft, unixOrNull(user.ValidTo), id)
+		return err
+	})
+	if err != nil {
+		log.Printf("%s: authenticating: %v", a.dbFilename, err)
+		return AuthFail, "Auth failed: database error."
+	}
+	return result, message
+}
+
+func (a *SQLiteAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return false, auth_msg
+	}
+
+	// We remember the sponsor who added the user.
+	user.Sponsors = []string{hashAuthCode(authentication_code)}
+	// If no valid from date is given, then this is creation time.
+	if user.ValidFrom.IsZero() {
+		user.ValidFrom = a.clock.Now()
+	}
+
+	err := a.inTransaction(func(tx *sql.Tx) error {
+		return insertUser(tx, &user)
+	})
+	if err != nil {
+		return false, err.Error()
+	}
+
+	postUserEvent(a.eventBus, AppUserAdded, &user)
+	return true, ""
+}
+
+// Note, the updater_fun is called while we're in the middle of a transaction,
+// so it must not call back into the authenticator.
+func (a *SQLiteAuthenticator) UpdateUser(authentication_code string,
+	user_code string, updater_fun ModifyFun) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelModify); !auth_ok {
+		return false, auth_msg
+	}
+
+	var modified *User
+	err := a.inTransaction(func(tx *sql.Tx) error {
+		user, id, err := a.findUser(tx, user_code)
+		if err == sql.ErrNoRows {
+			return errors.New("No user for code.")
+		} else if err != nil {
+			return err
+		}
+		if !updater_fun(user) {
+			return errors.New("Update abort.")
+		}
+		_, err = tx.Exec("UPDATE users SET name=?, contact_info=?, level=?,"+
+			" sponsors=?, valid_from=?, valid_to=?, schedule=?, targets=?,"+
+			" uses_left=? WHERE id=?",
+			user.Name, user.ContactInfo, string(user.UserLevel),
+			strings.Join(user.Sponsors, ";"),
+			unixOrNull(user.ValidFrom), unixOrNull(user.ValidTo),
+			user.Schedule.String(), joinTargets(user.Targets),
+			user.UsesLeft, id)
+		if err != nil {
+			return err
+		}
+		// The codes might've been modified: replace all of them.
+		if _, err = tx.Exec("DELETE FROM codes WHERE user_id=?", id); err != nil {
+			return err
+		}
+		if err = insertCodes(tx, id, user.Codes); err != nil {
+			return err
+		}
+		modified = user
+		return nil
+	})
+	if err != nil {
+		return false, err.Error()
+	}
+
+	postUserEvent(a.eventBus, AppUserUpdated, modified)
+	return true, ""
+}
+
+func (a *SQLiteAuthenticator) DeleteUser(
+	authentication_code string, user_code string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return false, auth_msg
+	}
+
+	var deleted *User
+	err := a.inTransaction(func(tx *sql.Tx) error {
+		user, id, err := a.findUser(tx, user_code)
+		if err != nil {
+			return errors.New("Delete failed")
+		}
+		// Codes are removed by the ON DELETE CASCADE
+		if _, err = tx.Exec("DELETE FROM users WHERE id=?", id); err != nil {
+			return err
+		}
+		deleted = user
+		return nil
+	})
+	if err != nil {
+		return false, err.Error()
+	}
+
+	postUserEvent(a.eventBus, AppUserDeleted, deleted)
+	return true, ""
+}
+
+// One-shot import of the users from a CSV file as read by the
+// FileBasedAuthenticator. Only works on an empty database, so that
+// running it twice does not mess things up.
+// Returns number of users imported.
+func (a *SQLiteAuthenticator) ImportCSV(csvFilename string) (int, error) {
+	f, err := os.Open(csvFilename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1 //variable length fields
+
+	total := 0
+	err = a.inTransaction(func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRow("SELECT count(*) FROM users").Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%s already contains %d users",
+				a.dbFilename, count)
+		}
+		for {
+			line, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err // Don't import half of the file.
+			}
+			user := NewUserFromCSVLine(line)
+			if user == nil {
+				continue // e.g. due to comment or short line
+			}
+			if user.broken != "" {
+				// We'd lose what is in the broken fields.
+				return fmt.Errorf("entry for '%s' is broken (%s); please fix first",
+					user.Name, user.broken)
+			}
+			err = insertUser(tx, user)
+			if err == errDuplicateCode {
+				// Same as the file-based one: ignore duplicates.
+				// Nothing is inserted yet then.
+				log.Printf("Skipping '%s': %v", user.Name, err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("entry for '%s': %v", user.Name, err)
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Given a test function for the user level, test if operation is allowed
+func (a *SQLiteAuthenticator) verifyOpAllowed(auth_code string, isOpAllowed func(Level) bool) (bool, string) {
+	return verifyMemberOpAllowed(a.FindUser(auth_code), isOpAllowed,
+		a.clock.Now())
+}
+
+// Run the given function in a transaction. Commits if it returns nil,
+// otherwise the transaction is rolled back and the error returned.
+func (a *SQLiteAuthenticator) inTransaction(op func(tx *sql.Tx) error) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = op(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Something we can run queries on: the database or a transaction.
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Find user by plain code. Returns the user including all codes and the
+// database id. Returns sql.ErrNoRows if there is no such user.
+func (a *SQLiteAuthenticator) findUser(q sqlQueryer, plain_code string) (*User, int64, error) {
+	user, id, err := scanUser(q.QueryRow("SELECT "+sqliteUserColumns+
+		" FROM users JOIN codes ON codes.user_id = users.id"+
+		" WHERE codes.code = ?", hashAuthCode(plain_code)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if user.Codes, err = readCodes(q, id); err != nil {
+		return nil, 0, err
+	}
+	return user, id, nil
+}
+
+func readCodes(q sqlQueryer, user_id int64) ([]string, error) {
+	rows, err := q.Query("SELECT code FROM codes WHERE user_id=? ORDER BY rowid", user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err = rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// Either *sql.Row or *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan the sqliteUserColumns into a user. Does not fill the codes.
+func scanUser(row sqlScanner) (*User, int64, error) {
+	var id int64
+	var level, sponsors, schedule, targets string
+	var validFrom, validTo sql.NullInt64
+	user := &User{}
+	err := row.Scan(&id, &user.Name, &user.ContactInfo, &level,
+		&sponsors, &validFrom, &validTo, &schedule, &targets, &user.UsesLeft)
+	if err != nil {
+		return nil, 0, err
+	}
+	if user.Schedule, err = ParseSchedule(schedule); err != nil {
+		return nil, 0, err
+	}
+	if targets != "" {
+		for _, target := range strings.Split(targets, ";") {
+			user.Targets = append(user.Targets, Target(target))
+		}
+	}
+	user.UserLevel = Level(level)
+	if sponsors != "" {
+		user.Sponsors = strings.Split(sponsors, ";")
+	}
+	if validFrom.Valid {
+		user.ValidFrom = time.Unix(validFrom.Int64, 0)
+	}
+	if validTo.Valid {
+		user.ValidTo = time.Unix(validTo.Int64, 0)
+	}
+	return user, id, nil
+}
+
+func insertUser(tx *sql.Tx, user *User) error {
+	// Check codes first, so that we don't leave a user without codes behind.
+	seen := make(map[string]bool)
+	for _, code := range user.Codes {
+		if seen[code] {
+			return errDuplicateCode
+		}
+		seen[code] = true
+		if err := verifyCodeUnused(tx, code); err != nil {
+			return err
+		}
+	}
+	result, err := tx.Exec("INSERT INTO users (name, contact_info, level,"+
+		" sponsors, valid_from, valid_to, schedule, targets, uses_left)"+
+		" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		user.Name, user.ContactInfo, string(user.UserLevel),
+		strings.Join(user.Sponsors, ";"),
+		unixOrNull(user.ValidFrom), unixOrNull(user.ValidTo),
+		user.Schedule.String(), joinTargets(user.Targets), user.UsesLeft)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return insertCodes(tx, id, user.Codes)
+}
+
+// Add codes for user. Fails if any of the codes is already in use.
+func insertCodes(tx *sql.Tx, user_id int64, codes []string) error {
+	for _, code := range codes {
+		if err := verifyCodeUnused(tx, code); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO codes (code, user_id) VALUES (?, ?)",
+			code, user_id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyCodeUnused(tx *sql.Tx, code string) error {
+	var other int64
+	err := tx.QueryRow("SELECT user_id FROM codes WHERE code=?", code).Scan(&other)
+	if err == nil {
+		return errDuplicateCode
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+func unixOrNull(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
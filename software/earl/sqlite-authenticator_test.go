@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SQLite authenticator in a fresh temp directory, seeded with one root-user.
+func CreateSimpleSQLiteAuth(t *testing.T, clock Clock) (*SQLiteAuthenticator, string) {
+	dir, _ := ioutil.TempDir("", "test-sqlite-auth")
+	csvFile, _ := os.Create(filepath.Join(dir, "users.csv"))
+	csvFile.WriteString("# Comment\n")
+	rootUser := User{
+		Name:        "root",
+		ContactInfo: "root@nb",
+		UserLevel:   "member"}
+	rootUser.SetAuthCode("root123")
+	writer := csv.NewWriter(csvFile)
+	rootUser.WriteCSV(writer)
+	writer.Flush()
+	csvFile.Close()
+
+	auth := NewSQLiteAuthenticator(filepath.Join(dir, "users.db"), NewApplicationBus())
+	if auth == nil {
+		t.Fatal("Could not create SQLite authenticator")
+	}
+	auth.clock = clock
+	count, err := auth.ImportCSV(csvFile.Name())
+	if err != nil || count != 1 {
+		t.Fatalf("Expected to import root user, got %d (%v)", count, err)
+	}
+	return auth, dir
+}
+
+func TestSQLiteAddUser(t *testing.T) {
+	auth, dir := CreateSimpleSQLiteAuth(t, RealClock{})
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Didn't expect non-existent code to work")
+
+	u := User{
+		Name:      "Jon Doe",
+		UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("non-existent member", u)),
+		"Adding new user with non-existent code.")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)),
+		"Add user with valid member account")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("root123", u)),
+		"Adding user with code already in use.")
+
+	found := auth.FindUser("doe123")
+	if found == nil || found.Name != "Jon Doe" {
+		t.Fatalf("Didn't find user for code")
+	}
+	ExpectTrue(t, len(found.Sponsors) == 1 && found.Sponsors[0] == hashAuthCode("root123"),
+		"Sponsor should be recorded")
+	ExpectFalse(t, found.ValidFrom.IsZero(), "ValidFrom should be set")
+
+	u.Name = "Another,user;[]funny\"characters '"
+	u.SetAuthCode("other123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)),
+		"Adding another user with unique code.")
+
+	u.Name = "Shouldnotbeadded"
+	u.SetAuthCode("shouldfail")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("doe123", u)),
+		"John Doe may not add users")
+
+	// Everything should be persisted when re-opening.
+	auth.Close()
+	auth = NewSQLiteAuthenticator(filepath.Join(dir, "users.db"), NewApplicationBus())
+	defer auth.Close()
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Finding root123")
+	ExpectTrue(t, auth.FindUser("doe123") != nil, "Finding doe123")
+	ExpectTrue(t, auth.FindUser("other123") != nil, "Finding other123")
+	ExpectTrue(t, auth.FindUser("shouldfail") == nil, "Not finding shouldfail")
+
+	count := 0
+	auth.IterateUsers(func(user User) { count++ })
+	ExpectTrue(t, count == 3, "Iterating over all users")
+}
+
+func TestSQLiteUpdateUser(t *testing.T) {
+	auth, dir := CreateSimpleSQLiteAuth(t, RealClock{})
+	defer auth.Close()
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	u := User{
+		Name:      "Jon Doe",
+		UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+
+	u.Name = "Jon Philanthropist"
+	u.UserLevel = LevelPhilanthropist
+	u.SetAuthCode("phil123")
+	auth.AddNewUser("root123", u)
+
+	ExpectFalse(t, eatmsg(auth.UpdateUser("doe123", "doe123", func(user *User) bool { return true })),
+		"Regular user attempted to update")
+	ExpectTrue(t, eatmsg(auth.UpdateUser("phil123", "doe123", func(user *User) bool { return true })),
+		"Philanthropist should be able to update")
+	ExpectFalse(t, eatmsg(auth.UpdateUser("root123", "doe123", func(user *User) bool { return false })),
+		"Updater discarding change")
+	ExpectFalse(t, eatmsg(auth.UpdateUser("root123", "nobody123", func(user *User) bool { return true })),
+		"Updating non-existing user")
+
+	// Attempt to steal the code of someone else is rolled back.
+	ExpectFalse(t, eatmsg(auth.UpdateUser("root123", "doe123", func(user *User) bool {
+		user.ContactInfo = "should@not.be.set"
+		user.SetAuthCode("phil123")
+		return true
+	})), "Duplicate code on update")
+	ExpectTrue(t, auth.FindUser("doe123").ContactInfo == "", "Rolled back")
+
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "doe123", func(user *User) bool {
+		user.SetAuthCode("newdoe123")
+		user.ContactInfo = "hello@world"
+		return true
+	})), "Root updating user")
+
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "doe123 not valid anymore")
+	updatedUser := auth.FindUser("newdoe123")
+	ExpectTrue(t, updatedUser != nil && updatedUser.ContactInfo == "hello@world",
+		"Finding newdoe123")
+}
+
+func TestSQLiteDeleteUser(t *testing.T) {
+	auth, dir := CreateSimpleSQLiteAuth(t, RealClock{})
+	defer auth.Close()
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	u := User{
+		Name:      "Jon Doe",
+		UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+
+	u.Name = "Unchanged User"
+	u.SetAuthCode("unchanged123")
+	auth.AddNewUser("root123", u)
+
+	ExpectFalse(t, eatmsg(auth.DeleteUser("unchanged123", "doe123")),
+		"Regular user may not delete")
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "doe123")), "Delete doe123")
+	ExpectFalse(t, eatmsg(auth.DeleteUser("root123", "doe123")), "Already deleted")
+
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "doe123 not valid anymore")
+	ExpectTrue(t, auth.FindUser("unchanged123") != nil, "Unchanged User")
+
+	// Code can be re-used after the user is gone.
+	u.Name = "New Doe"
+	u.SetAuthCode("doe123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Re-use deleted code")
+}
+
+func TestSQLiteImportKeepsFields(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test-sqlite-import")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	validFrom, _ := time.Parse("2006-01-02 15:04", "2020-03-01 10:00")
+	validTo, _ := time.Parse("2006-01-02 15:04", "2020-06-01 12:30")
+	u := User{
+		Name:        "Imported",
+		ContactInfo: "imported@nb",
+		UserLevel:   LevelFulltimeUser,
+		Sponsors:    []string{hashAuthCode("sponsor1"), hashAuthCode("sponsor2")},
+		ValidFrom:   validFrom,
+		ValidTo:     validTo,
+		Codes:       []string{hashAuthCode("import123"), hashAuthCode("import456")},
+		Targets:     []Target{TargetUpstairs},
+	}
+	u.Schedule, _ = ParseSchedule("Mon-Fri 18-22;Sat 10-18")
+	csvFile, _ := os.Create(filepath.Join(dir, "users.csv"))
+	writer := csv.NewWriter(csvFile)
+	u.WriteCSV(writer)
+	writer.Flush()
+	csvFile.Close()
+
+	auth := NewSQLiteAuthenticator(filepath.Join(dir, "users.db"), NewApplicationBus())
+	defer auth.Close()
+	count, err := auth.ImportCSV(csvFile.Name())
+	ExpectTrue(t, err == nil && count == 1, "Import one user")
+
+	found := auth.FindUser("import456")
+	if found == nil {
+		t.Fatal("Imported user not found")
+	}
+	ExpectTrue(t, found.Name == u.Name && found.ContactInfo == u.ContactInfo,
+		"Name and contact info")
+	ExpectTrue(t, found.UserLevel == LevelFulltimeUser, "Level")
+	ExpectTrue(t, len(found.Sponsors) == 2 && found.Sponsors[1] == u.Sponsors[1],
+		"Sponsors")
+	ExpectTrue(t, found.ValidFrom.Equal(validFrom), "ValidFrom")
+	ExpectTrue(t, found.ValidTo.Equal(validTo), "ValidTo")
+	ExpectTrue(t, len(found.Codes) == 2, "Both codes")
+	ExpectTrue(t, found.Schedule.String() == "Mon-Fri 18-22;Sat 10-18", "Schedule")
+	ExpectTrue(t, len(found.Targets) == 1 && found.Targets[0] == TargetUpstairs,
+		"Targets")
+
+	// One-shot: a second import is refused.
+	_, err = auth.ImportCSV(csvFile.Name())
+	ExpectTrue(t, err != nil, "Importing into non-empty database")
+}
+
+func TestSQLiteImportRefusesBrokenEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test-sqlite-import")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	csvFilename := filepath.Join(dir, "users.csv")
+	ioutil.WriteFile(csvFilename, []byte("broken,b@nb,user,,,,"+
+		hashAuthCode("doe123")+",Mon 25-26\n"), 0644)
+
+	auth := NewSQLiteAuthenticator(filepath.Join(dir, "users.db"), NewApplicationBus())
+	defer auth.Close()
+	_, err := auth.ImportCSV(csvFilename)
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "broken"), "Refused")
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Nothing imported")
+}
+
+func TestSQLiteImportSkipsDuplicates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test-sqlite-import")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	csvFilename := filepath.Join(dir, "users.csv")
+	ioutil.WriteFile(csvFilename, []byte(
+		"first,f@nb,user,,,,"+hashAuthCode("first123")+"\n"+
+			"again,a@nb,user,,,,"+hashAuthCode("first123")+"\n"+
+			"twice,t@nb,user,,,,"+hashAuthCode("twice123")+";"+hashAuthCode("twice123")+"\n"+
+			"other,o@nb,user,,,,"+hashAuthCode("other123")+"\n"), 0644)
+
+	auth := NewSQLiteAuthenticator(filepath.Join(dir, "users.db"), NewApplicationBus())
+	defer auth.Close()
+	count, err := auth.ImportCSV(csvFilename)
+	ExpectTrue(t, err == nil && count == 2, fmt.Sprintf("Imported %d: %v", count, err))
+	ExpectTrue(t, auth.FindUser("first123").Name == "first", "First one wins")
+	ExpectTrue(t, auth.FindUser("twice123") == nil, "Code twice in entry skipped")
+	users := 0
+	auth.IterateUsers(func(user User) { users++ })
+	ExpectTrue(t, users == 2, "No user rows left behind without codes")
+}
+
+func TestSQLiteImportFailsOnBadRow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test-sqlite-import")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	csvFilename := filepath.Join(dir, "users.csv")
+	ioutil.WriteFile(csvFilename, []byte(
+		"first,f@nb,user,,,,"+hashAuthCode("first123")+"\n"+
+			"bad,\"b@nb,user,,,,"+hashAuthCode("bad123")+"\n"+
+			"other,o@nb,user,,,,"+hashAuthCode("other123")+"\n"), 0644)
+
+	auth := NewSQLiteAuthenticator(filepath.Join(dir, "users.db"), NewApplicationBus())
+	defer auth.Close()
+	_, err := auth.ImportCSV(csvFilename)
+	ExpectTrue(t, err != nil, "Bad row is an error")
+	ExpectTrue(t, auth.FindUser("first123") == nil, "Nothing imported")
+}
+
+func TestSQLiteTimeLimits(t *testing.T) {
+	mockClock := &MockClock{}
+	auth, dir := CreateSimpleSQLiteAuth(t, mockClock)
+	defer auth.Close()
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+
+	u = User{UserLevel: LevelUser}
+	u.SetAuthCode("user_nocontact")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = someMidnight.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "root123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside")
+	ExpectAuthResult(t, auth, "unknown123", TargetUpstairs,
+		AuthFail, "No user")
+
+	mockClock.now = someMidnight.Add(13 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs, AuthOk, "")
+
+	mockClock.now = someMidnight.Add(30*24*time.Hour + 16*time.Hour)
+	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs,
+		AuthExpired, "Code not valid yet/expired")
+}
+
+func TestSQLiteLimitedUses(t *testing.T) {
+	mockClock := &MockClock{now: time.Date(2026, 10, 1, 14, 0, 0, 0, time.UTC)}
+	auth, dir := CreateSimpleSQLiteAuth(t, mockClock)
+	defer auth.Close()
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	u := User{UserLevel: LevelUser, ValidFrom: mockClock.now.Add(-time.Minute), UsesLeft: 2}
+	u.SetAuthCode("visitor123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add limited user")
+
+	ExpectAuthResult(t, auth, "visitor123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.FindUser("visitor123").UsesLeft == 1, "Use counted")
+	ExpectAuthResult(t, auth, "visitor123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "visitor123", TargetDownstairs, AuthExpired, "expired")
+
+	u.UsesLeft = 3
+	u.SetAuthCode("group123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add group")
+	ExpectUsesGrantedOnce(t, auth, "group123", 3)
+}
+
+func TestSQLiteMigratesOldSchema(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "test-sqlite-migrate")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	dbFile := filepath.Join(dir, "users.db")
+
+	// Database as created before the schema had migrations.
+	db, _ := sql.Open("sqlite", dbFile)
+	db.Exec(sqliteUserSchema)
+	db.Exec("INSERT INTO users (name, contact_info, level) VALUES ('old', 'old@nb', 'member')")
+	db.Exec("INSERT INTO codes (code, user_id) VALUES (?, 1)", hashAuthCode("old12345"))
+	db.Close()
+
+	auth := NewSQLiteAuthenticator(dbFile, NewApplicationBus())
+	if auth == nil {
+		t.Fatal("Could not open old database")
+	}
+	found := auth.FindUser("old12345")
+	ExpectTrue(t, found != nil && found.Name == "old" && found.Schedule == nil,
+		"Old user readable")
+	ExpectTrue(t, eatmsg(auth.UpdateUser("old12345", "old12345", func(user *User) bool {
+		user.Schedule, _ = ParseSchedule("Sun 0-24")
+		return true
+	})), "Update with schedule")
+	auth.Close()
+
+	// Re-opening does not attempt to migrate again.
+	auth = NewSQLiteAuthenticator(dbFile, NewApplicationBus())
+	if auth == nil {
+		t.Fatal("Could not re-open migrated database")
+	}
+	defer auth.Close()
+	ExpectTrue(t, auth.FindUser("old12345").Schedule.String() == "Sun 0-24",
+		"Schedule stored")
+}
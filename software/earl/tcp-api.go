@@ -1,12 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
 	"net"
 	"os"
-	"sort"
-	"sync"
+	"strings"
 )
 
 const (
@@ -15,50 +14,19 @@ const (
 )
 
 type TcpServer struct {
-	bus *ApplicationBus
-
-	// Remember the last event for each type. Already JSON prepared
-	eventChannel   AppEventChannel
-	lastEvents     map[AppEventType]*JsonAppEvent
-	lastEventsLock sync.Mutex
-	port           int
+	bus      *ApplicationBus
+	commands *RemoteCommands // Optional, can be nil.
+	port     int
 }
 
-func NewTcpServer(bus *ApplicationBus, port int) *TcpServer {
-	newObject := &TcpServer{
-		bus:          bus,
-		eventChannel: make(AppEventChannel),
-		lastEvents:   make(map[AppEventType]*JsonAppEvent),
-		port:         port,
-	}
-	bus.Subscribe(newObject.eventChannel)
-	go newObject.collectLastEvents()
-	return newObject
-}
-
-func (a *TcpServer) collectLastEvents() {
-	for {
-		ev := <-a.eventChannel
-		// Remember the last event of each type.
-		a.lastEventsLock.Lock()
-		jsonified := JsonEventFromAppEvent(ev)
-		jsonified.IsHistoricEvent = true
-		a.lastEvents[ev.Ev] = jsonified
-		a.lastEventsLock.Unlock()
+func NewTcpServer(backends *Backends, port int) *TcpServer {
+	return &TcpServer{
+		bus:      backends.appEventBus,
+		commands: backends.remoteCommands,
+		port:     port,
 	}
 }
 
-func (a *TcpServer) getHistory() []*JsonAppEvent {
-	result := EventList{}
-	a.lastEventsLock.Lock()
-	for _, ev := range a.lastEvents {
-		result = append(result, ev)
-	}
-	a.lastEventsLock.Unlock()
-	sort.Sort(result) // Show old events first
-	return result
-}
-
 func (a *TcpServer) ListenAndServe() {
 	listener, err := net.Listen(CONN_TYPE, fmt.Sprintf("%s:%d", CONN_HOST, a.port))
 	if err != nil {
@@ -82,38 +50,53 @@ func (a *TcpServer) Run() {
 	a.ListenAndServe()
 }
 
-func (event *JsonAppEvent) writeJSONEventToTCP(conn net.Conn) bool {
-	json, err := json.Marshal(event)
-	if err != nil {
-		// Funny event, let's just ignore.
-		return true
-	}
-	_, err = conn.Write(json)
-	if err != nil {
-		return false
-	}
-	conn.Write([]byte("\n"))
-	return true
-}
-
+// Clients get a stream of events, one JSON object per line, starting with
+// the last event of each type. They can send commands, one per line, and get
+// the replies as lines in between; see streamSession.
 func (a *TcpServer) handleTcpConnection(conn net.Conn) {
 	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	commands := make(chan string)
+	go a.readCommands(conn, commands, done)
 
-	// Write out the historical events
-	for _, event := range a.getHistory() {
-		if !event.writeJSONEventToTCP(conn) {
-			break
+	session := &streamSession{commands: a.commands}
+	appEvents := subscribeStream(a.bus, "tcp-events", ReplayLatest())
+	defer func() { a.bus.Unsubscribe(appEvents) }()
+	for {
+		select {
+		case event, ok := <-appEvents:
+			if !ok {
+				return // Too slow; disconnected by the bus.
+			}
+			if !writeJSONEvent(conn, event, "") {
+				return
+			}
+		case command := <-commands:
+			replay, reply := session.handle(command)
+			if replay == nil {
+				if !writeJSONLine(conn, reply, "") {
+					return
+				}
+				continue
+			}
+			// Events still in the old channel are part of the replay.
+			a.bus.Unsubscribe(appEvents)
+			appEvents = subscribeStream(a.bus, "tcp-events", replay)
 		}
 	}
+}
 
-	// Subscribe and write out new events as published
-	appEvents := make(AppEventChannel, 3)
-	a.bus.Subscribe(appEvents)
-	for {
-		event := <-appEvents
-		if !JsonEventFromAppEvent(event).writeJSONEventToTCP(conn) {
-			break
+func (a *TcpServer) readCommands(conn net.Conn, commands chan<- string, done <-chan struct{}) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		select {
+		case commands <- scanner.Text():
+		case <-done:
+			return
 		}
 	}
-	a.bus.Unsubscribe(appEvents)
 }
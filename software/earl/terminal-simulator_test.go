@@ -0,0 +1,348 @@
+//go:build linux
+
+package main
+
+// A simulated terminal behind a pseudo-terminal, speaking the serial
+// protocol of the firmware (see ../firmware/terminal-main.cc). Earl connects
+// to the pty like it would to a serial device; the test scripts what the
+// user does (SwipeCard(), PressKeys()) and checks what the terminal shows.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How long to wait for earl to act on something.
+const simulatorTimeout = 5 * time.Second
+
+type TerminalSimulator struct {
+	t         *testing.T
+	master    *os.File
+	slave     *os.File // Kept open, so that master does not see hangups.
+	slavePath string
+
+	lock         sync.Mutex
+	name         string
+	pendingName  string // 'N' needs to be sent twice.
+	lcd          [maxLCDRows]string
+	leds         string
+	tones        []string // Tone commands as sent, e.g. "H500"
+	keyClick     bool
+	noStats      bool // Like old firmware without 's' command.
+	baud         int
+	storedBaud   int // In EEPROM; what we come up with after reset.
+	maxGoodBaud  int // Long lines get mangled above this rate.
+	commandCount int
+}
+
+func NewTerminalSimulator(t *testing.T, name string) *TerminalSimulator {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("Can't open pty: %v", err)
+	}
+	// Not using master.Fd(), as that would make it blocking, and we
+	// could not Close() it while serve() is reading.
+	var ptyNumber uint32
+	conn, err := master.SyscallConn()
+	if err == nil {
+		conn.Control(func(fd uintptr) {
+			if err = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); err == nil {
+				ptyNumber, err = unix.IoctlGetUint32(int(fd), unix.TIOCGPTN)
+			}
+		})
+	}
+	if err != nil {
+		t.Fatalf("Can't set up pty: %v", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", ptyNumber)
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("Can't open %s: %v", slavePath, err)
+	}
+	// Raw mode, so that nothing is echoed before earl configures the line.
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatalf("Can't get termios: %v", err)
+	}
+	termios.Iflag &^= unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios)
+
+	s := &TerminalSimulator{
+		t:          t,
+		master:     master,
+		slave:      slave,
+		slavePath:  slavePath,
+		name:       name,
+		baud:       defaultBaudrate,
+		storedBaud: defaultBaudrate,
+	}
+	// Like the firmware after reset.
+	s.send("# Noisebridge access control terminal (simulated)")
+	s.send("# Type '?<RETURN>' for help.")
+	s.send("# Name: " + name)
+	go s.serve()
+	return s
+}
+
+// Path of the serial device earl should connect to.
+func (s *TerminalSimulator) Path() string {
+	return s.slavePath
+}
+
+// Pull the plug: earl sees the line going away.
+func (s *TerminalSimulator) Unplug() {
+	s.master.Close()
+	s.slave.Close()
+}
+
+// -- Scripting the user.
+
+// Present a card with the given hex id.
+func (s *TerminalSimulator) SwipeCard(uid string) {
+	s.send(fmt.Sprintf("I%02X %s", len(uid)/2, uid))
+}
+
+func (s *TerminalSimulator) PressKeys(keys string) {
+	for _, key := range keys {
+		s.send(fmt.Sprintf("K%c", key))
+	}
+}
+
+// Behave like old firmware that doesn't know the 's' command.
+func (s *TerminalSimulator) DisableStats() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.noStats = true
+}
+
+// Like a terminal that has the rate stored in its EEPROM.
+func (s *TerminalSimulator) SetBaud(baud int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.baud = baud
+	s.storedBaud = baud
+}
+
+// Like a long cable: above this rate, longer replies arrive mangled.
+func (s *TerminalSimulator) SetMaxGoodBaud(baud int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxGoodBaud = baud
+}
+
+// -- Inspecting the terminal.
+
+func (s *TerminalSimulator) Baud() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.baud
+}
+
+func (s *TerminalSimulator) StoredBaud() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.storedBaud
+}
+
+func (s *TerminalSimulator) LCD(row int) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lcd[row]
+}
+
+func (s *TerminalSimulator) LEDs() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.leds
+}
+
+func (s *TerminalSimulator) Tones() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.tones...)
+}
+
+func (s *TerminalSimulator) CommandCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.commandCount
+}
+
+// Wait until the condition on the terminal state is true.
+func (s *TerminalSimulator) ExpectEventually(what string, condition func() bool) {
+	s.t.Helper()
+	for deadline := time.Now().Add(simulatorTimeout); !condition(); {
+		if time.Now().After(deadline) {
+			s.t.Errorf("%s: timeout waiting for %s", s.name, what)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *TerminalSimulator) ExpectLCD(row int, text string) {
+	s.t.Helper()
+	s.ExpectEventually(fmt.Sprintf("LCD row %d '%s'", row, text),
+		func() bool { return s.LCD(row) == text })
+}
+
+func (s *TerminalSimulator) ExpectLEDs(colors string) {
+	s.t.Helper()
+	s.ExpectEventually(fmt.Sprintf("LEDs '%s'", colors),
+		func() bool { return s.LEDs() == colors })
+}
+
+// -- Firmware protocol.
+
+func (s *TerminalSimulator) send(line string) {
+	s.master.Write([]byte(line + "\r\n"))
+}
+
+func (s *TerminalSimulator) serve() {
+	reader := bufio.NewReader(s.master)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return // Unplugged.
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		s.send(s.handleCommand(line))
+	}
+}
+
+// The baud rate earl set on its side of the line.
+func (s *TerminalSimulator) hostBaud() int {
+	termios, err := unix.IoctlGetTermios(int(s.slave.Fd()), unix.TCGETS)
+	if err != nil {
+		return 0
+	}
+	for baud, flag := range serialBaudFlags {
+		if termios.Cflag&unix.CBAUD == flag {
+			return baud
+		}
+	}
+	return 0
+}
+
+func (s *TerminalSimulator) handleCommand(line string) string {
+	hostBaud := s.hostBaud()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if hostBaud != s.baud {
+		// Neither side understands the other.
+		return "\xf0\xe0\xfc"
+	}
+	s.commandCount++
+	reply := s.reply(line)
+	if s.maxGoodBaud > 0 && s.baud > s.maxGoodBaud && len(reply) > 20 {
+		reply = reply[:12] + "\x7f" + reply[13:]
+	}
+	return reply
+}
+
+func (s *TerminalSimulator) reply(line string) string {
+	switch line[0] {
+	case '?':
+		return "# Help not simulated.\r\n? ok"
+	case 'R':
+		return "Reset RFID reader."
+	case 'M':
+		if len(line) < 2 || line[1] < '0' || line[1] > '1' {
+			return "E row number must be 0 or 1"
+		}
+		s.lcd[line[1]-'0'] = line[2:]
+		return "M ok"
+	case 'L':
+		s.leds = line[1:]
+		return "L ok"
+	case 'N':
+		if len(line) < 4 {
+			return "Name too short!"
+		}
+		if s.pendingName == "" {
+			s.pendingName = line[1:]
+			return "Name received. Send 2nd time to confirm."
+		}
+		defer func() { s.pendingName = "" }()
+		if s.pendingName != line[1:] {
+			return "Name mismatch!"
+		}
+		s.name = line[1:]
+		return "Name stored: " + s.name
+	case 'B':
+		baud, _ := strconv.Atoi(line[1:])
+		if baud < 300 || baud > 38400 {
+			return "E not a valid baudrate between 300..38400"
+		}
+		if baud == s.baud {
+			s.storedBaud = baud
+			return "Baud rate stored in EEPROM"
+		}
+		s.baud = baud
+		return "Baud rate will be switched after this line. Send command a second time to permanently store in EEPROM"
+	case 'T':
+		tone := line[1:]
+		if len(tone) < 2 {
+			tone += "250" // Default duration.
+		}
+		s.tones = append(s.tones, tone)
+		return "T ok"
+	case 'F':
+		if len(line) < 3 || line[1] != 'K' {
+			return "E invalid flag"
+		}
+		s.keyClick = line[2] == '1'
+		// Sic: the firmware answers with 'T'.
+		if s.keyClick {
+			return "T flag on"
+		}
+		return "T flag off"
+	case 'e':
+		return line
+	case 's':
+		if s.noStats {
+			break
+		}
+		return fmt.Sprintf("s commands-seen=0x%04X; dropped-rx-bytes=0x0000",
+			s.commandCount)
+	case 'n':
+		return "n" + s.name
+	}
+	return fmt.Sprintf("E Unknown command '%c'; '?' for help.", line[0])
+}
+
+// Make the simulator reachable under a stable path, like the symlinks in
+// /dev/serial/by-id/. Re-linking simulates plugging in another terminal.
+func linkSimulator(t *testing.T, s *TerminalSimulator, link string) {
+	os.Remove(link)
+	if err := os.Symlink(s.Path(), link); err != nil {
+		t.Fatalf("Can't link %s: %v", link, err)
+	}
+}
+
+func simulatorLinkPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "test-tty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if !keepGeneratedFiles {
+			os.RemoveAll(dir)
+		}
+	})
+	return filepath.Join(dir, "ttyUSB0")
+}
@@ -0,0 +1,362 @@
+// Health of the terminals connected to the serial devices: what is connected
+// where, since when, what went wrong last, and the statistics the firmware
+// reports with the 's' command. When a terminal connects, we also check
+// the quality of the line by letting it echo test lines.
+//
+// Besides being available in /api/terminals, all of this is exported to
+// Prometheus.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// How often to ask the terminals for their statistics.
+	terminalStatsInterval = 30 * time.Second
+)
+
+var (
+	terminalSubsystem = "terminal"
+	terminalConnected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "connected",
+			Help:      "1 if a terminal is connected to the device",
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "reconnects_total",
+			Help:      "Number of attempts to reconnect to the device",
+		},
+		[]string{"device"},
+	)
+	terminalRoundTrip = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "round_trip_seconds",
+			Help:      "Time from sending a command to the terminal until the reply",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2},
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalErrorReplies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "error_replies_total",
+			Help:      "Number of 'E' error replies from the terminal",
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "timeouts_total",
+			Help:      "Number of commands the terminal did not reply to in time",
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalCommandsSeen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "commands_seen",
+			Help:      "Commands seen by the terminal firmware (16 bit, wraps around)",
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalDroppedRxBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "dropped_rx_bytes",
+			Help:      "Bytes the terminal firmware had to drop from its receive buffer",
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalLineErrorRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "line_error_ratio",
+			Help:      "Fraction of echo test lines that did not come back intact in the last line check",
+		},
+		[]string{"device", "terminal"},
+	)
+	terminalBaud = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: terminalSubsystem,
+			Name:      "baud",
+			Help:      "Baud rate we talk to the terminal with",
+		},
+		[]string{"device", "terminal"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(terminalConnected, terminalReconnects,
+		terminalRoundTrip, terminalErrorReplies, terminalTimeouts,
+		terminalCommandsSeen, terminalDroppedRxBytes,
+		terminalLineErrorRatio, terminalBaud)
+}
+
+// Status of one serial device and the terminal connected to it.
+type TerminalStatus struct {
+	lock sync.Mutex
+
+	device         string
+	baud           int
+	name           string // Empty, if not connected yet.
+	connectedSince time.Time
+	lastError      string
+	lastErrorTime  time.Time
+	reconnects     int
+	timeouts       int
+	errorReplies   int
+	lastRoundTrip  time.Duration
+	stats          map[string]uint64 // As last reported by 's'
+	lineChecked    bool
+	lineErrorRate  float64
+	lineCheckBaud  int
+}
+
+type JsonTerminalStatus struct {
+	Name           string            `json:"name,omitempty"`
+	Device         string            `json:"device"`
+	Baud           int               `json:"baud"`
+	Connected      bool              `json:"connected"`
+	ConnectedSince *time.Time        `json:"connected_since,omitempty"`
+	LastError      string            `json:"last_error,omitempty"`
+	LastErrorTime  *time.Time        `json:"last_error_time,omitempty"`
+	Reconnects     int               `json:"reconnects"`
+	Timeouts       int               `json:"timeouts"`
+	ErrorReplies   int               `json:"error_replies"`
+	RoundTripMs    float64           `json:"round_trip_ms,omitempty"`
+	Stats          map[string]uint64 `json:"stats,omitempty"`
+	LineErrorRate  *float64          `json:"line_error_rate,omitempty"`
+	LineCheckBaud  int               `json:"line_check_baud,omitempty"`
+}
+
+// All serial devices we handle.
+type TerminalRegistry struct {
+	lock    sync.Mutex
+	devices map[string]*TerminalStatus
+}
+
+func NewTerminalRegistry() *TerminalRegistry {
+	return &TerminalRegistry{devices: make(map[string]*TerminalStatus)}
+}
+
+// Get the status for the device, creating it if needed. Can be called
+// on a nil registry; the status is not listed anywhere then.
+func (r *TerminalRegistry) Device(device string, baud int) *TerminalStatus {
+	if r == nil {
+		return newTerminalStatus(device, baud)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	status, exists := r.devices[device]
+	if !exists {
+		status = newTerminalStatus(device, baud)
+		r.devices[device] = status
+	}
+	return status
+}
+
+// Forget about a device that went away. Can be called on a nil registry.
+func (r *TerminalRegistry) Remove(device string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.devices, device)
+}
+
+// Status of all devices, ordered by device path.
+func (r *TerminalRegistry) List() []*JsonTerminalStatus {
+	result := []*JsonTerminalStatus{}
+	if r == nil {
+		return result
+	}
+	r.lock.Lock()
+	for _, status := range r.devices {
+		result = append(result, status.Json())
+	}
+	r.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Device < result[j].Device
+	})
+	return result
+}
+
+func newTerminalStatus(device string, baud int) *TerminalStatus {
+	terminalReconnects.WithLabelValues(device)
+	return &TerminalStatus{device: device, baud: baud}
+}
+
+func (s *TerminalStatus) Json() *JsonTerminalStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := &JsonTerminalStatus{
+		Name:         s.name,
+		Device:       s.device,
+		Baud:         s.baud,
+		Connected:    !s.connectedSince.IsZero(),
+		LastError:    s.lastError,
+		Reconnects:   s.reconnects,
+		Timeouts:     s.timeouts,
+		ErrorReplies: s.errorReplies,
+		RoundTripMs:  float64(s.lastRoundTrip) / float64(time.Millisecond),
+	}
+	if !s.connectedSince.IsZero() {
+		since := s.connectedSince
+		result.ConnectedSince = &since
+	}
+	if !s.lastErrorTime.IsZero() {
+		when := s.lastErrorTime
+		result.LastErrorTime = &when
+	}
+	if s.lineChecked {
+		rate := s.lineErrorRate
+		result.LineErrorRate = &rate
+		result.LineCheckBaud = s.lineCheckBaud
+	}
+	if len(s.stats) > 0 {
+		result.Stats = make(map[string]uint64)
+		for key, value := range s.stats {
+			result.Stats[key] = value
+		}
+	}
+	return result
+}
+
+// Labels for the per-terminal metrics. Needs to be called with lock held.
+func (s *TerminalStatus) labels() prometheus.Labels {
+	return prometheus.Labels{"device": s.device, "terminal": s.name}
+}
+
+func (s *TerminalStatus) Connected(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.name = name
+	s.connectedSince = time.Now()
+	terminalConnected.With(s.labels()).Set(1)
+	terminalBaud.With(s.labels()).Set(float64(s.baud))
+}
+
+func (s *TerminalStatus) Disconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.connectedSince.IsZero() {
+		terminalConnected.With(s.labels()).Set(0)
+	}
+	s.connectedSince = time.Time{}
+}
+
+func (s *TerminalStatus) NoteReconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reconnects++
+	terminalReconnects.WithLabelValues(s.device).Inc()
+}
+
+func (s *TerminalStatus) NoteError(format string, args ...interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastError = fmt.Sprintf(format, args...)
+	s.lastErrorTime = time.Now()
+}
+
+func (s *TerminalStatus) NoteRoundTrip(duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastRoundTrip = duration
+	terminalRoundTrip.With(s.labels()).Observe(duration.Seconds())
+}
+
+func (s *TerminalStatus) NoteTimeout(command string) {
+	s.lock.Lock()
+	s.timeouts++
+	terminalTimeouts.With(s.labels()).Inc()
+	s.lock.Unlock()
+	s.NoteError("timeout waiting for reply to '%s'", command)
+}
+
+func (s *TerminalStatus) NoteErrorReply(reply string) {
+	s.lock.Lock()
+	s.errorReplies++
+	terminalErrorReplies.With(s.labels()).Inc()
+	s.lock.Unlock()
+	s.NoteError("%s", reply)
+}
+
+func (s *TerminalStatus) SetStats(stats map[string]uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats = stats
+	if value, ok := stats["commands-seen"]; ok {
+		terminalCommandsSeen.With(s.labels()).Set(float64(value))
+	}
+	if value, ok := stats["dropped-rx-bytes"]; ok {
+		terminalDroppedRxBytes.With(s.labels()).Set(float64(value))
+	}
+}
+
+// Record the result of an echo line check at the given baud rate.
+func (s *TerminalStatus) SetLineQuality(baud int, errorRate float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lineChecked = true
+	s.lineErrorRate = errorRate
+	s.lineCheckBaud = baud
+	terminalLineErrorRatio.With(s.labels()).Set(errorRate)
+}
+
+func (s *TerminalStatus) SetBaud(baud int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.baud = baud
+	terminalBaud.With(s.labels()).Set(float64(baud))
+}
+
+// Parse the reply of the 's' command, which looks like
+// "s commands-seen=0x002a; dropped-rx-bytes=0x0000"
+func parseTerminalStats(reply string) (map[string]uint64, error) {
+	if len(reply) == 0 || reply[0] != 's' {
+		return nil, fmt.Errorf("not a stats reply: '%s'", reply)
+	}
+	result := make(map[string]uint64)
+	for _, field := range strings.Split(reply[1:], ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("expected key=value, got '%s'", field)
+		}
+		value, err := strconv.ParseUint(keyValue[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyValue[0], err)
+		}
+		result[keyValue[0]] = value
+	}
+	return result, nil
+}
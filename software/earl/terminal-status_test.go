@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTerminalStats(t *testing.T) {
+	stats, err := parseTerminalStats("s commands-seen=0x002A; dropped-rx-bytes=0x0003")
+	ExpectTrue(t, err == nil, "Parse stats")
+	ExpectTrue(t, stats["commands-seen"] == 42, "commands-seen")
+	ExpectTrue(t, stats["dropped-rx-bytes"] == 3, "dropped-rx-bytes")
+
+	_, err = parseTerminalStats("E Unknown command 's'; '?' for help.")
+	ExpectTrue(t, err != nil, "Error reply")
+	_, err = parseTerminalStats("s commands-seen")
+	ExpectTrue(t, err != nil, "Missing value")
+	_, err = parseTerminalStats("s commands-seen=lots")
+	ExpectTrue(t, err != nil, "Not a number")
+}
+
+func TestTerminalRegistry(t *testing.T) {
+	registry := NewTerminalRegistry()
+	status := registry.Device("/dev/ttyUSB1", 9600)
+	ExpectTrue(t, registry.Device("/dev/ttyUSB1", 9600) == status, "Same device")
+	registry.Device("/dev/ttyUSB0", 19200)
+
+	status.Connected("gate")
+	status.NoteTimeout("n")
+	status.NoteReconnect()
+	status.SetStats(map[string]uint64{"commands-seen": 17})
+
+	list := registry.List()
+	ExpectTrue(t, len(list) == 2, "Two devices")
+	ExpectTrue(t, list[0].Device == "/dev/ttyUSB0" && !list[0].Connected,
+		"Sorted; not connected")
+	gate := list[1]
+	ExpectTrue(t, gate.Name == "gate" && gate.Connected && gate.ConnectedSince != nil,
+		"Connected")
+	ExpectTrue(t, gate.Timeouts == 1 && gate.Reconnects == 1, "Counters")
+	ExpectTrue(t, gate.LastError == "timeout waiting for reply to 'n'", "Last error")
+	ExpectTrue(t, gate.Stats["commands-seen"] == 17, "Stats")
+
+	status.Disconnected()
+	ExpectFalse(t, registry.List()[1].Connected, "Disconnected")
+
+	// A nil registry just doesn't keep track.
+	var none *TerminalRegistry
+	ExpectTrue(t, none.Device("/dev/ttyUSB0", 9600) != nil, "Unregistered status")
+	ExpectTrue(t, len(none.List()) == 0, "Empty list")
+}
+
+func TestServeTerminals(t *testing.T) {
+	registry := NewTerminalRegistry()
+	registry.Device("/dev/ttyUSB0", 9600).Connected("upstairs")
+	api := &ApiServer{terminals: registry}
+
+	response := httptest.NewRecorder()
+	api.ServeTerminals(response, httptest.NewRequest("GET", "/api/terminals", nil))
+	ExpectTrue(t, response.Code == http.StatusOK, "Status OK")
+	var list []*JsonTerminalStatus
+	json.NewDecoder(response.Body).Decode(&list)
+	ExpectTrue(t, len(list) == 1 && list[0].Name == "upstairs" && list[0].Baud == 9600,
+		"Terminal listed")
+}
@@ -14,7 +14,11 @@ package main
 //  - How to enter names for members ? For initiall mass-adding: on console
 //  - make this state-machine more readable.
 import (
+	"crypto/rand"
 	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -28,6 +32,9 @@ const (
 	StateUpdateAwaitRFID           // Member/Philanthropist updates user: wait for new user RFID
 	StateDoorbellRequest           // Someone just rang
 	StateDooropenRequest           // Someone at control just requested to open a door regardless of doorbell
+	StateSpaceCheckin              // Member checked in to open space; not enough yet.
+	StateTempPinAwaitKind          // Member adds temporary PIN: hours, days or uses ?
+	StateTempPinAwaitNumber        // How many of these; typed on the keypad.
 )
 
 const (
@@ -40,6 +47,15 @@ const (
 	maxSilenceDoorbell                 = 5 * 60 * time.Second
 )
 
+const (
+	// Temporary PINs for visitors and classes.
+	tempPinLength       = 6
+	maxTempPinHours     = 72
+	maxTempPinDays      = 30 // Anonymous codes don't last longer anyway.
+	maxTempPinUses      = 20
+	tempPinUsesValidity = 7 * 24 * time.Hour // For PINs limited by uses.
+)
+
 const (
 	// We programmed the LCD to show a doorbell pictogram
 	DoorBellCharacter = "\001"
@@ -48,6 +64,7 @@ const (
 type UIControlHandler struct {
 	backends *Backends
 	auth     Authenticator // shortcut, copy of the pointer in backends
+	clock    Clock
 
 	t Terminal
 
@@ -58,6 +75,9 @@ type UIControlHandler struct {
 
 	userCounter int // counter to generate new user names.
 
+	tempPinKind   byte   // [1] hours, [2] days, [3] uses
+	tempPinNumber string // typed so far
+
 	// We allow rate-limiting of the doorbell.
 	lastDoorbellRequest time.Time // To know when to offer hush.
 	doorbellTarget      Target
@@ -76,6 +96,7 @@ func NewControlHandler(backends *Backends) *UIControlHandler {
 	return &UIControlHandler{
 		backends:               backends,
 		auth:                   backends.authenticator,
+		clock:                  RealClock{},
 		userCounter:            time.Now().Second() % 100, // semi-random start
 		observedDoorOpenStatus: make(map[Target]int),
 	}
@@ -108,14 +129,13 @@ func (u *UIControlHandler) CurrentAuthLevel() Level {
 	return user.UserLevel
 }
 
-func keyToTarget(key byte) (Target, bool) {
-	switch key {
-	case '4':
-		return TargetDownstairs, false
-	case '5':
-		return TargetUpstairs, false
-	case '6':
-		return TargetElevator, false
+// Keys with a meaning in the menus; control keys of targets need to stay
+// clear of them.
+const controlMenuKeys = "123789"
+
+func (u *UIControlHandler) keyToTarget(key byte) (Target, bool) {
+	if target := u.backends.config.TargetForControlKey(key); target != nil {
+		return target.Name, false
 	}
 	return TargetControlUI, true
 }
@@ -126,9 +146,10 @@ func (u *UIControlHandler) HandleKeypress(key byte) {
 		return
 	}
 
-	// If user presses 4,5,6 they are requesting to open a specific door without regard for doorbells or lack thereof
-	target, err := keyToTarget(key)
-	if !err {
+	// If user presses a door's control key (4,5,6 at Noisebridge) they are requesting to open a specific door without regard for doorbells or lack thereof
+	// (unless they're typing a number).
+	target, err := u.keyToTarget(key)
+	if !err && u.state != StateTempPinAwaitNumber {
 		u.t.WriteLCD(0, fmt.Sprintf("RFID: open at %s", target))
 		u.t.WriteLCD(1, "[*] Cancel")
 		u.dooropenTarget = target
@@ -140,7 +161,11 @@ func (u *UIControlHandler) HandleKeypress(key byte) {
 		level := u.CurrentAuthLevel()
 		if key == '1' && CanLevelAddDelete(level) {
 			u.t.WriteLCD(0, "Read new user RFID")
-			u.t.WriteLCD(1, "[*] Cancel")
+			if level == LevelMember {
+				u.t.WriteLCD(1, "[7] Temp PIN  [*] Cancel")
+			} else {
+				u.t.WriteLCD(1, "[*] Cancel")
+			}
 			u.setStateWithTimeout(StateAddAwaitNewRFID, 30*time.Second)
 		}
 		if key == '2' && CanLevelModify(level) {
@@ -148,6 +173,46 @@ func (u *UIControlHandler) HandleKeypress(key byte) {
 			u.t.WriteLCD(1, "[*] Cancel")
 			u.setStateWithTimeout(StateUpdateAwaitRFID, 30*time.Second)
 		}
+		if key == '3' && level == LevelMember && u.backends.spaceStatus != nil {
+			u.toggleSpaceOpen()
+		}
+
+	case StateAddAwaitNewRFID:
+		// Temp PINs are for anyone; only members hand them out.
+		if key == '7' && u.CurrentAuthLevel() == LevelMember {
+			u.t.WriteLCD(0, "Temp PIN valid for")
+			u.t.WriteLCD(1, "[1]Hours [2]Days [3]Uses")
+			u.setStateWithTimeout(StateTempPinAwaitKind, 30*time.Second)
+		}
+
+	case StateTempPinAwaitKind:
+		if key >= '1' && key <= '3' {
+			u.tempPinKind = key
+			u.tempPinNumber = ""
+			u.t.WriteLCD(0, u.tempPinUnit()+"?")
+			u.t.WriteLCD(1, "[#] Confirm  [*] Cancel")
+			u.setStateWithTimeout(StateTempPinAwaitNumber, 30*time.Second)
+		}
+
+	case StateTempPinAwaitNumber:
+		if key == '#' {
+			u.addTempPin()
+		} else if key >= '0' && key <= '9' && len(u.tempPinNumber) < 3 {
+			u.tempPinNumber += string(key)
+			u.t.WriteLCD(0, u.tempPinUnit()+"? "+u.tempPinNumber)
+			u.setStateWithTimeout(StateTempPinAwaitNumber, 30*time.Second)
+		}
+
+	case StateSpaceCheckin:
+		if key == '8' {
+			member := u.auth.FindUser(u.authUserCode)
+			if member != nil {
+				until := u.backends.spaceStatus.OpenSolo(member)
+				u.t.WriteLCD(0, "Open to public til "+until.Format("15:04"))
+				u.t.WriteLCD(1, "Don't forget to close!")
+				u.setStateWithTimeout(StateDisplayInfoMessage, 5*time.Second)
+			}
+		}
 
 	case StateDoorbellRequest:
 		if key == '9' {
@@ -275,7 +340,11 @@ func (u *UIControlHandler) HandleAppEvent(event *AppEvent) {
 		// more important:
 		u.startDoorOpenUI(event.Target, event.Msg)
 	case AppOpenRequest:
-		u.actionMessage = "Opening " + string(event.Target)
+		if strings.HasPrefix(event.Source, "gpio:") {
+			u.actionMessage = "Button opens " + string(event.Target)
+		} else {
+			u.actionMessage = "Opening " + string(event.Target)
+		}
 		u.actionMessageTimeout = time.Now().Add(2 * time.Second)
 	case AppHushBellRequest:
 		u.hushedDoorbellTimeout = event.Timeout
@@ -284,6 +353,18 @@ func (u *UIControlHandler) HandleAppEvent(event *AppEvent) {
 		if event.Value == 1 {
 			u.actionMessage = "" // No need to show 'Open' anymore
 		}
+	case AppDoorHeldOpenAlarm:
+		u.actionMessage = "ALARM " + string(event.Target) + " held open"
+		u.actionMessageTimeout = time.Now().Add(30 * time.Second)
+	case AppDoorForcedOpenAlarm:
+		u.actionMessage = "ALARM " + string(event.Target) + " forced"
+		u.actionMessageTimeout = time.Now().Add(30 * time.Second)
+	case AppSpaceOpened:
+		u.actionMessage = "Space open to public"
+		u.actionMessageTimeout = time.Now().Add(5 * time.Second)
+	case AppSpaceClosed:
+		u.actionMessage = "Space closed to public"
+		u.actionMessageTimeout = time.Now().Add(5 * time.Second)
 	}
 	u.HandleTick() // If we're in idle, update status right away.
 }
@@ -317,6 +398,12 @@ func (u *UIControlHandler) displayIdleScreen() {
 			u.hushedDoorbellTimeout.Sub(now)/time.Second))
 	} else if doorStatus := u.getDoorStatusString(); doorStatus != "" {
 		u.t.WriteLCD(0, doorStatus)
+	} else if open, until := u.backends.spaceStatus.OpenUntil(); open {
+		if until.IsZero() {
+			u.t.WriteLCD(0, "  Noisebridge: Open")
+		} else {
+			u.t.WriteLCD(0, "Open to public til "+until.Format("15:04"))
+		}
 	} else {
 		// Default, nothing else to display
 		u.t.WriteLCD(0, "      Noisebridge")
@@ -331,7 +418,16 @@ func (u *UIControlHandler) displayIdleScreen() {
 }
 
 func (u *UIControlHandler) presentMemberActions(member *User) {
-	u.t.WriteLCD(0, fmt.Sprintf("Howdy %s", member.Name))
+	// With a space status, the [3] choice goes right-aligned on the first
+	// line; the second has no room left.
+	greeting := fmt.Sprintf("Howdy %s", member.Name)
+	if u.backends.spaceStatus == nil {
+		u.t.WriteLCD(0, greeting)
+	} else if u.backends.spaceStatus.IsOpen() {
+		u.t.WriteLCD(0, fmt.Sprintf("%-16.16s%8s", greeting, "[3]Close"))
+	} else {
+		u.t.WriteLCD(0, fmt.Sprintf("%-16.16s%8s", greeting, "[3]Open"))
+	}
 	u.t.WriteLCD(1, "[*]ESC [1]Add [2]Renew")
 	// @TODO: allow members to make philanthropists trusted philanthropists
 	u.setStateWithTimeout(StateWaitMenuChoice, 5*time.Second)
@@ -375,7 +471,11 @@ func (u *UIControlHandler) displayUserInfo(user *User) {
 	}
 
 	// Second line
-	if user.InValidityPeriod(time.Now()) {
+	if user.InValidityPeriod(time.Now()) && user.Schedule != nil {
+		// Cut off by the terminal if too long, but the beginning
+		// is the most relevant part anyway.
+		u.t.WriteLCD(1, user.Schedule.String())
+	} else if user.InValidityPeriod(time.Now()) {
 		from, to := user.AccessHours()
 		u.t.WriteLCD(1, fmt.Sprintf("Open doors [%d:00-%d:00)",
 			from, to))
@@ -386,6 +486,113 @@ func (u *UIControlHandler) displayUserInfo(user *User) {
 	u.setStateWithTimeout(StateDisplayInfoMessage, 2*time.Second)
 }
 
+func (u *UIControlHandler) tempPinUnit() string {
+	switch u.tempPinKind {
+	case '1':
+		return "Hours"
+	case '2':
+		return "Days"
+	}
+	return "Uses"
+}
+
+func (u *UIControlHandler) tempPinLimit() int {
+	switch u.tempPinKind {
+	case '1':
+		return maxTempPinHours
+	case '2':
+		return maxTempPinDays
+	}
+	return maxTempPinUses
+}
+
+func newTempPin() string {
+	pin := make([]byte, tempPinLength)
+	for i := range pin {
+		digit, _ := rand.Int(rand.Reader, big.NewInt(10)) // Unbiased.
+		pin[i] = '0' + byte(digit.Int64())
+	}
+	return string(pin)
+}
+
+// Add a user with a random PIN for the number of hours, days or uses typed.
+// The PIN is only shown here, once; we only store its hash.
+func (u *UIControlHandler) addTempPin() {
+	number, _ := strconv.Atoi(u.tempPinNumber)
+	if number < 1 || number > u.tempPinLimit() {
+		u.tempPinNumber = ""
+		u.t.WriteLCD(0, fmt.Sprintf("%s? 1..%d please", u.tempPinUnit(), u.tempPinLimit()))
+		u.setStateWithTimeout(StateTempPinAwaitNumber, 30*time.Second)
+		return
+	}
+	now := u.clock.Now()
+	u.userCounter++
+	newUser := User{
+		Name:      fmt.Sprintf("<p%s%02d>", now.Format("0102-15"), u.userCounter%100),
+		UserLevel: LevelUser,
+		ValidFrom: now,
+	}
+	switch u.tempPinKind {
+	case '1':
+		newUser.ValidTo = now.Add(time.Duration(number) * time.Hour)
+	case '2':
+		newUser.ValidTo = now.Add(time.Duration(number) * 24 * time.Hour)
+	case '3':
+		newUser.ValidTo = now.Add(tempPinUsesValidity)
+		newUser.UsesLeft = number
+	}
+
+	var pin, msg string
+	ok := false
+	for attempt := 0; !ok && attempt < 3; attempt++ { // PIN might be taken.
+		pin = newTempPin()
+		newUser.SetAuthCode(pin)
+		ok, msg = u.auth.AddNewUser(u.authUserCode, newUser)
+	}
+	if !ok {
+		u.t.WriteLCD(0, "Trouble:"+msg)
+		u.t.WriteLCD(1, "[*] Done")
+		u.setStateWithTimeout(StateDisplayInfoMessage, 5*time.Second)
+		return
+	}
+	u.t.WriteLCD(0, "Temp PIN: "+pin)
+	if newUser.UsesLeft > 0 {
+		u.t.WriteLCD(1, fmt.Sprintf("%d uses til %s", newUser.UsesLeft,
+			newUser.ValidTo.Format("Jan 02")))
+	} else {
+		u.t.WriteLCD(1, "Until "+newUser.ValidTo.Format("Jan 02 15:04"))
+	}
+	// Gone when we're back to idle.
+	u.setStateWithTimeout(StateDisplayInfoMessage, 60*time.Second)
+}
+
+// Members can check in to open the space to the public, or close it.
+func (u *UIControlHandler) toggleSpaceOpen() {
+	member := u.auth.FindUser(u.authUserCode)
+	if member == nil {
+		return
+	}
+	space := u.backends.spaceStatus
+	if space.IsOpen() {
+		space.Close(member.Name)
+		u.t.WriteLCD(0, "Closed to public.")
+		u.t.WriteLCD(1, "Thanks!")
+		u.setStateWithTimeout(StateDisplayInfoMessage, 3*time.Second)
+		return
+	}
+	if open, count := space.CheckIn(member); open {
+		u.t.WriteLCD(0, "Open to public.")
+		u.t.WriteLCD(1, "Don't forget to close!")
+		u.setStateWithTimeout(StateDisplayInfoMessage, 3*time.Second)
+	} else {
+		u.t.WriteLCD(0, fmt.Sprintf("Checked in %d/%d",
+			count, space.requiredCheckins))
+		u.t.WriteLCD(1, fmt.Sprintf("[*]Done [8]Alone %dh",
+			space.soloDuration/time.Hour))
+		u.setStateWithTimeout(StateSpaceCheckin, 10*time.Second)
+	}
+}
+
 func (u *UIControlHandler) startDoorOpenUI(target Target, message string) {
 	now := time.Now()
 
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func pressKeys(u *UIControlHandler, keys string) {
+	for _, key := range []byte(keys) {
+		u.HandleKeypress(key)
+	}
+}
+
+// Walk through the menu as member; returns the PIN shown.
+func addTempPin(t *testing.T, u *UIControlHandler, term *MockTerminal, keys string) string {
+	t.Helper()
+	u.HandleRFID("root123")
+	pressKeys(u, "17")
+	ExpectTrue(t, term.lcd[1] == "[1]Hours [2]Days [3]Uses", term.lcd[1])
+	pressKeys(u, keys)
+	if !strings.HasPrefix(term.lcd[0], "Temp PIN: ") {
+		t.Fatalf("Expected PIN, got '%s' '%s'", term.lcd[0], term.lcd[1])
+	}
+	pin := strings.TrimPrefix(term.lcd[0], "Temp PIN: ")
+	ExpectTrue(t, len(pin) == tempPinLength, "PIN length")
+	u.HandleKeypress('*')
+	ExpectFalse(t, strings.Contains(term.lcd[0]+term.lcd[1], pin), "Shown only once")
+	return pin
+}
+
+func TestControlTerminalTempPin(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-temp-pin")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	clock := &MockClock{now: time.Date(2026, 10, 1, 14, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, clock)
+	bus := NewApplicationBus()
+	backends := &Backends{authenticator: auth, appEventBus: bus, config: DefaultConfig()}
+	term := NewMockTerminal(t)
+	control := NewControlHandler(backends)
+	control.clock = clock
+	control.Init(term)
+
+	// Out of range; then 4 hours; the 4 doesn't open the elevator.
+	control.HandleRFID("root123")
+	pressKeys(control, "171")
+	pressKeys(control, "99#")
+	ExpectTrue(t, term.lcd[0] == "Hours? 1..72 please", term.lcd[0])
+	pressKeys(control, "4#")
+	pin := strings.TrimPrefix(term.lcd[0], "Temp PIN: ")
+	ExpectTrue(t, term.lcd[1] == "Until Oct 01 18:00", term.lcd[1])
+	control.HandleKeypress('*')
+	user := auth.FindUser(pin)
+	ExpectTrue(t, user != nil && strings.HasPrefix(user.Name, "<p1001-14") &&
+		user.UserLevel == LevelUser && user.Codes[0] == hashAuthCode(pin), "Stored hashed")
+
+	// Accepted on the keypad of the gate.
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events, OnlyEvents(AppOpenRequest))
+	gate := NewAccessHandler(backends)
+	gate.clock = clock
+	gate.Init(NewMockTerminal(t))
+	clock.now = clock.now.Add(time.Minute)
+	for _, key := range []byte(pin + "#") {
+		gate.HandleKeypress(key)
+	}
+	select {
+	case event := <-events:
+		ExpectTrue(t, event.Target == "mock", "Opened")
+	case <-time.After(asyncTestTimeout):
+		t.Error("PIN not accepted")
+	}
+	clock.now = clock.now.Add(4 * time.Hour)
+	ExpectAuthResult(t, auth, pin, TargetDownstairs, AuthExpired, "expired")
+
+	// Limited uses.
+	pin = addTempPin(t, control, term, "32#")
+	clock.now = clock.now.Add(time.Minute)
+	ExpectAuthResult(t, auth, pin, TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, pin, TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, pin, TargetDownstairs, AuthExpired, "expired")
+
+	// Days.
+	pin = addTempPin(t, control, term, "23#")
+	ExpectTrue(t, auth.FindUser(pin).ValidTo.Equal(clock.now.Add(3*24*time.Hour)), "3 days")
+
+	// Only members hand out temp PINs, even if others can add users.
+	philanthropist := User{Name: "Phil", ContactInfo: "phil@example.com",
+		UserLevel: LevelTrustedPhilanthropist}
+	philanthropist.SetAuthCode("phil1234")
+	ok, _ := auth.AddNewUser("root123", philanthropist)
+	ExpectTrue(t, ok, "Add philanthropist")
+	control.HandleKeypress('*')
+	control.HandleRFID("phil1234")
+	pressKeys(control, "1")
+	ExpectTrue(t, term.lcd[0] == "Read new user RFID", term.lcd[0])
+	ExpectTrue(t, term.lcd[1] == "[*] Cancel", term.lcd[1])
+	pressKeys(control, "7")
+	ExpectTrue(t, term.lcd[0] == "Read new user RFID", "No temp PIN menu")
+}
+
+func TestControlTerminalMemberMenu(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-member-menu")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	bus := NewApplicationBus()
+	backends := &Backends{authenticator: auth, appEventBus: bus, config: DefaultConfig(),
+		spaceStatus: NewSpaceStatus("", 1, time.Hour, bus)}
+	term := NewMockTerminal(t)
+	control := NewControlHandler(backends)
+	control.Init(term)
+
+	control.HandleRFID("root123")
+	ExpectTrue(t, len(term.lcd[0]) <= 24 && strings.HasSuffix(term.lcd[0], "[3]Open"),
+		term.lcd[0])
+	ExpectTrue(t, term.lcd[1] == "[*]ESC [1]Add [2]Renew", term.lcd[1])
+
+	pressKeys(control, "3")
+	ExpectTrue(t, backends.spaceStatus.IsOpen(), "Opened")
+	control.HandleKeypress('*')
+	control.HandleRFID("root123")
+	ExpectTrue(t, len(term.lcd[0]) <= 24 && strings.HasSuffix(term.lcd[0], "[3]Close"),
+		term.lcd[0])
+	ExpectTrue(t, term.lcd[1] == "[*]ESC [1]Add [2]Renew", term.lcd[1])
+}
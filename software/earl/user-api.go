@@ -0,0 +1,336 @@
+// REST API to manage users.
+//
+// Mirrors the Authenticator interface, so all the operations are subject
+// to the same authorization as adding users on the control terminal.
+//
+//	GET    /api/users         list all users
+//	GET    /api/users/<code>  get user with given code
+//	POST   /api/users         add new user; code in the JSON body
+//	PUT    /api/users/<code>  update user. Only fields given are changed.
+//	DELETE /api/users/<code>  delete user
+//
+// Each request needs to be authenticated with an "Authorization: Bearer <code>"
+// header, with the code being the PIN or RFID of a member. API tokens for
+// scripts are just users with a long random code (that can't be typed on a
+// keypad), e.g. a trustedphilanthropist named "api:renewal-script".
+//
+// Responses never contain the hashed codes or sponsors.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Slow down brute-forcing codes over the network.
+	userApiAuthFailureDelay = 1 * time.Second
+
+	userApiTimeFormat = "2006-01-02 15:04" // same as in the CSV file.
+)
+
+// Checks the "Authorization: Bearer <code>" header of API requests.
+type BearerAuth struct {
+	auth  Authenticator
+	clock Clock
+
+	// Held while delaying a failed authentication, so that failures are
+	// serialized and can't be parallelized.
+	authFailureLock  sync.Mutex
+	authFailureDelay time.Duration
+}
+
+type UserApiServer struct {
+	*BearerAuth
+}
+
+// Representation of a user in responses.
+type JsonUser struct {
+	Name        string   `json:"name"`
+	ContactInfo string   `json:"contact_info"`
+	Level       Level    `json:"level"`
+	ValidFrom   string   `json:"valid_from,omitempty"`
+	ValidTo     string   `json:"valid_to,omitempty"`
+	Expires     string   `json:"expires,omitempty"` // Including implicit expiry.
+	Valid       bool     `json:"valid"`             // Currently valid.
+	Schedule    string   `json:"schedule,omitempty"`
+	Targets     []Target `json:"targets,omitempty"`
+	UsesLeft    int      `json:"uses_left,omitempty"` // Limited-use codes.
+}
+
+// Request to add or update a user. Fields not set are not modified.
+// Times are in "2006-01-02 15:04" format, empty string to remove the limit.
+type JsonUserRequest struct {
+	Code        string   `json:"code,omitempty"` // Plain code; only when adding
+	Name        *string  `json:"name"`
+	ContactInfo *string  `json:"contact_info"`
+	Level       *Level   `json:"level"`
+	ValidFrom   *string  `json:"valid_from"`
+	ValidTo     *string  `json:"valid_to"`
+	Schedule    *string  `json:"schedule"` // e.g. "Mon-Fri 18-22", "" for level default
+	Targets     []Target `json:"targets"`  // Empty list: all targets.
+}
+
+func NewUserApiServer(auth Authenticator, mux *http.ServeMux) *UserApiServer {
+	newObject := &UserApiServer{NewBearerAuth(auth)}
+	mux.Handle("/api/users", newObject)
+	mux.Handle("/api/users/", newObject)
+	return newObject
+}
+
+func formatUserApiTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(userApiTimeFormat)
+}
+
+func JsonUserFromUser(user *User, now time.Time) *JsonUser {
+	return &JsonUser{
+		Name:        user.Name,
+		ContactInfo: user.ContactInfo,
+		Level:       user.UserLevel,
+		ValidFrom:   formatUserApiTime(user.ValidFrom),
+		ValidTo:     formatUserApiTime(user.ValidTo),
+		Expires:     formatUserApiTime(user.ExpiryDate(now)),
+		Valid:       user.InValidityPeriod(now) && user.broken == "",
+		Schedule:    user.Schedule.String(),
+		Targets:     user.Targets,
+		UsesLeft:    user.UsesLeft,
+	}
+}
+
+// Apply the fields set in the request to the user. Returns an error message
+// if something is not valid.
+func (r *JsonUserRequest) applyTo(user *User) string {
+	if r.Name != nil {
+		user.Name = *r.Name
+	}
+	if r.ContactInfo != nil {
+		user.ContactInfo = *r.ContactInfo
+	}
+	if r.Level != nil {
+		if !isValidLevel(string(*r.Level)) {
+			return "Invalid level"
+		}
+		user.UserLevel = *r.Level
+	}
+	var err error
+	if r.ValidFrom != nil {
+		user.ValidFrom = time.Time{}
+		if *r.ValidFrom != "" {
+			if user.ValidFrom, err = time.Parse(userApiTimeFormat, *r.ValidFrom); err != nil {
+				return "Invalid valid_from"
+			}
+		}
+	}
+	if r.ValidTo != nil {
+		user.ValidTo = time.Time{}
+		if *r.ValidTo != "" {
+			if user.ValidTo, err = time.Parse(userApiTimeFormat, *r.ValidTo); err != nil {
+				return "Invalid valid_to"
+			}
+		}
+	}
+	if r.Schedule != nil {
+		if user.Schedule, err = ParseSchedule(*r.Schedule); err != nil {
+			return "Invalid schedule: " + err.Error()
+		}
+	}
+	if r.Targets != nil {
+		user.Targets = r.Targets
+		if len(user.Targets) == 0 {
+			user.Targets = nil
+		}
+	}
+	return ""
+}
+
+func writeJSONResponse(out http.ResponseWriter, status int, value interface{}) {
+	out.Header()["Content-Type"] = []string{"application/json"}
+	out.WriteHeader(status)
+	json.NewEncoder(out).Encode(value)
+}
+
+func writeJSONError(out http.ResponseWriter, status int, msg string) {
+	writeJSONResponse(out, status, map[string]string{"error": msg})
+}
+
+func NewBearerAuth(auth Authenticator) *BearerAuth {
+	return &BearerAuth{
+		auth:             auth,
+		clock:            RealClock{},
+		authFailureDelay: userApiAuthFailureDelay,
+	}
+}
+
+// Get the authentication code from the request and check that it belongs to
+// a member allowed to do the operation. Writes the error response and returns
+// empty string if not.
+func (s *BearerAuth) authenticate(out http.ResponseWriter, req *http.Request,
+	isOpAllowed func(Level) bool) (string, *User) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		out.Header()["WWW-Authenticate"] = []string{"Bearer"}
+		writeJSONError(out, http.StatusUnauthorized, "Authorization required.")
+		return "", nil
+	}
+	code := strings.TrimSpace(header[len("Bearer "):])
+	member := s.auth.FindUser(code)
+	if ok, msg := verifyMemberOpAllowed(member, isOpAllowed, s.clock.Now()); !ok {
+		s.authFailureLock.Lock()
+		time.Sleep(s.authFailureDelay)
+		s.authFailureLock.Unlock()
+		writeJSONError(out, http.StatusForbidden, msg)
+		return "", nil
+	}
+	return code, member
+}
+
+func (s *UserApiServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	userCode := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/users"), "/")
+	switch {
+	case req.Method == "GET" && userCode == "":
+		s.listUsers(out, req)
+	case req.Method == "GET":
+		s.getUser(out, req, userCode)
+	case req.Method == "POST" && userCode == "":
+		s.addUser(out, req)
+	case (req.Method == "PUT" || req.Method == "PATCH") && userCode != "":
+		s.updateUser(out, req, userCode)
+	case req.Method == "DELETE" && userCode != "":
+		s.deleteUser(out, req, userCode)
+	default:
+		writeJSONError(out, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+func (s *UserApiServer) listUsers(out http.ResponseWriter, req *http.Request) {
+	if code, _ := s.authenticate(out, req, CanLevelModify); code == "" {
+		return
+	}
+	now := s.clock.Now()
+	result := []*JsonUser{}
+	s.auth.IterateUsers(func(user User) {
+		result = append(result, JsonUserFromUser(&user, now))
+	})
+	writeJSONResponse(out, http.StatusOK, result)
+}
+
+func (s *UserApiServer) getUser(out http.ResponseWriter, req *http.Request, userCode string) {
+	if code, _ := s.authenticate(out, req, CanLevelModify); code == "" {
+		return
+	}
+	user := s.auth.FindUser(userCode)
+	if user == nil {
+		writeJSONError(out, http.StatusNotFound, "No user for code.")
+		return
+	}
+	writeJSONResponse(out, http.StatusOK, JsonUserFromUser(user, s.clock.Now()))
+}
+
+func (s *UserApiServer) readRequest(out http.ResponseWriter, req *http.Request,
+	member *User) *JsonUserRequest {
+	var request JsonUserRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeJSONError(out, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return nil
+	}
+	// Only members can hand out levels (and be it by updating existing
+	// users); on the control terminal, everyone else can only add
+	// regular users.
+	if request.Level != nil && *request.Level != LevelUser &&
+		member.UserLevel != LevelMember {
+		writeJSONError(out, http.StatusForbidden, "Only members can set this level.")
+		return nil
+	}
+	return &request
+}
+
+func (s *UserApiServer) addUser(out http.ResponseWriter, req *http.Request) {
+	code, member := s.authenticate(out, req, CanLevelAddDelete)
+	if code == "" {
+		return
+	}
+	request := s.readRequest(out, req, member)
+	if request == nil {
+		return
+	}
+	user := User{UserLevel: LevelUser}
+	if msg := request.applyTo(&user); msg != "" {
+		writeJSONError(out, http.StatusBadRequest, msg)
+		return
+	}
+	if !user.SetAuthCode(request.Code) {
+		writeJSONError(out, http.StatusBadRequest, "Code too short.")
+		return
+	}
+	now := s.clock.Now()
+	if user.ValidFrom.IsZero() {
+		user.ValidFrom = now // Like AddNewUser() does; so we report it.
+	}
+	if ok, msg := s.auth.AddNewUser(code, user); !ok {
+		writeJSONError(out, http.StatusConflict, msg)
+		return
+	}
+	writeJSONResponse(out, http.StatusCreated, JsonUserFromUser(&user, now))
+}
+
+func (s *UserApiServer) updateUser(out http.ResponseWriter, req *http.Request, userCode string) {
+	code, member := s.authenticate(out, req, CanLevelModify)
+	if code == "" {
+		return
+	}
+	request := s.readRequest(out, req, member)
+	if request == nil {
+		return
+	}
+	if request.Code != "" {
+		writeJSONError(out, http.StatusBadRequest, "Can't change code.")
+		return
+	}
+	if request.Level != nil && member.UserLevel != LevelMember {
+		// Not even demoting; that would allow to lock out members.
+		writeJSONError(out, http.StatusForbidden, "Only members can change levels.")
+		return
+	}
+	if s.auth.FindUser(userCode) == nil {
+		writeJSONError(out, http.StatusNotFound, "No user for code.")
+		return
+	}
+	errorMsg := ""
+	var updated User
+	ok, msg := s.auth.UpdateUser(code, userCode, func(user *User) bool {
+		errorMsg = request.applyTo(user)
+		updated = *user
+		return errorMsg == ""
+	})
+	if errorMsg != "" {
+		writeJSONError(out, http.StatusBadRequest, errorMsg)
+		return
+	}
+	if !ok {
+		writeJSONError(out, http.StatusConflict, msg)
+		return
+	}
+	writeJSONResponse(out, http.StatusOK, JsonUserFromUser(&updated, s.clock.Now()))
+}
+
+func (s *UserApiServer) deleteUser(out http.ResponseWriter, req *http.Request, userCode string) {
+	code, _ := s.authenticate(out, req, CanLevelAddDelete)
+	if code == "" {
+		return
+	}
+	if s.auth.FindUser(userCode) == nil {
+		writeJSONError(out, http.StatusNotFound, "No user for code.")
+		return
+	}
+	if ok, msg := s.auth.DeleteUser(code, userCode); !ok {
+		writeJSONError(out, http.StatusConflict, msg)
+		return
+	}
+	out.WriteHeader(http.StatusNoContent)
+}
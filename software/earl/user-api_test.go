@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type UserApiFixture struct {
+	t    *testing.T
+	auth Authenticator
+	mux  *http.ServeMux
+}
+
+func NewUserApiFixture(t *testing.T, authFile string) *UserApiFixture {
+	mux := http.NewServeMux()
+	auth := NewFileBasedAuthenticator(authFile, NewApplicationBus())
+	server := NewUserApiServer(auth, mux)
+	server.authFailureDelay = 0
+	return &UserApiFixture{t: t, auth: auth, mux: mux}
+}
+
+func (f *UserApiFixture) Request(method string, path string, authCode string,
+	body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authCode != "" {
+		req.Header.Set("Authorization", "Bearer "+authCode)
+	}
+	response := httptest.NewRecorder()
+	f.mux.ServeHTTP(response, req)
+	return response
+}
+
+func (f *UserApiFixture) ExpectStatus(response *httptest.ResponseRecorder,
+	status int, context string) {
+	if response.Code != status {
+		f.t.Errorf("%s: expected status %d, got %d (%s)", context, status,
+			response.Code, response.Body.String())
+	}
+}
+
+func TestUserApi(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-user-api")
+	CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	f := NewUserApiFixture(t, authFile.Name())
+
+	f.ExpectStatus(f.Request("GET", "/api/users", "", ""),
+		http.StatusUnauthorized, "No authentication")
+
+	response := f.Request("POST", "/api/users", "root123",
+		`{"code":"doe123", "name":"Jon Doe", "contact_info":"jon@doe", "valid_to":"2030-01-01 00:00"}`)
+	f.ExpectStatus(response, http.StatusCreated, "Add user")
+	var user JsonUser
+	json.Unmarshal(response.Body.Bytes(), &user)
+	ExpectTrue(t, user.Name == "Jon Doe" && user.Level == LevelUser,
+		"Added user defaults to level user")
+	ExpectTrue(t, user.ValidTo == "2030-01-01 00:00", "Valid-to set")
+	ExpectFalse(t, strings.Contains(response.Body.String(), hashAuthCode("doe123")),
+		"Response should not contain hashed code")
+	ExpectTrue(t, f.auth.FindUser("doe123") != nil, "User added")
+
+	f.ExpectStatus(f.Request("POST", "/api/users", "root123",
+		`{"code":"doe123", "name":"Duplicate"}`),
+		http.StatusConflict, "Adding duplicate code")
+
+	f.ExpectStatus(f.Request("POST", "/api/users", "root123",
+		`{"code":"sho"}`), http.StatusBadRequest, "Too short code")
+
+	// Regular users can't do anything.
+	f.ExpectStatus(f.Request("GET", "/api/users", "doe123", ""),
+		http.StatusForbidden, "Regular user listing")
+	f.ExpectStatus(f.Request("POST", "/api/users", "doe123",
+		`{"code":"other123"}`), http.StatusForbidden, "Regular user adding")
+
+	response = f.Request("GET", "/api/users", "root123", "")
+	f.ExpectStatus(response, http.StatusOK, "List users")
+	var users []JsonUser
+	json.Unmarshal(response.Body.Bytes(), &users)
+	ExpectTrue(t, len(users) == 2, "Two users listed")
+	ExpectFalse(t, strings.Contains(response.Body.String(), hashAuthCode("root123")),
+		"Listing should not contain hashed code")
+
+	f.ExpectStatus(f.Request("GET", "/api/users/nobody123", "root123", ""),
+		http.StatusNotFound, "Get non-existent user")
+
+	response = f.Request("PUT", "/api/users/doe123", "root123",
+		`{"contact_info":"new@doe", "valid_to":""}`)
+	f.ExpectStatus(response, http.StatusOK, "Update user")
+	found := f.auth.FindUser("doe123")
+	ExpectTrue(t, found.ContactInfo == "new@doe", "Contact info updated")
+	ExpectTrue(t, found.ValidTo.IsZero(), "Valid-to removed")
+	ExpectTrue(t, found.Name == "Jon Doe", "Name not touched")
+
+	f.ExpectStatus(f.Request("PUT", "/api/users/doe123", "root123",
+		`{"level":"admin"}`), http.StatusBadRequest, "Invalid level")
+
+	f.ExpectStatus(f.Request("DELETE", "/api/users/doe123", "root123", ""),
+		http.StatusNoContent, "Delete user")
+	ExpectTrue(t, f.auth.FindUser("doe123") == nil, "User deleted")
+}
+
+func TestUserApiLevelChanges(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-user-api-level")
+	CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	f := NewUserApiFixture(t, authFile.Name())
+
+	f.ExpectStatus(f.Request("POST", "/api/users", "root123",
+		`{"code":"phil123", "name":"Phil", "contact_info":"p@nb", "level":"trustedphilanthropist"}`),
+		http.StatusCreated, "Member adding trusted philanthropist")
+
+	f.ExpectStatus(f.Request("POST", "/api/users", "phil123",
+		`{"code":"user123", "name":"User", "contact_info":"u@nb"}`),
+		http.StatusCreated, "Trusted philanthropist adding user")
+
+	f.ExpectStatus(f.Request("POST", "/api/users", "phil123",
+		`{"code":"member123", "level":"member"}`),
+		http.StatusForbidden, "Trusted philanthropist adding member")
+
+	f.ExpectStatus(f.Request("PUT", "/api/users/phil123", "phil123",
+		`{"level":"member"}`),
+		http.StatusForbidden, "Trusted philanthropist promoting themselves")
+
+	f.ExpectStatus(f.Request("PUT", "/api/users/user123", "root123",
+		`{"level":"fulltimeuser"}`),
+		http.StatusOK, "Member changing level")
+	ExpectTrue(t, f.auth.FindUser("user123").UserLevel == LevelFulltimeUser,
+		"Level changed")
+}
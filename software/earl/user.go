@@ -9,7 +9,9 @@ package main
 
 import (
 	"encoding/csv"
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -71,41 +73,89 @@ type User struct {
 	ValidFrom   time.Time // E.g. for temporary classes pin
 	ValidTo     time.Time // for anonymous tokens, day visitors or temp PIN
 	Codes       []string  // List of (hashed) codes associated with user
+	Schedule    *Schedule // Optional; custom instead of level access times.
+	Targets     []Target  // Optional; only these doors. Empty: all.
+	UsesLeft    int       // Optional; for limited-use codes. 0: unlimited.
+
+	// Set if the level or the optional fields in the file can't be
+	// parsed. Such users get no access, and the fields are written back
+	// as they were.
+	broken       string
+	brokenFields []string
 }
 
 // User CSV
 // Fields are stored in the sequence as they appear in the struct, with arrays
 // being represented as semicolon separated lists.
+// The last three fields (schedule, targets, uses left) are optional, so
+// older files with 7 fields still work.
 // Create a new user read from a CSV reader
 func NewUserFromCSV(reader *csv.Reader) (user *User, done bool) {
 	line, err := reader.Read()
 	if err != nil {
 		return nil, true
 	}
-	if len(line) != 7 {
-		return nil, false
+	return NewUserFromCSVLine(line), false
+}
+
+// Create a new user from the fields of a CSV line. Returns nil for comments
+// and lines that are too short or long.
+func NewUserFromCSVLine(line []string) *User {
+	if len(line) < 7 || len(line) > 10 {
+		return nil
 	}
 	// comment
 	firstElement := strings.TrimSpace(line[0])
 	if len(firstElement) > 0 && firstElement[0] == '#' {
-		return nil, false
+		return nil
 	}
+	var err error
 	level := line[2]
 	ValidFrom, _ := time.Parse("2006-01-02 15:04", line[4])
 	ValidTo, _ := time.Parse("2006-01-02 15:04", line[5])
+	var broken []string
 	if !isValidLevel(level) {
-		log.Printf("Got invalid level '%s'", level)
-		return nil, false
+		broken = append(broken, fmt.Sprintf("level '%s'", level))
+	}
+	var schedule *Schedule
+	if len(line) > 7 {
+		if schedule, err = ParseSchedule(line[7]); err != nil {
+			broken = append(broken, fmt.Sprintf("schedule: %v", err))
+		}
+	}
+	var targets []Target
+	if len(line) > 8 && line[8] != "" {
+		for _, target := range strings.Split(line[8], ";") {
+			targets = append(targets, Target(target))
+		}
+	}
+	uses_left := 0
+	if len(line) > 9 && line[9] != "" {
+		if uses_left, err = strconv.Atoi(line[9]); err != nil || uses_left < 0 {
+			broken = append(broken, fmt.Sprintf("uses left '%s'", line[9]))
+		}
+	}
+	user := &User{
+		Name:        line[0],
+		ContactInfo: line[1],
+		UserLevel:   Level(level),
+		Sponsors:    strings.Split(line[3], ";"),
+		ValidFrom:   ValidFrom, // field 4
+		ValidTo:     ValidTo,   // field 5
+		Codes:       strings.Split(line[6], ";"),
+		Schedule:    schedule,  // field 7
+		Targets:     targets,   // field 8
+		UsesLeft:    uses_left, // field 9
 	}
-	return &User{
-			Name:        line[0],
-			ContactInfo: line[1],
-			UserLevel:   Level(level),
-			Sponsors:    strings.Split(line[3], ";"),
-			ValidFrom:   ValidFrom, // field 4
-			ValidTo:     ValidTo,   // field 5
-			Codes:       strings.Split(line[6], ";")},
-		false
+	if len(broken) > 0 {
+		// Keep the user, so that the entry is not lost when the
+		// file is written next time.
+		user.broken = strings.Join(broken, ", ")
+		user.brokenFields = append([]string{}, line[7:]...)
+		log.Printf("BROKEN entry for '%s' (%s): no access until fixed in the file.",
+			line[0], user.broken)
+	}
+	return user
 }
 
 func isValidLevel(input string) bool {
@@ -115,11 +165,19 @@ func isValidLevel(input string) bool {
 	default:
 		return false
 	}
-	return false // Make old compilers happy.
 }
 
 func (user *User) WriteCSV(writer *csv.Writer) {
-	var fields []string = make([]string, 7)
+	// Only write the optional fields if needed, so that the file stays
+	// readable by older versions.
+	field_count := 7
+	if user.Schedule != nil || len(user.Targets) > 0 {
+		field_count = 9
+	}
+	if user.UsesLeft > 0 {
+		field_count = 10
+	}
+	var fields []string = make([]string, field_count)
 	fields[0] = user.Name
 	fields[1] = user.ContactInfo
 	fields[2] = string(user.UserLevel)
@@ -131,6 +189,16 @@ func (user *User) WriteCSV(writer *csv.Writer) {
 		fields[5] = user.ValidTo.Format("2006-01-02 15:04")
 	}
 	fields[6] = strings.Join(user.Codes, ";")
+	if field_count > 7 {
+		fields[7] = user.Schedule.String()
+		fields[8] = joinTargets(user.Targets)
+	}
+	if field_count > 9 {
+		fields[9] = strconv.Itoa(user.UsesLeft)
+	}
+	if user.brokenFields != nil {
+		fields = append(fields[:7], user.brokenFields...)
+	}
 	writer.Write(fields)
 }
 
@@ -149,6 +217,19 @@ func (user *User) InValidityPeriod(now time.Time) bool {
 		(expires.IsZero() || expires.After(now))
 }
 
+// Count the use of a limited-use code; the last use expires it. Returns
+// false if the code is not limited.
+func (user *User) ConsumeUse(now time.Time) bool {
+	if user.UsesLeft <= 0 {
+		return false
+	}
+	user.UsesLeft--
+	if user.UsesLeft == 0 {
+		user.ValidTo = now
+	}
+	return true
+}
+
 // Return when code expires. If the returned date IsZero(), there is no limit.
 // Even if there is no explicit user.ValidTo
 // limited when there is no contact info 30 days after creation
@@ -180,12 +261,48 @@ func (user *User) AccessHours() (from int, to int) {
 	case LevelUser:
 		return 10, 23 // 10:00 .. 22:59
 	}
-	// TODO: for time-restricted users such as users for classes,
-	// we can have custom hours here that don't depend on the UserLevel
-
 	return 0, 0 // no access.
 }
 
+// Returns the schedule in which this user may open doors: their custom
+// schedule if they have one, otherwise the AccessHours() of their level.
+func (user *User) AccessSchedule() *Schedule {
+	if user.Schedule != nil {
+		return user.Schedule
+	}
+	return NewDailySchedule(user.AccessHours())
+}
+
+// Human readable access times, e.g. "10:00..23:00" or a custom schedule.
+func (user *User) AccessTimeString() string {
+	if user.Schedule != nil {
+		return user.Schedule.String()
+	}
+	from, to := user.AccessHours()
+	return fmt.Sprintf("%d:00..%d:00", from, to)
+}
+
+// Is the user allowed at this target at all ?
+func (user *User) HasTarget(target Target) bool {
+	if len(user.Targets) == 0 {
+		return true
+	}
+	for _, t := range user.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func joinTargets(targets []Target) string {
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = string(target)
+	}
+	return strings.Join(names, ";")
+}
+
 // Set the auth code to some value (should probably be add-auth-code)
 // Returns true if code is long enough to meet criteria.
 // (todo: right now we only set one code, but we need something like add)
@@ -0,0 +1,240 @@
+// Webhooks: tell other machines about events by POSTing to them, e.g. the
+// doorbell speakers upstairs. Configured in the -config file (see
+// WebhookConfig).
+//
+// Each webhook subscribes to the events it is interested in with its own
+// queue on the ApplicationBus, and is delivered from its own goroutine; so a
+// slow or unreachable receiver never holds up door handling (or the other
+// webhooks). Deliveries time out and are retried with increasing backoff; if
+// events keep coming in faster than they can be delivered, the oldest are
+// dropped.
+//
+// The body is the event JSON as in the API, or built from the payload
+// template. The template is plain text/template; values put into the JSON
+// need to go through the json function, which quotes and escapes them:
+//
+//	payload: '{"tone": {{json .Target}}, "text": {{json .Msg}}}'
+//
+// With a secret, the body is signed with HMAC-SHA256, so that
+// receivers can check it came from us:
+//
+//	X-Earl-Signature: sha256=<hex HMAC of the body>
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	defaultWebhookRetries = 3
+
+	// Events waiting for a webhook that doesn't keep up.
+	webhookQueueSize = 20
+
+	// Time to wait before the first retry; doubled for each further retry.
+	webhookRetryBackoff = 2 * time.Second
+)
+
+var (
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: "webhook",
+			Name:      "deliveries_total",
+			Help:      "Webhook deliveries by result: ok, retry, failed",
+		},
+		[]string{"webhook", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveries)
+}
+
+type webhook struct {
+	config   *WebhookConfig
+	payload  *template.Template // nil: event JSON
+	client   *http.Client
+	backoff  time.Duration // Before the first retry.
+	bus      *ApplicationBus
+	events   AppEventChannel
+	done     chan struct{}
+	finished chan struct{}
+}
+
+type WebhookDispatcher struct {
+	hooks []*webhook
+}
+
+// Data available in the payload template.
+type webhookTemplateData struct {
+	*AppEvent
+	Json string // The event as JSON, like in the API.
+}
+
+// Functions available in the payload template.
+var webhookTemplateFuncs = template.FuncMap{
+	// Value as JSON, e.g. a string with quotes and escapes.
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+func parseWebhookPayload(config *WebhookConfig) (*template.Template, error) {
+	if config.Payload == "" {
+		return nil, nil
+	}
+	return template.New(config.Name).Funcs(webhookTemplateFuncs).Parse(config.Payload)
+}
+
+// Subscribes to the bus; call Run() to start delivering.
+func NewWebhookDispatcher(configs []*WebhookConfig, bus *ApplicationBus) *WebhookDispatcher {
+	d := &WebhookDispatcher{}
+	for _, config := range configs {
+		payload, err := parseWebhookPayload(config)
+		if err != nil {
+			// Checked in config validation already.
+			log.Printf("Webhook %s: %v", config.Name, err)
+			continue
+		}
+		hook := &webhook{
+			config:   config,
+			payload:  payload,
+			client:   &http.Client{Timeout: config.Timeout},
+			backoff:  webhookRetryBackoff,
+			bus:      bus,
+			events:   make(AppEventChannel, 1),
+			done:     make(chan struct{}),
+			finished: make(chan struct{}),
+		}
+		options := []SubscribeOption{
+			SubscriberName("webhook:" + config.Name),
+			QueueSize(webhookQueueSize),
+		}
+		if len(config.Events) > 0 {
+			options = append(options, OnlyEvents(config.Events...))
+		}
+		if len(config.Targets) > 0 {
+			options = append(options, OnlyTargets(config.Targets...))
+		}
+		bus.Subscribe(hook.events, options...)
+		d.hooks = append(d.hooks, hook)
+	}
+	return d
+}
+
+func (d *WebhookDispatcher) Run() {
+	for _, hook := range d.hooks {
+		go hook.run()
+	}
+}
+
+// Stop delivering; events not delivered yet are dropped.
+func (d *WebhookDispatcher) Shutdown() {
+	for _, hook := range d.hooks {
+		hook.bus.Unsubscribe(hook.events)
+		close(hook.done)
+		<-hook.finished
+	}
+}
+
+func (h *webhook) run() {
+	defer close(h.finished)
+	for {
+		select {
+		case event := <-h.events:
+			h.deliver(event)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *webhook) body(event *AppEvent) ([]byte, error) {
+	encoded, err := encodeEvent(event)
+	if err != nil || h.payload == nil {
+		return encoded, err
+	}
+	var body bytes.Buffer
+	err = h.payload.Execute(&body, &webhookTemplateData{AppEvent: event, Json: string(encoded)})
+	return body.Bytes(), err
+}
+
+// Deliver the event, retrying on failure. Returns early on Shutdown().
+func (h *webhook) deliver(event *AppEvent) {
+	name := h.config.Name
+	body, err := h.body(event)
+	if err != nil {
+		log.Printf("Webhook %s: %v", name, err)
+		webhookDeliveries.WithLabelValues(name, "failed").Inc()
+		return
+	}
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(event, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(name, "ok").Inc()
+			return
+		}
+		if !retry || attempt >= h.config.Retries {
+			log.Printf("Webhook %s: giving up on %s: %v", name, event.Ev, err)
+			webhookDeliveries.WithLabelValues(name, "failed").Inc()
+			return
+		}
+		webhookDeliveries.WithLabelValues(name, "retry").Inc()
+		select {
+		case <-time.After(backoff):
+		case <-h.done:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// POST the body once. Returns if it is worth trying again on error.
+func (h *webhook) post(event *AppEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "earl/"+Version)
+	req.Header.Set("X-Earl-Event", string(event.Ev))
+	req.Header.Set("X-Earl-Seq", fmt.Sprint(event.Seq))
+	if h.config.Secret != "" {
+		req.Header.Set("X-Earl-Signature", "sha256="+signWebhookBody(h.config.Secret, body))
+	}
+	response, err := h.client.Do(req)
+	if err != nil {
+		return true, err // Network trouble or timeout.
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	switch {
+	case response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("status %s", response.Status)
+	}
+	return false, fmt.Errorf("status %s", response.Status)
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
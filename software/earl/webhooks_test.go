@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+// A receiver recording what is POSTed to it. Answers with the given status
+// codes in turn, then 200.
+type WebhookReceiver struct {
+	server   *httptest.Server
+	requests chan *webhookRequest
+	statuses chan int
+}
+
+func NewWebhookReceiver(t *testing.T, statuses ...int) *WebhookReceiver {
+	r := &WebhookReceiver{
+		requests: make(chan *webhookRequest, 100),
+		statuses: make(chan int, len(statuses)),
+	}
+	for _, status := range statuses {
+		r.statuses <- status
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.requests <- &webhookRequest{header: req.Header, body: string(body)}
+		select {
+		case status := <-r.statuses:
+			out.WriteHeader(status)
+		default:
+		}
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *WebhookReceiver) Expect(t *testing.T) *webhookRequest {
+	t.Helper()
+	select {
+	case request := <-r.requests:
+		return request
+	case <-time.After(asyncTestTimeout):
+		t.Fatal("Timeout waiting for webhook")
+	}
+	return nil
+}
+
+func (r *WebhookReceiver) ExpectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case request := <-r.requests:
+		t.Errorf("Unexpected webhook %s", request.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func startWebhooks(t *testing.T, bus *ApplicationBus, configs ...*WebhookConfig) {
+	config := &Config{Targets: []*TargetConfig{{Name: TargetDownstairs}}, Webhooks: configs}
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := NewWebhookDispatcher(configs, bus)
+	for _, hook := range dispatcher.hooks {
+		hook.backoff = time.Millisecond
+	}
+	dispatcher.Run()
+	t.Cleanup(dispatcher.Shutdown)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	bus := NewApplicationBus()
+	plain := NewWebhookReceiver(t)
+	templated := NewWebhookReceiver(t)
+	startWebhooks(t, bus,
+		&WebhookConfig{URL: plain.server.URL, Secret: "s3cr3t",
+			Events: []AppEventType{AppDoorbellTriggerEvent}},
+		&WebhookConfig{URL: templated.server.URL + "/bell/",
+			Targets: []Target{TargetDownstairs},
+			Payload: `{"tone": {{json .Target}}, "text": {{json .Msg}}, "event": {{.Json}}}`})
+
+	bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs})
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs, Msg: `ring "twice" \ please`})
+
+	request := plain.Expect(t)
+	event := &JsonAppEvent{}
+	ExpectTrue(t, json.Unmarshal([]byte(request.body), event) == nil, "Event JSON")
+	ExpectTrue(t, event.Ev == AppDoorbellTriggerEvent && event.Msg == `ring "twice" \ please` && event.Seq == 2,
+		"Doorbell event")
+	ExpectTrue(t, request.header.Get("X-Earl-Event") == "trigger-bell", "Event header")
+	ExpectTrue(t, request.header.Get("X-Earl-Signature") ==
+		"sha256="+signWebhookBody("s3cr3t", []byte(request.body)), "Signature")
+	plain.ExpectNone(t) // Not the open request.
+
+	request = templated.Expect(t)
+	var payload struct {
+		Tone  string
+		Text  string
+		Event JsonAppEvent
+	}
+	ExpectTrue(t, json.Unmarshal([]byte(request.body), &payload) == nil, request.body)
+	ExpectTrue(t, payload.Tone == "gate" && payload.Event.Seq == 2, "Templated payload")
+	ExpectTrue(t, payload.Text == `ring "twice" \ please`, "Escaped in template")
+	ExpectTrue(t, request.header.Get("X-Earl-Signature") == "", "No secret, no signature")
+	templated.ExpectNone(t) // Not upstairs.
+}
+
+func TestWebhookRetries(t *testing.T) {
+	bus := NewApplicationBus()
+	flaky := NewWebhookReceiver(t, 500, 503)
+	broken := NewWebhookReceiver(t, 404)
+	startWebhooks(t, bus,
+		&WebhookConfig{URL: flaky.server.URL},
+		&WebhookConfig{URL: broken.server.URL})
+
+	bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	for i := 0; i < 3; i++ {
+		ExpectTrue(t, flaky.Expect(t).header.Get("X-Earl-Seq") == "1", "Same event again")
+	}
+	flaky.ExpectNone(t)
+	broken.Expect(t)
+	broken.ExpectNone(t) // Not worth retrying.
+}
+
+func TestSlowWebhookDoesNotHoldUpOthers(t *testing.T) {
+	bus := NewApplicationBus()
+	stuck := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, req *http.Request) {
+		<-stuck
+	}))
+	defer slow.Close()
+	defer close(stuck)
+	fast := NewWebhookReceiver(t)
+	startWebhooks(t, bus,
+		&WebhookConfig{URL: slow.URL, Timeout: time.Hour},
+		&WebhookConfig{URL: fast.server.URL})
+
+	for i := 0; i < 5; i++ {
+		bus.Post(&AppEvent{Ev: AppDoorbellTriggerEvent, Target: TargetDownstairs})
+	}
+	for i := 0; i < 5; i++ {
+		fast.Expect(t)
+	}
+}